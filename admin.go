@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisOverridesKey holds the JSON overrides set through PUT /admin/config.
+// Every replica polls it, so a change reaches all of them within
+// ADMIN_CONFIG_REFRESH.
+const redisOverridesKey = "config_overrides"
+
+// tuning is the part of the configuration that can change at runtime.
+type tuning struct {
+	WindowSize int     `json:"windowSize"`
+	ZThreshold float64 `json:"zThreshold"`
+	Detector   string  `json:"detector"`
+}
+
+// overrides are the tuning values set through the admin API; a nil field
+// keeps the configured value.
+type overrides struct {
+	WindowSize *int     `json:"windowSize,omitempty"`
+	ZThreshold *float64 `json:"zThreshold,omitempty"`
+	Detector   *string  `json:"detector,omitempty"`
+	UpdatedAt  int64    `json:"updatedAt,omitempty"`
+}
+
+func (o overrides) apply(t tuning) tuning {
+	if o.WindowSize != nil {
+		t.WindowSize = *o.WindowSize
+	}
+	if o.ZThreshold != nil {
+		t.ZThreshold = *o.ZThreshold
+	}
+	if o.Detector != nil {
+		t.Detector = *o.Detector
+	}
+	return t
+}
+
+// runtimeTuning is what tuning() reads: the effective values and the
+// overrides they came from.
+type runtimeTuning struct {
+	effective tuning
+	overrides overrides
+}
+
+func configuredTuning(cfg Config) tuning {
+	return tuning{WindowSize: cfg.WindowSize, ZThreshold: cfg.ZThreshold, Detector: cfg.Detector}
+}
+
+// tuning returns the window size, z-score threshold and detector in effect.
+// Read it once per batch or request where the values must agree.
+func (s *Service) tuning() tuning {
+	return s.tune.Load().effective
+}
+
+// checkTuning applies the rules LoadConfig applies to WINDOW_SIZE,
+// Z_THRESHOLD and DETECTOR, including the ones that tie them to settings
+// that cannot change at runtime. The in-memory windows are sized and
+// created for the configured detector, so WINDOW_STORE=memory pins both.
+func (s *Service) checkTuning(t tuning) error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(t.WindowSize >= 2, "windowSize must be at least 2, got %d", t.WindowSize)
+	check(t.ZThreshold > 0 && !math.IsInf(t.ZThreshold, 0), "zThreshold must be a positive number, got %g", t.ZThreshold)
+	check(t.Detector == detectorWindow || t.Detector == detectorEWMA || t.Detector == detectorSeasonal,
+		"detector must be %q, %q or %q, got %q", detectorWindow, detectorEWMA, detectorSeasonal, t.Detector)
+
+	check(s.cfg.SmoothingWindow <= t.WindowSize, "windowSize must be at least SMOOTHING_WINDOW=%d", s.cfg.SmoothingWindow)
+	check(s.cfg.AnomalySamples <= t.WindowSize, "windowSize must be at least ANOMALY_SAMPLES=%d", s.cfg.AnomalySamples)
+	for _, w := range s.cfg.VoteWindows {
+		check(w <= t.WindowSize, "windowSize must be at least the largest of VOTE_WINDOWS, %d", w)
+	}
+	if t.Detector != detectorWindow {
+		check(len(s.cfg.VoteWindows) == 0, "detector %s does not work with VOTE_WINDOWS", t.Detector)
+		check(len(s.cfg.JointPatterns) == 0, "detector %s does not work with JOINT_PATTERNS", t.Detector)
+		check(s.cfg.AnomalySamples == 0, "detector %s does not work with ANOMALY_SAMPLES", t.Detector)
+		check(s.cfg.BaselineDecay == 0, "detector %s does not work with BASELINE_DECAY", t.Detector)
+	}
+	if s.cfg.WindowStore == windowStoreMemory {
+		check(t.WindowSize == s.cfg.WindowSize, "windowSize cannot change at runtime with WINDOW_STORE=%s", windowStoreMemory)
+		check(t.Detector == s.cfg.Detector, "detector cannot change at runtime with WINDOW_STORE=%s", windowStoreMemory)
+	}
+	return errors.Join(errs...)
+}
+
+// applyOverrides puts o into effect and logs what changed.
+func (s *Service) applyOverrides(ctx context.Context, o overrides) {
+	t := o.apply(configuredTuning(s.cfg))
+	prev := s.tune.Swap(&runtimeTuning{effective: t, overrides: o})
+	if prev != nil && prev.effective != t {
+		slog.InfoContext(ctx, "detector tuning changed",
+			"windowSize", t.WindowSize, "zThreshold", t.ZThreshold, "detector", t.Detector,
+			"previousWindowSize", prev.effective.WindowSize, "previousZThreshold", prev.effective.ZThreshold,
+			"previousDetector", prev.effective.Detector)
+	}
+}
+
+func (s *Service) loadOverrides(ctx context.Context) (overrides, error) {
+	var o overrides
+	b, err := s.redis().Get(ctx, s.key(redisOverridesKey)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return o, nil
+	}
+	if err != nil {
+		return o, err
+	}
+	if err := json.Unmarshal(b, &o); err != nil {
+		return o, fmt.Errorf("%s: %w", s.key(redisOverridesKey), err)
+	}
+	return o, nil
+}
+
+// refreshOverridesLoop picks up overrides set through any replica every
+// interval until the service starts stopping.
+func (s *Service) refreshOverridesLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-t.C:
+			s.refreshOverrides()
+		}
+	}
+}
+
+// refreshOverrides loads the stored overrides. Overrides that fail
+// checkTuning here, e.g. stored by a replica with a different
+// configuration, are logged and the current values stay.
+func (s *Service) refreshOverrides() {
+	o, err := s.loadOverrides(s.ctx)
+	if err != nil {
+		slog.Warn("config overrides reload failed", "key", s.key(redisOverridesKey), "err", err)
+		return
+	}
+	if err := s.checkTuning(o.apply(configuredTuning(s.cfg))); err != nil {
+		slog.Warn("ignoring invalid config overrides", "key", s.key(redisOverridesKey), "err", err)
+		return
+	}
+	s.applyOverrides(s.ctx, o)
+}
+
+type adminConfig struct {
+	Effective  tuning    `json:"effective"`
+	Configured tuning    `json:"configured"`
+	Overrides  overrides `json:"overrides"`
+}
+
+// handleAdminConfig shows the tuning in effect (GET), overrides some of it
+// for all replicas (PUT with a JSON object of windowSize, zThreshold and
+// detector; omitted fields keep their current override) or drops the
+// overrides (DELETE). Concurrent PUTs through different replicas are last
+// writer wins.
+func (s *Service) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req overrides
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeBodyError(w, "bad json", err)
+			return
+		}
+		o, err := s.loadOverrides(r.Context())
+		if err != nil {
+			http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if req.WindowSize != nil {
+			o.WindowSize = req.WindowSize
+		}
+		if req.ZThreshold != nil {
+			o.ZThreshold = req.ZThreshold
+		}
+		if req.Detector != nil {
+			o.Detector = req.Detector
+		}
+		if err := s.checkTuning(o.apply(configuredTuning(s.cfg))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		o.UpdatedAt = time.Now().Unix()
+		b, _ := json.Marshal(o)
+		if err := s.redis().Set(r.Context(), s.key(redisOverridesKey), b, 0).Err(); err != nil {
+			http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		s.applyOverrides(r.Context(), o)
+	case http.MethodDelete:
+		if err := s.redis().Del(r.Context(), s.key(redisOverridesKey)).Err(); err != nil {
+			http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		s.applyOverrides(r.Context(), overrides{})
+	default:
+		http.Error(w, "GET, PUT or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rt := s.tune.Load()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(adminConfig{
+		Effective:  rt.effective,
+		Configured: configuredTuning(s.cfg),
+		Overrides:  rt.overrides,
+	})
+}
+
+// newAdminAuthenticator returns nil when ADMIN_API_KEYS is empty. Admin
+// keys are separate from API_KEYS: an ingest key cannot retune detection.
+func newAdminAuthenticator(cfg Config) *authenticator {
+	if len(cfg.AdminAPIKeys) == 0 {
+		return nil
+	}
+	return &authenticator{static: hashKeys(cfg.AdminAPIKeys)}
+}
+
+// protectAdmin requires one of ADMIN_API_KEYS, passed like the ingest keys.
+// Without ADMIN_API_KEYS the admin API, /admin/config, /admin/sources and
+// /deadletter/replay, is off.
+func (s *Service) protectAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminAuth == nil {
+			http.Error(w, "admin API is disabled: set ADMIN_API_KEYS", http.StatusForbidden)
+			return
+		}
+		if key := requestKey(r.Header); key == "" || !s.adminAuth.valid(key) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "missing or invalid admin API key", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckTuning(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		t    tuning
+		want string
+	}{
+		{name: "valid", t: tuning{WindowSize: 10, ZThreshold: 2, Detector: detectorEWMA}},
+		{name: "window too small", t: tuning{WindowSize: 1, ZThreshold: 2, Detector: detectorWindow},
+			want: "windowSize must be at least 2"},
+		{name: "zero threshold", t: tuning{WindowSize: 10, ZThreshold: 0, Detector: detectorWindow},
+			want: "zThreshold must be a positive number"},
+		{name: "unknown detector", t: tuning{WindowSize: 10, ZThreshold: 2, Detector: "median"},
+			want: `detector must be "window", "ewma" or "seasonal"`},
+		{name: "below smoothing", env: []string{"SMOOTHING_WINDOW", "5"},
+			t:    tuning{WindowSize: 4, ZThreshold: 2, Detector: detectorWindow},
+			want: "windowSize must be at least SMOOTHING_WINDOW=5"},
+		{name: "below vote windows", env: []string{"VOTE_WINDOWS", "5,20"},
+			t:    tuning{WindowSize: 10, ZThreshold: 2, Detector: detectorWindow},
+			want: "windowSize must be at least the largest of VOTE_WINDOWS, 20"},
+		{name: "ewma with vote windows", env: []string{"VOTE_WINDOWS", "5"},
+			t:    tuning{WindowSize: 10, ZThreshold: 2, Detector: detectorEWMA},
+			want: "detector ewma does not work with VOTE_WINDOWS"},
+		{name: "memory store pins the window", env: []string{"WINDOW_STORE", "memory"},
+			t:    tuning{WindowSize: 10, ZThreshold: 3, Detector: detectorWindow},
+			want: "windowSize cannot change at runtime with WINDOW_STORE=memory"},
+		{name: "memory store takes a threshold", env: []string{"WINDOW_STORE", "memory"},
+			t: tuning{WindowSize: defaultWindowSize, ZThreshold: 3, Detector: detectorWindow}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newTestService(t, tt.env...)
+			err := svc.checkTuning(tt.t)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Fatalf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	svc, mr := newTestService(t)
+	do := func(method, body string) (adminConfig, int, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		svc.handleAdminConfig(rec, httptest.NewRequest(method, "/admin/config", strings.NewReader(body)))
+		var got adminConfig
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return got, rec.Code, rec.Body.String()
+	}
+	configured := configuredTuning(svc.cfg)
+
+	got, code, _ := do(http.MethodPut, `{"zThreshold":3}`)
+	if code != http.StatusOK || got.Effective.ZThreshold != 3 || got.Configured != configured || got.Overrides.UpdatedAt == 0 {
+		t.Fatalf("PUT zThreshold: %d %+v", code, got)
+	}
+	// Omitted fields keep the earlier override.
+	got, _, _ = do(http.MethodPut, `{"detector":"ewma"}`)
+	if want := (tuning{WindowSize: configured.WindowSize, ZThreshold: 3, Detector: detectorEWMA}); got.Effective != want || svc.tuning() != want {
+		t.Fatalf("effective %+v, tuning %+v, want %+v", got.Effective, svc.tuning(), want)
+	}
+
+	for _, tt := range []struct {
+		body, want string
+	}{
+		{`{"windowSize":1}`, "windowSize must be at least 2"},
+		{`{"zThreshold":-1}`, "zThreshold must be a positive number"},
+		{`{"alpha":0.5}`, "bad json"},
+	} {
+		if _, code, body := do(http.MethodPut, tt.body); code != http.StatusBadRequest || !strings.Contains(body, tt.want) {
+			t.Errorf("PUT %s: %d %q, want 400 %q", tt.body, code, body, tt.want)
+		}
+	}
+	if svc.tuning().ZThreshold != 3 {
+		t.Errorf("rejected PUT changed the tuning: %+v", svc.tuning())
+	}
+
+	// Another replica picks the stored overrides up on refresh.
+	other, _ := newTestService(t, "REDIS_ADDR", mr.Addr())
+	other.refreshOverrides()
+	if other.tuning() != svc.tuning() {
+		t.Errorf("other replica has %+v, want %+v", other.tuning(), svc.tuning())
+	}
+
+	got, code, _ = do(http.MethodDelete, "")
+	if code != http.StatusOK || got.Effective != configured || mr.Exists(svc.key(redisOverridesKey)) {
+		t.Fatalf("DELETE: %d %+v", code, got)
+	}
+	other.refreshOverrides()
+	if other.tuning() != configured {
+		t.Errorf("other replica kept %+v after DELETE", other.tuning())
+	}
+
+	if _, code, _ := do(http.MethodPost, "{}"); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d", code)
+	}
+}
+
+func TestRefreshOverridesIgnoresInvalid(t *testing.T) {
+	svc, mr := newTestService(t, "SMOOTHING_WINDOW", "10")
+	mr.Set(svc.key(redisOverridesKey), `{"zThreshold":4}`)
+	svc.refreshOverrides()
+	if svc.tuning().ZThreshold != 4 {
+		t.Fatalf("tuning %+v", svc.tuning())
+	}
+	// Valid where it was stored, not with this replica's SMOOTHING_WINDOW.
+	mr.Set(svc.key(redisOverridesKey), `{"windowSize":5}`)
+	svc.refreshOverrides()
+	if svc.tuning().ZThreshold != 4 || svc.tuning().WindowSize != svc.cfg.WindowSize {
+		t.Errorf("invalid overrides applied: %+v", svc.tuning())
+	}
+	mr.Set(svc.key(redisOverridesKey), "not json")
+	svc.refreshOverrides()
+	if svc.tuning().ZThreshold != 4 {
+		t.Errorf("corrupt overrides applied: %+v", svc.tuning())
+	}
+}
+
+func TestProtectAdmin(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name   string
+		keys   string
+		header string
+		want   int
+	}{
+		{name: "disabled", header: "Bearer admin", want: http.StatusForbidden},
+		{name: "missing key", keys: "admin", want: http.StatusUnauthorized},
+		{name: "wrong key", keys: "admin", header: "Bearer other", want: http.StatusUnauthorized},
+		{name: "valid key", keys: "admin,second", header: "Bearer second", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newTestService(t, "ADMIN_API_KEYS", tt.keys)
+			req := httptest.NewRequest(http.MethodGet, "/admin/config", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			svc.protectAdmin(ok).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
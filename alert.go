@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	alertFormatJSON         = "json"
+	alertFormatSlack        = "slack"
+	alertFormatAlertmanager = "alertmanager"
+
+	alertQueueSize      = 1000
+	alertRequestTimeout = 5 * time.Second
+	alertBackoff        = time.Second
+	// alertFlushTimeout bounds how long Drain waits for queued alerts.
+	alertFlushTimeout = 10 * time.Second
+)
+
+var (
+	alertNotifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "alert_notifications_total",
+		Help: "Anomaly webhook notifications by payload format and result",
+	}, []string{"format", "result"})
+	alertsSuppressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "alerts_suppressed_total",
+		Help: "Anomalies that did not alert because their stream was cooling down",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(alertNotifications, alertsSuppressed)
+	serviceRegistry.MustRegister(alertNotifications, alertsSuppressed)
+}
+
+type webhook struct {
+	format string
+	url    string
+}
+
+// parseWebhooks reads a comma-separated list of webhook URLs, each
+// optionally prefixed with its payload format, e.g.
+// "slack=https://hooks.slack.com/...,https://example.com/hook".
+func parseWebhooks(v string) ([]webhook, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var hooks []webhook
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		h := webhook{format: alertFormatJSON, url: part}
+		if f, u, ok := strings.Cut(part, "="); ok {
+			switch f {
+			case alertFormatJSON, alertFormatSlack, alertFormatAlertmanager:
+				h = webhook{format: f, url: u}
+			}
+		}
+		if !strings.HasPrefix(h.url, "http://") && !strings.HasPrefix(h.url, "https://") {
+			return nil, fmt.Errorf("webhook %q: URL must start with http:// or https://", part)
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// alerter posts anomalies to the configured webhooks. A stream alerts at
+// most once per cool-down, so a burst of anomalous samples produces a single
+// notification; on top of that, alertThrottle caps the alerts of a stream
+// that keeps escalating or anomalous for longer than the cool-down.
+// Delivery runs on its own goroutine and is
+// retried with exponential backoff; a full queue drops the alert rather
+// than blocking the worker. The cool-down and the throttle are tracked per
+// replica.
+type alerter struct {
+	hooks    []webhook
+	cooldown time.Duration
+	retries  int
+	client   *http.Client
+	events   chan Analysis
+	done     chan struct{}
+	throttle *alertThrottle
+
+	mu     sync.Mutex
+	last   map[string]lastAlert
+	closed bool
+}
+
+// lastAlert is the newest notification sent for a stream.
+type lastAlert struct {
+	at       time.Time
+	severity string
+}
+
+func newAlerter(cfg Config) *alerter {
+	if len(cfg.Webhooks) == 0 {
+		return nil
+	}
+	a := &alerter{
+		hooks:    cfg.Webhooks,
+		cooldown: cfg.AlertCooldown,
+		retries:  cfg.AlertRetries,
+		client:   &http.Client{Timeout: alertRequestTimeout},
+		events:   make(chan Analysis, alertQueueSize),
+		done:     make(chan struct{}),
+		last:     make(map[string]lastAlert),
+		throttle: newAlertThrottle(cfg),
+	}
+	go a.run()
+	return a
+}
+
+func (a *alerter) notify(anal Analysis) {
+	if a == nil {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	if last, ok := a.last[anal.Stream]; ok && now.Sub(last.at) < a.cooldown &&
+		severityRank(anal.Severity) <= severityRank(last.severity) {
+		alertsSuppressed.Inc()
+		return
+	}
+	// A throttled alert is not sent, so it does not start a cool-down.
+	if !a.throttle.allow(anal.Stream, now) {
+		return
+	}
+	a.last[anal.Stream] = lastAlert{at: now, severity: anal.Severity}
+
+	select {
+	case a.events <- anal:
+	default:
+		for _, h := range a.hooks {
+			alertNotifications.WithLabelValues(h.format, "dropped").Inc()
+		}
+	}
+}
+
+// close stops accepting alerts and waits up to timeout for the queued ones
+// to be delivered. Alerts still queued after that are lost.
+func (a *alerter) close(timeout time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.events)
+	a.mu.Unlock()
+
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+		slog.Warn("alert delivery still busy at shutdown, dropping the rest", "queued", len(a.events), "timeout", timeout.String())
+	}
+}
+
+func (a *alerter) run() {
+	defer close(a.done)
+	for anal := range a.events {
+		var wg sync.WaitGroup
+		for _, h := range a.hooks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a.deliver(h, anal)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func (a *alerter) deliver(h webhook, anal Analysis) {
+	body, err := alertPayload(h.format, anal)
+	if err != nil {
+		alertNotifications.WithLabelValues(h.format, "failed").Inc()
+		slog.Error("alert payload encoding failed", "format", h.format, "stream", anal.Stream, "err", err)
+		return
+	}
+
+	backoff := alertBackoff
+	for attempt := 0; ; attempt++ {
+		err = a.post(h.url, body)
+		if err == nil {
+			alertNotifications.WithLabelValues(h.format, "delivered").Inc()
+			return
+		}
+		if attempt >= a.retries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	alertNotifications.WithLabelValues(h.format, "failed").Inc()
+	slog.Error("alert webhook failed", "format", h.format, "stream", anal.Stream, "attempts", a.retries+1, "err", err)
+}
+
+func (a *alerter) post(url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), alertRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+type alertEvent struct {
+	Stream    string   `json:"stream"`
+	Timestamp int64    `json:"timestamp"`
+	Reason    string   `json:"reason"`
+	Severity  string   `json:"severity"`
+	Analysis  Analysis `json:"analysis"`
+}
+
+func alertSummary(anal Analysis) string {
+	return fmt.Sprintf("%s anomaly in stream %s (%s): rps=%g cpu=%g z=%.2f zCpu=%.2f",
+		strings.ToUpper(anal.Severity), anal.Stream, anal.Reason, anal.LastRPS, anal.LastCPU, anal.ZScore, anal.ZScoreCPU)
+}
+
+func alertPayload(format string, anal Analysis) ([]byte, error) {
+	switch format {
+	case alertFormatSlack:
+		return json.Marshal(map[string]string{"text": alertSummary(anal)})
+	case alertFormatAlertmanager:
+		type amAlert struct {
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+			StartsAt    string            `json:"startsAt"`
+		}
+		return json.Marshal([]amAlert{{
+			Labels: map[string]string{
+				"alertname": "MetricAnomaly",
+				"stream":    anal.Stream,
+				"reason":    anal.Reason,
+				"severity":  anal.Severity,
+			},
+			Annotations: map[string]string{"summary": alertSummary(anal)},
+			StartsAt:    time.Unix(anal.LastTs, 0).UTC().Format(time.RFC3339),
+		}})
+	default:
+		return json.Marshal(alertEvent{
+			Stream:    anal.Stream,
+			Timestamp: anal.LastTs,
+			Reason:    anal.Reason,
+			Severity:  anal.Severity,
+			Analysis:  anal,
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var alertsThrottled = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "alerts_throttled_total",
+	Help: "Alerts dropped because their stream exceeded ALERT_THROTTLE_MAX per ALERT_THROTTLE_WINDOW",
+})
+
+func init() {
+	prometheus.MustRegister(alertsThrottled)
+	serviceRegistry.MustRegister(alertsThrottled)
+}
+
+// alertThrottle lets through at most ALERT_THROTTLE_MAX alerts of a stream
+// per ALERT_THROTTLE_WINDOW, with a token bucket per stream that refills
+// evenly over the window. The excess is dropped and counted; detection is
+// not affected. Like the cool-down, it is tracked per replica.
+type alertThrottle struct {
+	limiter *rateLimiter
+}
+
+// newAlertThrottle returns nil, which lets everything through, when
+// ALERT_THROTTLE_MAX is 0.
+func newAlertThrottle(cfg Config) *alertThrottle {
+	if cfg.AlertThrottleMax == 0 {
+		return nil
+	}
+	return &alertThrottle{limiter: &rateLimiter{
+		rate:    float64(cfg.AlertThrottleMax) / cfg.AlertThrottleWindow.Seconds(),
+		burst:   float64(cfg.AlertThrottleMax),
+		buckets: make(map[string]*tokenBucket),
+	}}
+}
+
+// allow reports whether stream may alert at now, counting the alerts it
+// drops in alerts_throttled_total.
+func (t *alertThrottle) allow(stream string, now time.Time) bool {
+	if t == nil {
+		return true
+	}
+	if ok, _ := t.limiter.allow(stream, now); !ok {
+		alertsThrottled.Inc()
+		return false
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAlertThrottle(t *testing.T) {
+	type call struct {
+		stream string
+		after  time.Duration
+		want   bool
+	}
+	tests := []struct {
+		name   string
+		max    int
+		window time.Duration
+		calls  []call
+	}{
+		{name: "off", max: 0, window: time.Hour,
+			calls: []call{{"a", 0, true}, {"a", 0, true}, {"a", 0, true}}},
+		{name: "max per window", max: 2, window: time.Hour,
+			calls: []call{{"a", 0, true}, {"a", time.Second, true}, {"a", 2 * time.Second, false}}},
+		{name: "streams are throttled apart", max: 1, window: time.Hour,
+			calls: []call{{"a", 0, true}, {"a", 0, false}, {"b", 0, true}}},
+		{name: "refills evenly over the window", max: 2, window: time.Minute,
+			calls: []call{{"a", 0, true}, {"a", 0, true}, {"a", 29 * time.Second, false}, {"a", 30 * time.Second, true}, {"a", 31 * time.Second, false}}},
+	}
+	start := time.Unix(1_700_000_000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := newAlertThrottle(Config{AlertThrottleMax: tt.max, AlertThrottleWindow: tt.window})
+			for i, c := range tt.calls {
+				if got := th.allow(c.stream, start.Add(c.after)); got != c.want {
+					t.Errorf("call %d (%s at +%s): allow %v, want %v", i, c.stream, c.after, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+// TestAlerterThrottle checks that the alerter delivers only what the
+// throttle lets through.
+func TestAlerterThrottle(t *testing.T) {
+	var delivered atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { delivered.Add(1) }))
+	defer srv.Close()
+
+	a := newAlerter(Config{
+		Webhooks:            []webhook{{format: alertFormatJSON, url: srv.URL}},
+		AlertThrottleMax:    2,
+		AlertThrottleWindow: time.Hour,
+	})
+	for range 5 {
+		a.notify(Analysis{Stream: "a", Severity: severityCritical})
+	}
+	a.notify(Analysis{Stream: "b", Severity: severityCritical})
+	a.close(5 * time.Second)
+	if n := delivered.Load(); n != 3 {
+		t.Errorf("%d alerts delivered, want 3", n)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// redisAPIKeysKey is a set of API keys accepted in addition to API_KEYS
+	// when API_KEYS_REDIS is on.
+	redisAPIKeysKey = "api_keys"
+
+	refusedNoCredentials  = "missing_credentials"
+	refusedBadCredentials = "invalid_credentials"
+	refusedRateLimited    = "rate_limited"
+
+	rateLimitSweepEvery = time.Minute
+)
+
+var ingestRefused = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ingest_refused_total",
+	Help: "Ingest requests refused before reaching the handler by reason",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(ingestRefused)
+	serviceRegistry.MustRegister(ingestRefused)
+}
+
+type keyHash [sha256.Size]byte
+
+// authenticator holds the accepted API keys as SHA-256 hashes, so a lookup
+// does not compare the secret byte by byte and the keys are not kept in
+// memory in the clear.
+type authenticator struct {
+	static map[keyHash]struct{}
+
+	mu     sync.RWMutex
+	stored map[keyHash]struct{}
+}
+
+// newAuthenticator returns nil when no keys are configured, which leaves
+// the ingest endpoints open.
+func newAuthenticator(cfg Config) *authenticator {
+	if len(cfg.APIKeys) == 0 && !cfg.APIKeysRedis {
+		return nil
+	}
+	return &authenticator{static: hashKeys(cfg.APIKeys)}
+}
+
+func hashKeys(keys []string) map[keyHash]struct{} {
+	hashes := make(map[keyHash]struct{}, len(keys))
+	for _, k := range keys {
+		hashes[sha256.Sum256([]byte(k))] = struct{}{}
+	}
+	return hashes
+}
+
+func (a *authenticator) valid(key string) bool {
+	h := sha256.Sum256([]byte(key))
+	if _, ok := a.static[h]; ok {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	_, ok := a.stored[h]
+	return ok
+}
+
+// parseAPIKeys reads API_KEYS, a comma-separated list of keys.
+func parseAPIKeys(v string) []string {
+	var keys []string
+	for _, k := range strings.Split(v, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// refreshKeysLoop reloads the keys of the Redis set every interval until
+// the service starts stopping. A failed reload keeps the previous keys.
+func (s *Service) refreshKeysLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		s.refreshKeys()
+		select {
+		case <-s.stopping:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Service) refreshKeys() {
+	keys, err := s.redis().SMembers(s.ctx, s.key(redisAPIKeysKey)).Result()
+	if err != nil {
+		slog.Warn("api key reload failed", "key", s.key(redisAPIKeysKey), "err", err)
+		return
+	}
+	stored := hashKeys(keys)
+	s.auth.mu.Lock()
+	s.auth.stored = stored
+	s.auth.mu.Unlock()
+}
+
+// rateLimiter is a token bucket per client: each request takes a token,
+// and tokens come back at rate per second up to burst. Buckets live in
+// process memory, so every replica applies the limit on its own.
+type rateLimiter struct {
+	rate, burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(cfg Config) *rateLimiter {
+	if cfg.RateLimitRPS == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    cfg.RateLimitRPS,
+		burst:   float64(cfg.RateLimitBurst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the client's bucket. When the bucket is empty
+// it returns how long until the next token.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) >= rateLimitSweepEvery {
+		l.sweep(now)
+	}
+	b := l.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	return min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+}
+
+// sweep drops full buckets: they behave exactly like a missing one, and
+// without this every client address ever seen would stay in the map.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// admitClient checks the API key of a request (if keys are configured) and
+// charges the request to its client: the key when authenticated, otherwise
+// the remote IP. It returns the refusal reason, or "" to let the request
+// through.
+func (s *Service) admitClient(key, ip string) (reason string, retryAfter time.Duration) {
+	client, reason := s.identifyClient(key, ip)
+	if reason != "" {
+		return reason, 0
+	}
+	return s.chargeClient(client)
+}
+
+// identifyClient checks the API key, if keys are configured, and returns
+// the client the rate limit charges, or the refusal reason.
+func (s *Service) identifyClient(key, ip string) (client, reason string) {
+	if s.auth == nil {
+		return "ip:" + ip, ""
+	}
+	if key == "" {
+		return "", refusedNoCredentials
+	}
+	if !s.auth.valid(key) {
+		return "", refusedBadCredentials
+	}
+	h := sha256.Sum256([]byte(key))
+	return "key:" + hex.EncodeToString(h[:8]), ""
+}
+
+// chargeClient takes a token of the rate limit from client.
+func (s *Service) chargeClient(client string) (reason string, retryAfter time.Duration) {
+	if s.limiter != nil {
+		if ok, wait := s.limiter.allow(client, time.Now()); !ok {
+			return refusedRateLimited, wait
+		}
+	}
+	return "", 0
+}
+
+// requestKey returns the key of an X-API-Key header or of an
+// Authorization: Bearer header.
+func requestKey(h http.Header) string {
+	if k := h.Get("X-API-Key"); k != "" {
+		return k
+	}
+	scheme, token, ok := strings.Cut(h.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(max(1, int(math.Ceil(d.Seconds()))))
+}
+
+// protect puts the API key check and the rate limit in front of an ingest
+// handler. Without keys and without RATE_LIMIT_RPS it returns h unchanged.
+func (s *Service) protect(h http.Handler) http.Handler {
+	if s.auth == nil && s.limiter == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason, retryAfter := s.admitClient(requestKey(r.Header), remoteIP(r.RemoteAddr))
+		if reason == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ingestRefused.WithLabelValues(reason).Inc()
+		if reason == refusedRateLimited {
+			w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ingest"`)
+		http.Error(w, "missing or invalid API key", http.StatusUnauthorized)
+	})
+}
+
+// protectStream is protect for gRPC streams, i.e. IngestStream; Analyze
+// stays open like GET /analyze. The key comes from the x-api-key or
+// authorization metadata and is checked when the stream opens. Every
+// message received on the stream then counts as one request against the
+// rate limit, like a POST to /ingest/batch, so a long-lived stream cannot
+// outrun it; a message over the limit ends the stream with
+// RESOURCE_EXHAUSTED and a retry-after trailer.
+func (s *Service) protectStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if s.auth == nil && s.limiter == nil {
+		return handler(srv, ss)
+	}
+	client, reason := s.identifyClient(grpcKey(ss.Context()), grpcPeerIP(ss.Context()))
+	if reason != "" {
+		ingestRefused.WithLabelValues(reason).Inc()
+		return status.Error(codes.Unauthenticated, "missing or invalid API key")
+	}
+	return handler(srv, &limitedStream{ServerStream: ss, s: s, client: client})
+}
+
+// limitedStream charges client for every message it receives.
+type limitedStream struct {
+	grpc.ServerStream
+	s      *Service
+	client string
+}
+
+func (ls *limitedStream) RecvMsg(m any) error {
+	if err := ls.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	reason, retryAfter := ls.s.chargeClient(ls.client)
+	if reason == "" {
+		return nil
+	}
+	ingestRefused.WithLabelValues(reason).Inc()
+	ls.SetTrailer(metadata.Pairs("retry-after", retryAfterSeconds(retryAfter)))
+	return status.Error(codes.ResourceExhausted, "rate limit exceeded")
+}
+
+func grpcKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	h := make(http.Header)
+	for _, name := range []string{"x-api-key", "authorization"} {
+		if v := md.Get(name); len(v) > 0 {
+			h.Set(name, v[0])
+		}
+	}
+	return requestKey(h)
+}
+
+func grpcPeerIP(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return remoteIP(p.Addr.String())
+	}
+	return ""
+}
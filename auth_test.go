@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"go-service/ingestpb"
+)
+
+func TestAdmitClient(t *testing.T) {
+	type call struct {
+		key, ip string
+		want    string
+	}
+	tests := []struct {
+		name  string
+		env   []string
+		calls []call
+	}{
+		{name: "open", env: []string{"API_KEYS", "", "RATE_LIMIT_RPS", "0"},
+			calls: []call{{"", "10.0.0.1", ""}, {"anything", "10.0.0.1", ""}}},
+		{name: "keys", env: []string{"API_KEYS", "k1,k2", "RATE_LIMIT_RPS", "0"},
+			calls: []call{{"", "10.0.0.1", refusedNoCredentials}, {"bad", "10.0.0.1", refusedBadCredentials}, {"k2", "10.0.0.1", ""}}},
+		{name: "limit by ip", env: []string{"API_KEYS", "", "RATE_LIMIT_RPS", "0.001", "RATE_LIMIT_BURST", "2"},
+			calls: []call{{"", "10.0.0.1", ""}, {"", "10.0.0.1", ""}, {"", "10.0.0.1", refusedRateLimited}, {"", "10.0.0.2", ""}}},
+		{name: "limit by key across addresses", env: []string{"API_KEYS", "k1,k2", "RATE_LIMIT_RPS", "0.001", "RATE_LIMIT_BURST", "1"},
+			calls: []call{{"k1", "10.0.0.1", ""}, {"k1", "10.0.0.2", refusedRateLimited}, {"k2", "10.0.0.1", ""}}},
+		{name: "refused key is not charged", env: []string{"API_KEYS", "k1", "RATE_LIMIT_RPS", "0.001", "RATE_LIMIT_BURST", "1"},
+			calls: []call{{"bad", "10.0.0.1", refusedBadCredentials}, {"k1", "10.0.0.1", ""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, _ := newTestService(t, tt.env...)
+			for i, c := range tt.calls {
+				reason, retryAfter := svc.admitClient(c.key, c.ip)
+				if reason != c.want {
+					t.Errorf("call %d (%q from %s): reason %q, want %q", i, c.key, c.ip, reason, c.want)
+				}
+				if (reason == refusedRateLimited) != (retryAfter > 0) {
+					t.Errorf("call %d: retryAfter %s with reason %q", i, retryAfter, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestStreamRateLimit(t *testing.T) {
+	svc, _ := newTestService(t, "API_KEYS", "k1", "RATE_LIMIT_RPS", "0.001", "RATE_LIMIT_BURST", "2")
+	srv := svc.newGRPCServer(nil)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	client := ingestpb.NewIngestClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("without a key", func(t *testing.T) {
+		stream, err := client.IngestStream(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = stream.Send(&ingestpb.IngestRequest{Metrics: []*ingestpb.Metric{{Cpu: 1, Rps: 1}}})
+		if _, err := stream.Recv(); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("Recv: %v, want Unauthenticated", err)
+		}
+	})
+
+	t.Run("every message is charged", func(t *testing.T) {
+		stream, err := client.IngestStream(metadata.AppendToOutgoingContext(ctx, "x-api-key", "k1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range 3 {
+			if err := stream.Send(&ingestpb.IngestRequest{Metrics: []*ingestpb.Metric{{Cpu: 1, Rps: 1}}}); err != nil {
+				t.Fatalf("Send %d: %v", i, err)
+			}
+			_, err := stream.Recv()
+			switch {
+			case i < 2 && err != nil:
+				t.Fatalf("message %d within the burst: %v", i, err)
+			case i == 2 && status.Code(err) != codes.ResourceExhausted:
+				t.Fatalf("message %d over the limit: %v, want ResourceExhausted", i, err)
+			}
+		}
+		if got := stream.Trailer().Get("retry-after"); len(got) == 0 {
+			t.Error("no retry-after trailer")
+		}
+	})
+}
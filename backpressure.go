@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// What enqueue does in channel mode when metricsCh is full.
+const (
+	overloadReject     = "reject"
+	overloadDropOldest = "drop_oldest"
+	overloadBlock      = "block"
+
+	// overloadWait blocks until there is room or the request is gone. It is
+	// what /bulk-load uses and cannot be configured.
+	overloadWait = "wait"
+
+	defaultIngestBlockTimeout = 100 * time.Millisecond
+	maxIngestBlockTimeout     = 10 * time.Second
+
+	defaultWorkerScaleUp   = 0.5
+	defaultWorkerScaleDown = 0.05
+
+	// backpressureTick is how often the queue depth and the drain rate are
+	// sampled, and the unit of WORKER_SCALE_INTERVAL checks.
+	backpressureTick = time.Second
+	// drainRateSmoothing weighs the newest sample of the drain rate.
+	drainRateSmoothing    = 0.3
+	maxOverloadRetryAfter = 30 * time.Second
+)
+
+var (
+	queueCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ingest_queue_capacity",
+		Help: "Capacity of the in-process queue (CHANNEL_CAPACITY)",
+	})
+	queueSaturation = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ingest_queue_saturation",
+		Help: "Fill ratio of the in-process queue, from 0 to 1",
+	})
+	queueDrainRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ingest_queue_drain_rate",
+		Help: "Metrics per second processed by the workers, smoothed",
+	})
+	ingestDroppedOldest = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ingest_dropped_oldest_total",
+		Help: "Queued metrics dropped to make room for new ones with INGEST_OVERLOAD_POLICY=drop_oldest",
+	})
+	workerScaleEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "worker_scale_events_total",
+		Help: "Workers added to or removed from the pool by queue depth, by direction",
+	}, []string{"direction"})
+)
+
+func init() {
+	collectors := []prometheus.Collector{queueCapacity, queueSaturation, queueDrainRate, ingestDroppedOldest, workerScaleEvents}
+	prometheus.MustRegister(collectors...)
+	serviceRegistry.MustRegister(collectors...)
+}
+
+// sendFull puts m into ch, metricsCh or backfillCh, which is full,
+// according to policy, or returns errOverloaded. drop_oldest evicts queued
+// metrics, which are the ones most out of date, so that fresh samples win
+// over a backlog; block waits up to INGEST_BLOCK_TIMEOUT for a worker to
+// make room; spill moves m to the overflow list. The caller holds
+// intakeMu, so ch stays open.
+func (s *Service) sendFull(ctx context.Context, ch chan Metric, m Metric, policy string) error {
+	switch policy {
+	case overloadDropOldest:
+		for {
+			select {
+			case ch <- m:
+				return nil
+			default:
+			}
+			select {
+			case <-ch:
+				ingestDroppedOldest.Inc()
+			default:
+			}
+		}
+	case overloadSpill:
+		if ch == s.metricsCh {
+			return s.spillOverflow(ctx, m)
+		}
+	case overloadBlock, overloadWait:
+		var timeout <-chan time.Time
+		if policy == overloadBlock {
+			t := time.NewTimer(s.cfg.IngestBlockTimeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case ch <- m:
+			return nil
+		case <-timeout:
+			return errOverloaded
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopping:
+			return errShuttingDown
+		}
+	}
+	return errOverloaded
+}
+
+// queueDepth is the number of metrics waiting for a worker: the length of
+// metricsCh, or with QUEUE=stream the backlog of the consumer group.
+func (s *Service) queueDepth() int {
+	if s.cfg.Queue == queueStream {
+		return int(s.streamBacklog.Load())
+	}
+	return len(s.metricsCh)
+}
+
+// reportQueueDepth sets the depth and saturation gauges of metricsCh.
+func (s *Service) reportQueueDepth() {
+	depth := len(s.metricsCh)
+	queueLength.Set(float64(depth))
+	queueSaturation.Set(float64(depth) / float64(cap(s.metricsCh)))
+}
+
+func (s *Service) drainRate() float64 {
+	return math.Float64frombits(s.drained.Load())
+}
+
+// overloadRetryAfter estimates when a rejected client should try again:
+// the time the workers need to drain the queue at the current rate,
+// between 1s and maxOverloadRetryAfter. Workers that process nothing, e.g.
+// while Redis is down, give the maximum. With QUEUE=stream the rate is that
+// of this replica, so the hint errs on the long side.
+func (s *Service) overloadRetryAfter() time.Duration {
+	rate := s.drainRate()
+	if rate <= 0 {
+		return maxOverloadRetryAfter
+	}
+	d := time.Duration(float64(s.queueDepth()) / rate * float64(time.Second))
+	return min(max(d, time.Second), maxOverloadRetryAfter)
+}
+
+// writeOverloaded answers 503 with a Retry-After from the drain rate.
+func (s *Service) writeOverloaded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", retryAfterSeconds(s.overloadRetryAfter()))
+	http.Error(w, "overloaded", http.StatusServiceUnavailable)
+}
+
+// backpressureLoop samples the queue every backpressureTick until the
+// service starts stopping. It updates the drain rate and, in channel mode,
+// the queue gauges and the size of the worker pool, between WORKER_COUNT
+// and WORKER_MAX. The pool grows by one worker once the queue has stayed
+// above WORKER_SCALE_UP of its capacity for WORKER_SCALE_INTERVAL, and
+// shrinks by one of the added workers once it has stayed below
+// WORKER_SCALE_DOWN as long. While Redis is down the queue fills because
+// the workers are gated, not because there are too few, so the pool does
+// not grow then.
+func (s *Service) backpressureLoop() {
+	t := time.NewTicker(backpressureTick)
+	defer t.Stop()
+	if s.cfg.Queue == queueChannel {
+		queueCapacity.Set(float64(cap(s.metricsCh)))
+	}
+
+	sustain := max(1, int(s.cfg.WorkerScaleInterval/backpressureTick))
+	// Consecutive ticks the queue has been above WORKER_SCALE_UP and below
+	// WORKER_SCALE_DOWN.
+	var above, below int
+	// quit channels of the workers added on top of WORKER_COUNT, newest last.
+	var added []chan struct{}
+	last, lastAt := s.processed.Load(), time.Now()
+
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case now := <-t.C:
+			processed := s.processed.Load()
+			elapsed := now.Sub(lastAt)
+			rate := float64(processed-last) / elapsed.Seconds()
+			last, lastAt = processed, now
+			if prev := s.drainRate(); prev > 0 {
+				rate = drainRateSmoothing*rate + (1-drainRateSmoothing)*prev
+			}
+			s.drained.Store(math.Float64bits(rate))
+			queueDrainRate.Set(rate)
+			s.rates.tick(elapsed)
+			if s.cfg.Queue != queueChannel {
+				continue
+			}
+			s.reportQueueDepth()
+
+			if s.cfg.WorkerMax == s.cfg.WorkerCount {
+				continue
+			}
+			fill := float64(len(s.metricsCh)) / float64(cap(s.metricsCh))
+			above, below = above+1, below+1
+			if fill <= s.cfg.WorkerScaleUp {
+				above = 0
+			}
+			if fill >= s.cfg.WorkerScaleDown {
+				below = 0
+			}
+			switch {
+			case above >= sustain && s.cfg.WorkerCount+len(added) < s.cfg.WorkerMax && s.redisGate.isOpen():
+				above = 0
+				quit := make(chan struct{})
+				if !s.growWorkers(s.cfg.WorkerCount+len(added), quit) {
+					return
+				}
+				added = append(added, quit)
+				workerScaleEvents.WithLabelValues("up").Inc()
+				slog.Info("worker pool grown", "workers", s.workers.Load(), "queueDepth", len(s.metricsCh), "drainRate", rate)
+			case below >= sustain && len(added) > 0:
+				below = 0
+				close(added[len(added)-1])
+				added = added[:len(added)-1]
+				s.workers.Add(-1)
+				workersStarted.Set(float64(s.workers.Load()))
+				workerScaleEvents.WithLabelValues("down").Inc()
+				slog.Info("worker pool shrunk", "workers", s.workers.Load(), "queueDepth", len(s.metricsCh), "drainRate", rate)
+			}
+		}
+	}
+}
+
+// growWorkers starts worker id, which returns when quit is closed. It
+// reports false once the service is stopping. Drain takes intakeMu after
+// closing stopping and before it waits for workersWG, so a worker is
+// either added before the wait or not at all.
+func (s *Service) growWorkers(id int, quit chan struct{}) bool {
+	s.intakeMu.RLock()
+	defer s.intakeMu.RUnlock()
+	select {
+	case <-s.stopping:
+		return false
+	default:
+	}
+	s.startWorker(id, quit)
+	s.workers.Add(1)
+	workersStarted.Set(float64(s.workers.Load()))
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEnqueueOverloadPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		// drain takes a metric off the queue after a while, as a worker
+		// would.
+		drain   bool
+		wantErr error
+		// want is the RPS of the queued metrics, oldest first.
+		want []float64
+	}{
+		{policy: overloadReject, wantErr: errOverloaded, want: []float64{0, 1}},
+		{policy: overloadDropOldest, want: []float64{1, 2}},
+		{policy: overloadBlock, wantErr: errOverloaded, want: []float64{0, 1}},
+		{policy: overloadBlock, drain: true, want: []float64{1, 2}},
+		{policy: overloadSpill, want: []float64{0, 1}},
+	}
+	for _, tt := range tests {
+		name := tt.policy
+		if tt.drain {
+			name += " drained"
+		}
+		t.Run(name, func(t *testing.T) {
+			svc, _ := newTestService(t, "CHANNEL_CAPACITY", "2", "INGEST_OVERLOAD_POLICY", tt.policy,
+				"INGEST_BLOCK_TIMEOUT", "200ms")
+			ctx := context.Background()
+			for i := range 2 {
+				if err := svc.enqueue(ctx, Metric{RPS: float64(i)}, tt.policy); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.drain {
+				time.AfterFunc(20*time.Millisecond, func() { <-svc.metricsCh })
+			}
+			if err := svc.enqueue(ctx, Metric{RPS: 2}, tt.policy); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("enqueue into a full queue: %v, want %v", err, tt.wantErr)
+			}
+			var got []float64
+			for len(svc.metricsCh) > 0 {
+				got = append(got, (<-svc.metricsCh).RPS)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("queued %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("queued %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEnqueueBlockRequestGone(t *testing.T) {
+	svc, _ := newTestService(t, "CHANNEL_CAPACITY", "1", "INGEST_BLOCK_TIMEOUT", "10s")
+	if err := svc.enqueue(context.Background(), Metric{}, overloadBlock); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := svc.enqueue(ctx, Metric{}, overloadBlock); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("blocked enqueue after the request is gone: %v", err)
+	}
+}
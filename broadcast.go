@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// broadcaster fans out freshly computed analyses to in-process subscribers;
+// see publishUpdates for the analyses of other replicas.
+// Publishing never blocks: a subscriber whose buffer is full misses the
+// update instead of stalling the worker. A subscriber gets the analyses of
+// one stream only, so updates of busier streams cannot crowd its buffer.
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan Analysis]string
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subs: make(map[chan Analysis]string)}
+}
+
+func (b *broadcaster) subscribe(stream string, buf int) chan Analysis {
+	ch := make(chan Analysis, buf)
+	b.mu.Lock()
+	b.subs[ch] = stream
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan Analysis) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+func (b *broadcaster) publish(a Analysis) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, stream := range b.subs {
+		if stream != a.Stream {
+			continue
+		}
+		select {
+		case ch <- a:
+		default:
+		}
+	}
+}
+
+// Broadcast modes (BROADCAST).
+const (
+	// broadcastLocal hands analyses to the subscribers of the replica
+	// whose worker computed them.
+	broadcastLocal = "local"
+	// broadcastRedis publishes analyses on a Redis channel that every
+	// replica relays to its own subscribers, so /stream and /analyze/poll
+	// see all of a stream's analyses whichever replica scored them.
+	broadcastRedis = "redis"
+
+	redisUpdatesChannel = "analyses"
+	relayRetryDelay     = time.Second
+)
+
+// publishUpdates hands anals to their subscribers: with BROADCAST=redis
+// on every replica, in one round trip, otherwise on this one.
+func (s *Service) publishUpdates(ctx context.Context, rdb redis.Cmdable, anals ...Analysis) {
+	if s.cfg.Broadcast != broadcastRedis {
+		for _, a := range anals {
+			s.updates.publish(a)
+		}
+		return
+	}
+	channel := s.key(redisUpdatesChannel)
+	_, err := rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, a := range anals {
+			b, _ := json.Marshal(a)
+			p.Publish(ctx, channel, b)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("redis PUBLISH failed", "channel", channel, "analyses", len(anals), "err", err)
+	}
+}
+
+// relayUpdates delivers the analyses published on the Redis channel to
+// this replica's subscribers until the service starts stopping. It
+// subscribes again when the subscription ends, as it does when the Redis
+// clients are replaced.
+func (s *Service) relayUpdates() {
+	channel := s.key(redisUpdatesChannel)
+	for {
+		sub := s.redis().Subscribe(s.ctx, channel)
+		msgs := sub.Channel()
+	relay:
+		for {
+			select {
+			case <-s.stopping:
+				_ = sub.Close()
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					break relay
+				}
+				var a Analysis
+				if err := json.Unmarshal([]byte(msg.Payload), &a); err != nil {
+					slog.Warn("dropping corrupt published analysis", "channel", channel, "err", err)
+					continue
+				}
+				s.updates.publish(a)
+			}
+		}
+		_ = sub.Close()
+		select {
+		case <-s.stopping:
+			return
+		case <-time.After(relayRetryDelay):
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayUpdates(t *testing.T) {
+	scorer, mr := newTestService(t, "BROADCAST", "redis")
+	t.Setenv("REDIS_ADDR", mr.Addr())
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer := NewService(newRedisClient(cfg, 0), cfg)
+	t.Cleanup(viewer.Close)
+
+	done := make(chan struct{})
+	go func() {
+		viewer.relayUpdates()
+		close(done)
+	}()
+	channel := viewer.key(redisUpdatesChannel)
+	for deadline := time.Now().Add(time.Second); mr.PubSubNumSub(channel)[channel] == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("relay did not subscribe")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	sub := viewer.updates.subscribe("web", 4)
+	defer viewer.updates.unsubscribe(sub)
+	local := scorer.updates.subscribe("web", 4)
+	defer scorer.updates.unsubscribe(local)
+
+	scorer.publishUpdates(scorer.ctx, scorer.redis(),
+		Analysis{Stream: "api", ComputedAtNano: 1}, Analysis{Stream: "web", ComputedAtNano: 2})
+	select {
+	case a := <-sub:
+		if a.Stream != "web" || a.ComputedAtNano != 2 {
+			t.Errorf("relayed %+v", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("analysis of another replica not relayed")
+	}
+	select {
+	case a := <-local:
+		t.Errorf("published locally without a relay: %+v", a)
+	default:
+	}
+
+	viewer.Drain(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("relayUpdates still running after Drain")
+	}
+}
+
+func TestBroadcastDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		want string
+	}{
+		{"channel queue", nil, broadcastLocal},
+		{"stream queue", []string{"QUEUE", "stream"}, broadcastRedis},
+		{"stream queue, local", []string{"QUEUE", "stream", "BROADCAST", "local"}, broadcastLocal},
+		{"channel queue, redis", []string{"BROADCAST", "redis"}, broadcastRedis},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, "", tt.env...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Broadcast != tt.want {
+				t.Errorf("BROADCAST = %q, want %q", cfg.Broadcast, tt.want)
+			}
+		})
+	}
+	if _, err := loadTestConfig(t, "", "BROADCAST", "kafka"); err == nil {
+		t.Error("BROADCAST=kafka accepted")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	bulkMaxLineBytes  = 1 << 20
+	bulkProgressEvery = 10_000
+)
+
+type bulkLoadResult struct {
+	Accepted int    `json:"accepted"`
+	Invalid  int    `json:"invalid"`
+	Lines    int    `json:"lines"`
+	Complete bool   `json:"complete"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleBulkLoad replays a gzipped NDJSON file of metrics through the worker
+// pipeline as backfill. The body is decoded line by line and every metric is
+// enqueued waiting for room, so however large the file is, what it queues
+// ahead of the workers stays bounded: in channel mode by the capacity of
+// backfillCh, in stream mode by STREAM_MAXLEN entries in Redis, as
+// waitStreamRoom holds each metric back while the backlog of the group is
+// at that limit.
+func (s *Service) handleBulkLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	select {
+	case s.bulkSem <- struct{}{}:
+		defer func() { <-s.bulkSem }()
+	default:
+		http.Error(w, "bulk load already in progress", http.StatusTooManyRequests)
+		return
+	}
+
+	// A large file takes longer than HTTP_READ_TIMEOUT to upload and score.
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, "bad gzip: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer zr.Close()
+
+	start := time.Now()
+	var res bulkLoadResult
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 0, 64*1024), bulkMaxLineBytes)
+
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		res.Lines++
+
+		var m Metric
+		if err := json.Unmarshal(line, &m); err != nil || m.Timestamp == 0 || s.validateMetric(m, true) != nil || s.admitStream(&m) != nil {
+			res.Invalid++
+			continue
+		}
+		m.backfill = true
+
+		if err := s.enqueue(r.Context(), m, overloadWait); err != nil {
+			if r.Context().Err() != nil {
+				slog.WarnContext(r.Context(), "bulk load aborted by client", "lines", res.Lines)
+				return
+			}
+			res.Error = err.Error()
+			break
+		}
+		res.Accepted++
+
+		if res.Lines%bulkProgressEvery == 0 {
+			slog.InfoContext(r.Context(), "bulk load progress", "lines", res.Lines, "accepted", res.Accepted, "invalid", res.Invalid)
+		}
+	}
+
+	if err := sc.Err(); err != nil && res.Error == "" {
+		res.Error = err.Error()
+	}
+	res.Complete = res.Error == ""
+	slog.InfoContext(r.Context(), "bulk load done",
+		"duration_ms", durationMillis(time.Since(start)), "lines", res.Lines,
+		"accepted", res.Accepted, "invalid", res.Invalid, "complete", res.Complete)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	ListenAddr     string
+	GRPCListenAddr string
+
+	TLSCertFile        string
+	TLSKeyFile         string
+	TLSClientCAFile    string
+	HTTPReadTimeout    time.Duration
+	HTTPWriteTimeout   time.Duration
+	HTTPIdleTimeout    time.Duration
+	HTTPMaxHeaderBytes int
+	HTTPMaxBodyBytes   int64
+
+	RedisAddr          string
+	RedisAddrSecondary string
+	PerWorkerRedis     bool
+	RedisKeyPrefix     string
+
+	RedisHealthInterval time.Duration
+	RedisReconnectAfter int
+
+	WorkerCount     int
+	ChannelCapacity int
+
+	OverloadPolicy      string
+	SpillMax            int
+	IngestBlockTimeout  time.Duration
+	WorkerMax           int
+	WorkerScaleInterval time.Duration
+	WorkerScaleUp       float64
+	WorkerScaleDown     float64
+	WorkerFairness      string
+	WorkerStreamShare   float64
+
+	RetryAttempts   int
+	RetryBackoff    time.Duration
+	DeadLetterSize  int
+	DeadLetterRedis bool
+
+	Queue           string
+	StreamMaxLen    int64
+	StreamClaimIdle time.Duration
+
+	WindowSize int
+	ZThreshold float64
+
+	SeverityWarningZ  float64
+	SeverityCriticalZ float64
+
+	WindowStore            string
+	WindowSnapshotInterval time.Duration
+
+	Detector   string
+	EWMAAlpha  float64
+	EWMAWarmup int
+
+	SeasonalPeriod   string
+	SeasonalAlpha    float64
+	SeasonalWarmup   int
+	SeasonalLocation *time.Location
+
+	SmoothingWindow int
+
+	BaselineDecay    float64
+	PercentThreshold float64
+	AnomalySamples   int
+
+	AnomalyHistorySize int
+	AnomalyRetention   time.Duration
+	// AnomalyRetentionByStream overrides both for the streams it lists.
+	AnomalyRetentionByStream map[string]historyRetention
+	AnomaliesMaxLimit        int
+
+	MetricHistoryRetention time.Duration
+
+	VoteWindows []int
+	VotePolicy  string
+
+	JointPatterns       []string
+	JointMinCorrelation float64
+
+	MaxStreams int
+	MaxSeries  int
+	// StreamNamePattern is STREAM_NAME_PATTERN anchored to the whole name.
+	StreamNamePattern *regexp.Regexp
+
+	RequiredFields  []string
+	ValidateCPUMax  float64
+	ValidateRPSMax  float64
+	ValidateMaxSkew time.Duration
+	ValidateMaxAge  time.Duration
+
+	RemoteWriteMap         map[string]string
+	RemoteWriteStreamLabel string
+
+	APIKeys        []string
+	APIKeysRedis   bool
+	APIKeysRefresh time.Duration
+	RateLimitRPS   float64
+	RateLimitBurst int
+
+	AdminAPIKeys       []string
+	AdminConfigRefresh time.Duration
+
+	Webhooks            []webhook
+	AlertCooldown       time.Duration
+	AlertRetries        int
+	AlertThrottleMax    int
+	AlertThrottleWindow time.Duration
+
+	SourceCheckInterval time.Duration
+	SourceDownAfter     time.Duration
+
+	PollTimeout     time.Duration
+	SSEMaxClients   int
+	SSEBuffer       int
+	Broadcast       string
+	ShutdownTimeout time.Duration
+
+	ReadyQueueThreshold float64
+
+	HTTPPathPrefix string
+	PrefixMetrics  bool
+
+	LogLevel  slog.Level
+	LogFormat string
+
+	// settings lists every key the loader looked at with its effective
+	// value, in load order. It backs the --validate-config report.
+	settings []setting
+	// Warnings are problems the loader recovered from by falling back to a
+	// default. They are logged at startup but do not fail LoadConfig.
+	Warnings []string
+}
+
+type setting struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Setting sources, in order of precedence.
+const (
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceDefault = "default"
+)
+
+// LoadConfig reads the service configuration from the environment and, if
+// CONFIG_FILE is set, from that file; environment variables win. It does
+// not stop at the first problem: every invalid setting is reported in the
+// returned error so a single run shows everything that needs fixing.
+func LoadConfig() (Config, error) {
+	var cfg Config
+	l := &loader{cfg: &cfg, seen: make(map[string]bool)}
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, err := loadConfigFile(path)
+		l.add(err)
+		l.file = file
+	}
+
+	cfg.ListenAddr = l.string("LISTEN_ADDR", ":8080")
+	cfg.GRPCListenAddr = l.optional("GRPC_LISTEN_ADDR", ":9090")
+	l.check(cfg.GRPCListenAddr != cfg.ListenAddr, "GRPC_LISTEN_ADDR must differ from LISTEN_ADDR")
+
+	cfg.TLSCertFile = l.string("TLS_CERT_FILE", "")
+	cfg.TLSKeyFile = l.string("TLS_KEY_FILE", "")
+	cfg.TLSClientCAFile = l.string("TLS_CLIENT_CA_FILE", "")
+	l.check((cfg.TLSCertFile == "") == (cfg.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	l.check(cfg.TLSClientCAFile == "" || cfg.TLSCertFile != "", "TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+	cfg.HTTPReadTimeout = l.duration("HTTP_READ_TIMEOUT", 30*time.Second)
+	l.check(cfg.HTTPReadTimeout >= 0, "HTTP_READ_TIMEOUT must not be negative, got %s", cfg.HTTPReadTimeout)
+	cfg.HTTPWriteTimeout = l.duration("HTTP_WRITE_TIMEOUT", 30*time.Second)
+	l.check(cfg.HTTPWriteTimeout >= 0, "HTTP_WRITE_TIMEOUT must not be negative, got %s", cfg.HTTPWriteTimeout)
+	cfg.HTTPIdleTimeout = l.duration("HTTP_IDLE_TIMEOUT", 120*time.Second)
+	l.check(cfg.HTTPIdleTimeout >= 0, "HTTP_IDLE_TIMEOUT must not be negative, got %s", cfg.HTTPIdleTimeout)
+	cfg.HTTPMaxHeaderBytes = l.int("HTTP_MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes)
+	l.check(cfg.HTTPMaxHeaderBytes >= 4096 && cfg.HTTPMaxHeaderBytes <= maxHTTPHeaderBytes,
+		"HTTP_MAX_HEADER_BYTES must be between 4096 and %d, got %d", maxHTTPHeaderBytes, cfg.HTTPMaxHeaderBytes)
+	cfg.HTTPMaxBodyBytes = int64(l.int("HTTP_MAX_BODY_BYTES", defaultHTTPMaxBodyBytes))
+	l.check(cfg.HTTPMaxBodyBytes >= 0, "HTTP_MAX_BODY_BYTES must not be negative, got %d", cfg.HTTPMaxBodyBytes)
+
+	cfg.RedisAddr = l.string("REDIS_ADDR", "redis-master:6379")
+	cfg.RedisAddrSecondary = l.string("REDIS_ADDR_SECONDARY", "")
+	l.check(cfg.RedisAddrSecondary == "" || cfg.RedisAddrSecondary != cfg.RedisAddr,
+		"REDIS_ADDR_SECONDARY must differ from REDIS_ADDR")
+	cfg.PerWorkerRedis = l.bool("REDIS_PER_WORKER_CLIENT", false)
+	cfg.RedisKeyPrefix = l.string("REDIS_KEY_PREFIX", "")
+	cfg.RedisHealthInterval = l.duration("REDIS_HEALTH_INTERVAL", 5*time.Second)
+	l.check(cfg.RedisHealthInterval > 0,
+		"REDIS_HEALTH_INTERVAL must be positive, got %s", cfg.RedisHealthInterval)
+	cfg.RedisReconnectAfter = l.int("REDIS_RECONNECT_AFTER", 0)
+	l.check(cfg.RedisReconnectAfter >= 0,
+		"REDIS_RECONNECT_AFTER must not be negative, got %d", cfg.RedisReconnectAfter)
+
+	cfg.WorkerCount = l.intOr("WORKER_COUNT", defaultWorkerCount, 1, maxWorkerCount)
+	cfg.ChannelCapacity = l.intOr("CHANNEL_CAPACITY", defaultChannelCapacity, 1, maxChannelCapacity)
+
+	cfg.RetryAttempts = l.int("RETRY_ATTEMPTS", 3)
+	l.check(cfg.RetryAttempts >= 0 && cfg.RetryAttempts <= 10,
+		"RETRY_ATTEMPTS must be between 0 and 10, got %d", cfg.RetryAttempts)
+	cfg.RetryBackoff = l.duration("RETRY_BACKOFF", 100*time.Millisecond)
+	l.check(cfg.RetryBackoff > 0 && cfg.RetryBackoff <= maxRetryBackoff,
+		"RETRY_BACKOFF must be in (0, %s], got %s", maxRetryBackoff, cfg.RetryBackoff)
+	cfg.DeadLetterSize = l.int("DEADLETTER_SIZE", 1000)
+	l.check(cfg.DeadLetterSize >= 0 && cfg.DeadLetterSize <= maxDeadLetterSize,
+		"DEADLETTER_SIZE must be between 0 and %d, got %d", maxDeadLetterSize, cfg.DeadLetterSize)
+	cfg.DeadLetterRedis = l.bool("DEADLETTER_REDIS", false)
+	l.check(!cfg.DeadLetterRedis || cfg.DeadLetterSize > 0, "DEADLETTER_REDIS needs DEADLETTER_SIZE above 0")
+
+	cfg.Queue = l.string("QUEUE", queueChannel)
+	l.check(cfg.Queue == queueChannel || cfg.Queue == queueStream,
+		"QUEUE must be %q or %q, got %q", queueChannel, queueStream, cfg.Queue)
+
+	cfg.OverloadPolicy = l.string("INGEST_OVERLOAD_POLICY", overloadReject)
+	l.check(cfg.OverloadPolicy == overloadReject || cfg.OverloadPolicy == overloadDropOldest || cfg.OverloadPolicy == overloadBlock || cfg.OverloadPolicy == overloadSpill,
+		"INGEST_OVERLOAD_POLICY must be %q, %q, %q or %q, got %q", overloadReject, overloadDropOldest, overloadBlock, overloadSpill, cfg.OverloadPolicy)
+	cfg.SpillMax = l.int("INGEST_SPILL_MAX", defaultSpillMax)
+	l.check(cfg.SpillMax >= 1, "INGEST_SPILL_MAX must be at least 1, got %d", cfg.SpillMax)
+	cfg.IngestBlockTimeout = l.duration("INGEST_BLOCK_TIMEOUT", defaultIngestBlockTimeout)
+	l.check(cfg.IngestBlockTimeout > 0 && cfg.IngestBlockTimeout <= maxIngestBlockTimeout,
+		"INGEST_BLOCK_TIMEOUT must be in (0, %s], got %s", maxIngestBlockTimeout, cfg.IngestBlockTimeout)
+	cfg.WorkerMax = l.int("WORKER_MAX", cfg.WorkerCount)
+	l.check(cfg.WorkerMax >= cfg.WorkerCount && cfg.WorkerMax <= maxWorkerCount,
+		"WORKER_MAX must be between WORKER_COUNT=%d and %d, got %d", cfg.WorkerCount, maxWorkerCount, cfg.WorkerMax)
+	l.check(cfg.WorkerMax <= cfg.WorkerCount || cfg.Queue == queueChannel,
+		"WORKER_MAX above WORKER_COUNT needs QUEUE=%s", queueChannel)
+	cfg.WorkerScaleInterval = l.duration("WORKER_SCALE_INTERVAL", 30*time.Second)
+	l.check(cfg.WorkerScaleInterval >= backpressureTick,
+		"WORKER_SCALE_INTERVAL must be at least %s, got %s", backpressureTick, cfg.WorkerScaleInterval)
+	cfg.WorkerScaleUp = l.float("WORKER_SCALE_UP", defaultWorkerScaleUp)
+	l.check(cfg.WorkerScaleUp > 0 && cfg.WorkerScaleUp < 1,
+		"WORKER_SCALE_UP must be in (0, 1), got %v", cfg.WorkerScaleUp)
+	cfg.WorkerScaleDown = l.float("WORKER_SCALE_DOWN", defaultWorkerScaleDown)
+	l.check(cfg.WorkerScaleDown >= 0 && cfg.WorkerScaleDown < cfg.WorkerScaleUp,
+		"WORKER_SCALE_DOWN must be at least 0 and below WORKER_SCALE_UP, got %v", cfg.WorkerScaleDown)
+	cfg.WorkerFairness = l.string("WORKER_FAIRNESS", fairnessFIFO)
+	l.check(cfg.WorkerFairness == fairnessFIFO || cfg.WorkerFairness == fairnessStreamCap,
+		"WORKER_FAIRNESS must be %q or %q, got %q", fairnessFIFO, fairnessStreamCap, cfg.WorkerFairness)
+	l.check(cfg.WorkerFairness == fairnessFIFO || cfg.Queue == queueChannel,
+		"WORKER_FAIRNESS=%s needs QUEUE=%s", fairnessStreamCap, queueChannel)
+	cfg.WorkerStreamShare = l.float("WORKER_STREAM_SHARE", defaultWorkerStreamShare)
+	l.check(cfg.WorkerStreamShare > 0 && cfg.WorkerStreamShare <= 1,
+		"WORKER_STREAM_SHARE must be in (0, 1], got %v", cfg.WorkerStreamShare)
+
+	cfg.StreamMaxLen = int64(l.int("STREAM_MAXLEN", 100_000))
+	l.check(cfg.StreamMaxLen > 0, "STREAM_MAXLEN must be positive, got %d", cfg.StreamMaxLen)
+	cfg.StreamClaimIdle = l.duration("STREAM_CLAIM_IDLE", time.Minute)
+	l.check(cfg.StreamClaimIdle > 0, "STREAM_CLAIM_IDLE must be positive, got %s", cfg.StreamClaimIdle)
+
+	cfg.WindowSize = l.int("WINDOW_SIZE", defaultWindowSize)
+	l.check(cfg.WindowSize >= 2, "WINDOW_SIZE must be at least 2, got %d", cfg.WindowSize)
+	cfg.ZThreshold = l.float("Z_THRESHOLD", defaultZThreshold)
+	l.check(cfg.ZThreshold > 0, "Z_THRESHOLD must be positive, got %g", cfg.ZThreshold)
+	cfg.SeverityWarningZ = l.float("SEVERITY_WARNING_Z", defaultSeverityWarningZ)
+	l.check(cfg.SeverityWarningZ > 0, "SEVERITY_WARNING_Z must be positive, got %g", cfg.SeverityWarningZ)
+	cfg.SeverityCriticalZ = l.float("SEVERITY_CRITICAL_Z", defaultSeverityCriticalZ)
+	l.check(cfg.SeverityCriticalZ >= cfg.SeverityWarningZ,
+		"SEVERITY_CRITICAL_Z must be at least SEVERITY_WARNING_Z=%g, got %g", cfg.SeverityWarningZ, cfg.SeverityCriticalZ)
+
+	cfg.WindowStore = l.string("WINDOW_STORE", windowStoreRedis)
+	l.check(cfg.WindowStore == windowStoreRedis || cfg.WindowStore == windowStoreMemory,
+		"WINDOW_STORE must be %q or %q, got %q", windowStoreRedis, windowStoreMemory, cfg.WindowStore)
+	cfg.WindowSnapshotInterval = l.duration("WINDOW_SNAPSHOT_INTERVAL", 5*time.Second)
+	l.check(cfg.WindowSnapshotInterval > 0,
+		"WINDOW_SNAPSHOT_INTERVAL must be positive, got %s", cfg.WindowSnapshotInterval)
+
+	cfg.Detector = l.string("DETECTOR", detectorWindow)
+	l.check(cfg.Detector == detectorWindow || cfg.Detector == detectorEWMA || cfg.Detector == detectorSeasonal,
+		"DETECTOR must be %q, %q or %q, got %q", detectorWindow, detectorEWMA, detectorSeasonal, cfg.Detector)
+	cfg.EWMAAlpha = l.float("EWMA_ALPHA", 0.1)
+	l.check(cfg.EWMAAlpha > 0 && cfg.EWMAAlpha <= 1, "EWMA_ALPHA must be in (0, 1], got %g", cfg.EWMAAlpha)
+	cfg.EWMAWarmup = l.int("EWMA_WARMUP", 10)
+	l.check(cfg.EWMAWarmup >= 2, "EWMA_WARMUP must be at least 2, got %d", cfg.EWMAWarmup)
+
+	cfg.SeasonalPeriod = l.string("SEASONAL_PERIOD", seasonDay)
+	l.check(cfg.SeasonalPeriod == seasonDay || cfg.SeasonalPeriod == seasonWeek,
+		"SEASONAL_PERIOD must be %q or %q, got %q", seasonDay, seasonWeek, cfg.SeasonalPeriod)
+	cfg.SeasonalAlpha = l.float("SEASONAL_ALPHA", 0.3)
+	l.check(cfg.SeasonalAlpha > 0 && cfg.SeasonalAlpha <= 1,
+		"SEASONAL_ALPHA must be in (0, 1], got %g", cfg.SeasonalAlpha)
+	cfg.SeasonalWarmup = l.int("SEASONAL_WARMUP", 2)
+	l.check(cfg.SeasonalWarmup >= 1, "SEASONAL_WARMUP must be at least 1, got %d", cfg.SeasonalWarmup)
+	cfg.SeasonalLocation = time.UTC
+	l.parse("SEASONAL_TIMEZONE", "UTC", func(v string) (err error) {
+		cfg.SeasonalLocation, err = time.LoadLocation(v)
+		if err != nil {
+			cfg.SeasonalLocation = time.UTC
+			return fmt.Errorf("SEASONAL_TIMEZONE: %w", err)
+		}
+		return nil
+	})
+
+	cfg.SmoothingWindow = l.int("SMOOTHING_WINDOW", 0)
+	l.check(cfg.SmoothingWindow >= 0 && cfg.SmoothingWindow <= cfg.WindowSize,
+		"SMOOTHING_WINDOW must be between 0 and %d, got %d", cfg.WindowSize, cfg.SmoothingWindow)
+
+	cfg.BaselineDecay = l.float("BASELINE_DECAY", 0)
+	l.check(cfg.BaselineDecay >= 0 && cfg.BaselineDecay < 1,
+		"BASELINE_DECAY must be in [0, 1), got %g", cfg.BaselineDecay)
+	cfg.PercentThreshold = l.float("PERCENT_THRESHOLD", 0)
+	l.check(cfg.PercentThreshold >= 0,
+		"PERCENT_THRESHOLD must not be negative, got %g", cfg.PercentThreshold)
+	cfg.AnomalySamples = l.int("ANOMALY_SAMPLES", 0)
+	l.check(cfg.AnomalySamples >= 0 && cfg.AnomalySamples <= cfg.WindowSize,
+		"ANOMALY_SAMPLES must be between 0 and %d, got %d", cfg.WindowSize, cfg.AnomalySamples)
+	cfg.AnomalyHistorySize = l.int("ANOMALY_HISTORY_SIZE", 1000)
+	l.check(cfg.AnomalyHistorySize >= 0 && cfg.AnomalyHistorySize <= maxHistorySize,
+		"ANOMALY_HISTORY_SIZE must be between 0 and %d, got %d", maxHistorySize, cfg.AnomalyHistorySize)
+	cfg.AnomalyRetention = l.duration("ANOMALY_RETENTION", 7*24*time.Hour)
+	l.check(cfg.AnomalyRetention >= 0, "ANOMALY_RETENTION must not be negative, got %s", cfg.AnomalyRetention)
+	cfg.AnomaliesMaxLimit = l.int("ANOMALIES_MAX_LIMIT", defaultAnomaliesMaxLimit)
+	l.check(cfg.AnomaliesMaxLimit >= 1 && cfg.AnomaliesMaxLimit <= maxHistorySize,
+		"ANOMALIES_MAX_LIMIT must be between 1 and %d, got %d", maxHistorySize, cfg.AnomaliesMaxLimit)
+	cfg.MetricHistoryRetention = l.duration("METRIC_HISTORY_RETENTION", 0)
+	l.check(cfg.MetricHistoryRetention >= 0, "METRIC_HISTORY_RETENTION must not be negative, got %s", cfg.MetricHistoryRetention)
+
+	l.parse("VOTE_WINDOWS", "", func(v string) (err error) {
+		cfg.VoteWindows, err = parseVoteWindows(v, cfg.WindowSize)
+		return err
+	})
+	cfg.VotePolicy = l.string("VOTE_POLICY", "majority")
+	if len(cfg.VoteWindows) > 0 {
+		l.add(validateVotePolicy(cfg.VotePolicy, len(cfg.VoteWindows)))
+	}
+
+	l.parse("JOINT_PATTERNS", "", func(v string) (err error) {
+		cfg.JointPatterns, err = parseJointPatterns(v)
+		return err
+	})
+	cfg.JointMinCorrelation = l.float("JOINT_MIN_CORRELATION", 0.5)
+	l.check(cfg.JointMinCorrelation >= -1 && cfg.JointMinCorrelation <= 1,
+		"JOINT_MIN_CORRELATION must be between -1 and 1, got %g", cfg.JointMinCorrelation)
+
+	// The EWMA and seasonal detectors keep no window, so rules that need one
+	// cannot run.
+	if cfg.Detector != detectorWindow {
+		l.check(len(cfg.VoteWindows) == 0, "VOTE_WINDOWS needs DETECTOR=%s", detectorWindow)
+		l.check(len(cfg.JointPatterns) == 0, "JOINT_PATTERNS needs DETECTOR=%s", detectorWindow)
+		l.check(cfg.AnomalySamples == 0, "ANOMALY_SAMPLES needs DETECTOR=%s", detectorWindow)
+		l.check(cfg.BaselineDecay == 0, "BASELINE_DECAY needs DETECTOR=%s", detectorWindow)
+	}
+
+	cfg.MaxStreams = l.int("MAX_STREAMS", defaultMaxStreams)
+	l.check(cfg.MaxStreams >= 1, "MAX_STREAMS must be at least 1, got %d", cfg.MaxStreams)
+	cfg.MaxSeries = l.int("MAX_SERIES", defaultMaxSeries)
+	l.check(cfg.MaxSeries >= 0, "MAX_SERIES must not be negative, got %d", cfg.MaxSeries)
+	l.parse("STREAM_NAME_PATTERN", defaultStreamNamePattern, func(v string) (err error) {
+		cfg.StreamNamePattern, err = compileNamePattern(v)
+		if err != nil {
+			// The settings below name streams; they are checked against the
+			// default pattern so their own errors are still reported.
+			cfg.StreamNamePattern, _ = compileNamePattern(defaultStreamNamePattern)
+		}
+		return err
+	})
+	l.parse("ANOMALY_RETENTION_BY_STREAM", "", func(v string) (err error) {
+		def := historyRetention{Retention: cfg.AnomalyRetention, Size: cfg.AnomalyHistorySize}
+		cfg.AnomalyRetentionByStream, err = parseHistoryRetention(v, cfg.StreamNamePattern, def)
+		return err
+	})
+
+	l.parse("VALIDATE_REQUIRED", "", func(v string) (err error) {
+		cfg.RequiredFields, err = parseRequiredFields(v)
+		return err
+	})
+	cfg.ValidateCPUMax = l.float("VALIDATE_CPU_MAX", 0)
+	l.check(cfg.ValidateCPUMax >= 0, "VALIDATE_CPU_MAX must not be negative, got %g", cfg.ValidateCPUMax)
+	cfg.ValidateRPSMax = l.float("VALIDATE_RPS_MAX", 0)
+	l.check(cfg.ValidateRPSMax >= 0, "VALIDATE_RPS_MAX must not be negative, got %g", cfg.ValidateRPSMax)
+	cfg.ValidateMaxSkew = l.duration("VALIDATE_MAX_SKEW", 5*time.Minute)
+	l.check(cfg.ValidateMaxSkew >= 0, "VALIDATE_MAX_SKEW must not be negative, got %s", cfg.ValidateMaxSkew)
+	cfg.ValidateMaxAge = l.duration("VALIDATE_MAX_AGE", 0)
+	l.check(cfg.ValidateMaxAge >= 0, "VALIDATE_MAX_AGE must not be negative, got %s", cfg.ValidateMaxAge)
+
+	l.parse("REMOTE_WRITE_MAP", "", func(v string) (err error) {
+		cfg.RemoteWriteMap, err = parseRemoteWriteMap(v, cfg.StreamNamePattern)
+		return err
+	})
+	cfg.RemoteWriteStreamLabel = l.string("REMOTE_WRITE_STREAM_LABEL", "")
+
+	cfg.APIKeys = parseAPIKeys(l.secret("API_KEYS"))
+	cfg.APIKeysRedis = l.bool("API_KEYS_REDIS", false)
+	cfg.APIKeysRefresh = l.duration("API_KEYS_REFRESH", 30*time.Second)
+	l.check(cfg.APIKeysRefresh > 0, "API_KEYS_REFRESH must be positive, got %s", cfg.APIKeysRefresh)
+	cfg.AdminAPIKeys = parseAPIKeys(l.secret("ADMIN_API_KEYS"))
+	cfg.AdminConfigRefresh = l.duration("ADMIN_CONFIG_REFRESH", 10*time.Second)
+	l.check(cfg.AdminConfigRefresh > 0, "ADMIN_CONFIG_REFRESH must be positive, got %s", cfg.AdminConfigRefresh)
+	cfg.RateLimitRPS = l.float("RATE_LIMIT_RPS", 0)
+	l.check(cfg.RateLimitRPS >= 0 && !math.IsInf(cfg.RateLimitRPS, 0),
+		"RATE_LIMIT_RPS must be a non-negative number, got %v", cfg.RateLimitRPS)
+	cfg.RateLimitBurst = l.int("RATE_LIMIT_BURST", max(1, int(math.Ceil(cfg.RateLimitRPS))))
+	l.check(cfg.RateLimitBurst >= 1, "RATE_LIMIT_BURST must be at least 1, got %d", cfg.RateLimitBurst)
+
+	webhooks, err := parseWebhooks(l.secret("WEBHOOK_URLS"))
+	l.add(err)
+	cfg.Webhooks = webhooks
+	cfg.AlertCooldown = l.duration("ALERT_COOLDOWN", 5*time.Minute)
+	l.check(cfg.AlertCooldown >= 0, "ALERT_COOLDOWN must not be negative, got %s", cfg.AlertCooldown)
+	cfg.AlertRetries = l.int("ALERT_RETRIES", 3)
+	l.check(cfg.AlertRetries >= 0 && cfg.AlertRetries <= 10,
+		"ALERT_RETRIES must be between 0 and 10, got %d", cfg.AlertRetries)
+	cfg.AlertThrottleMax = l.int("ALERT_THROTTLE_MAX", 0)
+	l.check(cfg.AlertThrottleMax >= 0, "ALERT_THROTTLE_MAX must not be negative, got %d", cfg.AlertThrottleMax)
+	cfg.AlertThrottleWindow = l.duration("ALERT_THROTTLE_WINDOW", time.Hour)
+	l.check(cfg.AlertThrottleWindow > 0, "ALERT_THROTTLE_WINDOW must be positive, got %s", cfg.AlertThrottleWindow)
+	cfg.SourceCheckInterval = l.duration("SOURCE_CHECK_INTERVAL", 30*time.Second)
+	l.check(cfg.SourceCheckInterval > 0, "SOURCE_CHECK_INTERVAL must be positive, got %s", cfg.SourceCheckInterval)
+	cfg.SourceDownAfter = l.duration("SOURCE_DOWN_AFTER", 5*time.Minute)
+	l.check(cfg.SourceDownAfter > 0, "SOURCE_DOWN_AFTER must be positive, got %s", cfg.SourceDownAfter)
+
+	cfg.PollTimeout = l.duration("POLL_TIMEOUT", 30*time.Second)
+	l.check(cfg.PollTimeout > 0 && cfg.PollTimeout <= maxPollTimeout,
+		"POLL_TIMEOUT must be in (0, %s], got %s", maxPollTimeout, cfg.PollTimeout)
+	cfg.SSEMaxClients = l.int("SSE_MAX_CLIENTS", defaultSSEMaxClients)
+	l.check(cfg.SSEMaxClients >= 1, "SSE_MAX_CLIENTS must be at least 1, got %d", cfg.SSEMaxClients)
+	cfg.SSEBuffer = l.int("SSE_BUFFER", defaultSSEBuffer)
+	l.check(cfg.SSEBuffer >= 1 && cfg.SSEBuffer <= maxSSEBuffer,
+		"SSE_BUFFER must be between 1 and %d, got %d", maxSSEBuffer, cfg.SSEBuffer)
+	// With a shared stream queue any replica may score a stream, so its
+	// subscribers are fed through Redis unless told otherwise.
+	defaultBroadcast := broadcastLocal
+	if cfg.Queue == queueStream {
+		defaultBroadcast = broadcastRedis
+	}
+	cfg.Broadcast = l.string("BROADCAST", defaultBroadcast)
+	l.check(cfg.Broadcast == broadcastLocal || cfg.Broadcast == broadcastRedis,
+		"BROADCAST must be %q or %q, got %q", broadcastLocal, broadcastRedis, cfg.Broadcast)
+
+	cfg.ShutdownTimeout = l.duration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	l.check(cfg.ShutdownTimeout > 0, "SHUTDOWN_TIMEOUT must be positive, got %s", cfg.ShutdownTimeout)
+	cfg.ReadyQueueThreshold = l.float("READY_QUEUE_THRESHOLD", defaultReadyQueueThreshold)
+	l.check(cfg.ReadyQueueThreshold > 0 && cfg.ReadyQueueThreshold <= 1,
+		"READY_QUEUE_THRESHOLD must be in (0, 1], got %v", cfg.ReadyQueueThreshold)
+
+	cfg.HTTPPathPrefix = strings.TrimRight(l.string("HTTP_PATH_PREFIX", ""), "/")
+	if cfg.HTTPPathPrefix != "" && !strings.HasPrefix(cfg.HTTPPathPrefix, "/") {
+		cfg.HTTPPathPrefix = "/" + cfg.HTTPPathPrefix
+	}
+	cfg.PrefixMetrics = l.bool("HTTP_PATH_PREFIX_METRICS", false)
+
+	l.parse("LOG_LEVEL", "info", func(v string) (err error) {
+		cfg.LogLevel, err = parseLogLevel(v)
+		return err
+	})
+	cfg.LogFormat = l.string("LOG_FORMAT", logFormatJSON)
+	l.check(cfg.LogFormat == logFormatJSON || cfg.LogFormat == logFormatText,
+		"LOG_FORMAT must be %q or %q, got %q", logFormatJSON, logFormatText, cfg.LogFormat)
+
+	// Typos in the file would otherwise be silently ignored.
+	var unknown []string
+	for k := range l.file {
+		if !l.seen[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		l.errs = append(l.errs, fmt.Errorf("CONFIG_FILE: unknown setting %s", k))
+	}
+
+	return cfg, errors.Join(l.errs...)
+}
+
+// WriteReport prints the effective settings followed by the problems found
+// while loading, if any.
+func (c Config) WriteReport(w io.Writer, err error) {
+	fmt.Fprintln(w, "effective configuration:")
+	for _, s := range c.settings {
+		fmt.Fprintf(w, "  %-26s %-24s (%s)\n", s.Key, s.Value, s.Source)
+	}
+	if len(c.Warnings) > 0 {
+		fmt.Fprintln(w, "warnings:")
+		for _, line := range c.Warnings {
+			fmt.Fprintf(w, "  - %s\n", line)
+		}
+	}
+	if err == nil {
+		fmt.Fprintln(w, "config OK")
+		return
+	}
+	fmt.Fprintln(w, "problems:")
+	for _, line := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintf(w, "  - %s\n", line)
+	}
+}
+
+// handleConfig returns the effective settings with where each value came
+// from, in load order.
+func (s *Service) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.cfg.settings)
+}
+
+type loader struct {
+	cfg  *Config
+	errs []error
+
+	file map[string]string
+	seen map[string]bool
+	// src is where the value returned by the last lookup came from.
+	src string
+}
+
+func (l *loader) lookup(key string) (string, bool) {
+	l.seen[key] = true
+	if v := os.Getenv(key); v != "" {
+		l.src = sourceEnv
+		return v, true
+	}
+	if v, ok := l.file[key]; ok && v != "" {
+		l.src = sourceFile
+		return v, true
+	}
+	l.src = sourceDefault
+	return "", false
+}
+
+func (l *loader) record(key string, value any) {
+	l.cfg.settings = append(l.cfg.settings, setting{Key: key, Value: fmt.Sprint(value), Source: l.src})
+}
+
+func (l *loader) add(err error) {
+	if err != nil {
+		l.errs = append(l.errs, err)
+	}
+}
+
+func (l *loader) check(ok bool, format string, args ...any) {
+	if !ok {
+		l.errs = append(l.errs, fmt.Errorf(format, args...))
+	}
+}
+
+func (l *loader) string(key, def string) string {
+	v, ok := l.lookup(key)
+	if !ok {
+		v = def
+	}
+	l.record(key, v)
+	return v
+}
+
+// optional is string for settings that an explicitly empty value turns
+// off: only a key that is not set at all gets def.
+func (l *loader) optional(key, def string) string {
+	l.seen[key] = true
+	v, ok := os.LookupEnv(key)
+	l.src = sourceEnv
+	if !ok {
+		v, ok = l.file[key]
+		l.src = sourceFile
+	}
+	if !ok {
+		v, l.src = def, sourceDefault
+	}
+	l.record(key, v)
+	return v
+}
+
+// secret is string for values that must not show up in reports or on
+// /config, such as tokens and webhook URLs: only whether it is set is
+// recorded.
+func (l *loader) secret(key string) string {
+	v, ok := l.lookup(key)
+	if ok {
+		l.record(key, "<redacted>")
+	} else {
+		l.record(key, "")
+	}
+	return v
+}
+
+// parse hands the raw value (or def) to fn, which stores the parsed result
+// itself.
+func (l *loader) parse(key, def string, fn func(string) error) {
+	l.add(fn(l.string(key, def)))
+}
+
+func (l *loader) int(key string, def int) int {
+	v, ok := l.lookup(key)
+	if !ok {
+		l.record(key, def)
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %w", key, err))
+		n = def
+	}
+	l.record(key, n)
+	return n
+}
+
+// intOr is int for settings where a bad value should not stop the service:
+// anything unparsable or outside [lo, hi] is replaced by def with a warning.
+func (l *loader) intOr(key string, def, lo, hi int) int {
+	v, ok := l.lookup(key)
+	if !ok {
+		l.record(key, def)
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		l.cfg.Warnings = append(l.cfg.Warnings,
+			fmt.Sprintf("%s=%q is not an integer between %d and %d, using %d", key, v, lo, hi, def))
+		n = def
+	}
+	l.record(key, n)
+	return n
+}
+
+func (l *loader) float(key string, def float64) float64 {
+	v, ok := l.lookup(key)
+	if !ok {
+		l.record(key, def)
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %w", key, err))
+		f = def
+	}
+	l.record(key, f)
+	return f
+}
+
+func (l *loader) duration(key string, def time.Duration) time.Duration {
+	v, ok := l.lookup(key)
+	if !ok {
+		l.record(key, def)
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %w", key, err))
+		d = def
+	}
+	l.record(key, d)
+	return d
+}
+
+func (l *loader) bool(key string, def bool) bool {
+	v, ok := l.lookup(key)
+	if !ok {
+		l.record(key, def)
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %w", key, err))
+		b = def
+	}
+	l.record(key, b)
+	return b
+}
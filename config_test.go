@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig runs LoadConfig with env, given as key/value pairs, and an
+// optional CONFIG_FILE with contents file. A value of "<unset>" removes the
+// variable from the environment.
+func loadTestConfig(t *testing.T, file string, env ...string) (Config, error) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("CONFIG_FILE", path)
+	}
+	for i := 0; i+1 < len(env); i += 2 {
+		t.Setenv(env[i], env[i+1])
+		if env[i+1] == "<unset>" {
+			os.Unsetenv(env[i])
+		}
+	}
+	return LoadConfig()
+}
+
+func TestGRPCListenAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  []string
+		want string
+	}{
+		{name: "default", env: []string{"GRPC_LISTEN_ADDR", "<unset>"}, want: ":9090"},
+		{name: "set", env: []string{"GRPC_LISTEN_ADDR", ":7000"}, want: ":7000"},
+		{name: "empty env turns it off", env: []string{"GRPC_LISTEN_ADDR", ""}, want: ""},
+		{name: "empty in file turns it off", file: `{"GRPC_LISTEN_ADDR": ""}`, env: []string{"GRPC_LISTEN_ADDR", "<unset>"}, want: ""},
+		{name: "null in file turns it off", file: `{"GRPC_LISTEN_ADDR": null}`, env: []string{"GRPC_LISTEN_ADDR", "<unset>"}, want: ""},
+		{name: "env wins over file", file: `{"GRPC_LISTEN_ADDR": ":7000"}`, env: []string{"GRPC_LISTEN_ADDR", ""}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadTestConfig(t, tt.file, tt.env...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.GRPCListenAddr != tt.want {
+				t.Errorf("GRPCListenAddr = %q, want %q", cfg.GRPCListenAddr, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  []string
+		// want lists substrings that must all be in the joined error.
+		want []string
+	}{
+		{name: "bad int", env: []string{"MAX_STREAMS", "many"}, want: []string{`MAX_STREAMS: strconv.Atoi: parsing "many"`}},
+		{name: "bad duration", env: []string{"POLL_TIMEOUT", "30"}, want: []string{"POLL_TIMEOUT: time: missing unit"}},
+		{name: "bad bool", env: []string{"API_KEYS_REDIS", "yes please"}, want: []string{"API_KEYS_REDIS: strconv.ParseBool"}},
+		{name: "out of range", env: []string{"POLL_TIMEOUT", "5m"}, want: []string{"POLL_TIMEOUT must be in (0, 2m0s], got 5m0s"}},
+		{name: "unknown choice", env: []string{"QUEUE", "kafka"}, want: []string{`QUEUE must be "channel" or "stream", got "kafka"`}},
+		{name: "every problem is reported",
+			env:  []string{"REDIS_HEALTH_INTERVAL", "0s", "LOG_FORMAT", "xml", "SSE_BUFFER", "0"},
+			want: []string{"REDIS_HEALTH_INTERVAL must be positive", `LOG_FORMAT must be "json" or "text"`, "SSE_BUFFER must be between 1"}},
+		{name: "settings that need each other",
+			env:  []string{"TLS_CERT_FILE", "cert.pem", "QUEUE", "stream", "WORKER_FAIRNESS", "stream_cap"},
+			want: []string{"TLS_CERT_FILE and TLS_KEY_FILE must be set together", "WORKER_FAIRNESS=stream_cap needs QUEUE=channel"}},
+		{name: "bad pattern with per-stream settings",
+			env:  []string{"STREAM_NAME_PATTERN", "(", "ANOMALY_RETENTION_BY_STREAM", "bad name=1h"},
+			want: []string{"STREAM_NAME_PATTERN: error parsing regexp", `"bad name"`}},
+		{name: "pattern must take the default stream", env: []string{"STREAM_NAME_PATTERN", "[a-c]+"},
+			want: []string{`must match the default stream name "default"`}},
+		{name: "typo in file", file: `{"WINDOW_SIZ": 100}`, want: []string{"CONFIG_FILE: unknown setting WINDOW_SIZ"}},
+		{name: "nested object in file", file: `{"WINDOW_SIZE": {"value": 100}}`, want: []string{"WINDOW_SIZE: nested objects are not supported"}},
+		{name: "bad value in file", file: `{"WINDOW_SIZE": "big"}`, want: []string{"WINDOW_SIZE: strconv.Atoi"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, tt.file, tt.env...)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigSources(t *testing.T) {
+	cfg, err := loadTestConfig(t, `{"WINDOW_SIZE": 100, "Z_THRESHOLD": 3.5, "VOTE_WINDOWS": [10, 50], "LOG_LEVEL": null}`,
+		"Z_THRESHOLD", "2.5", "WINDOW_SIZE", "", "WORKER_COUNT", "lots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An empty variable falls back to the file, the file to the default.
+	if cfg.WindowSize != 100 || cfg.ZThreshold != 2.5 || !slices.Equal(cfg.VoteWindows, []int{10, 50}) {
+		t.Errorf("WindowSize %d, ZThreshold %v, VoteWindows %v", cfg.WindowSize, cfg.ZThreshold, cfg.VoteWindows)
+	}
+	source := make(map[string]string)
+	for _, s := range cfg.settings {
+		source[s.Key] = s.Source
+	}
+	for key, want := range map[string]string{
+		"WINDOW_SIZE": sourceFile, "Z_THRESHOLD": sourceEnv, "LOG_LEVEL": sourceDefault, "REDIS_KEY_PREFIX": sourceDefault,
+	} {
+		if source[key] != want {
+			t.Errorf("%s from %q, want %q", key, source[key], want)
+		}
+	}
+	// WORKER_COUNT falls back with a warning instead of failing.
+	if cfg.WorkerCount != defaultWorkerCount || len(cfg.Warnings) != 1 || !strings.Contains(cfg.Warnings[0], `WORKER_COUNT="lots"`) {
+		t.Errorf("WorkerCount %d, warnings %q", cfg.WorkerCount, cfg.Warnings)
+	}
+}
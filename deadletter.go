@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisDeadLetterKey is a list of JSON deadLetter entries, oldest first,
+	// shared by all replicas when DEADLETTER_REDIS is on.
+	redisDeadLetterKey = "metrics_deadletter"
+
+	maxRetryBackoff      = 5 * time.Second
+	maxDeadLetterSize    = 100_000
+	deadLetterPushWait   = 2 * time.Second
+	deadLetterReplayPage = 500
+)
+
+var (
+	failedSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "failed_samples_total",
+		Help: "Samples hit by a Redis failure by outcome: retried (per attempt), deadlettered, replayed or dropped",
+	}, []string{"outcome"})
+	deadLetterSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "deadletter_size",
+		Help: "Samples in the in-memory dead-letter buffer of this replica",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(failedSamples, deadLetterSize)
+	serviceRegistry.MustRegister(failedSamples, deadLetterSize)
+}
+
+// transientRedisError reports whether err may go away on its own: network
+// errors, timeouts, a closed client (replaced by superviseRedis) and the
+// replies of a Redis that is loading, failing over or busy. A command that
+// Redis rejects for good, such as WRONGTYPE, is not retried.
+func transientRedisError(err error) bool {
+	if err == nil || errors.Is(err, redis.Nil) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, redis.ErrClosed) ||
+		errors.Is(err, redis.ErrPoolTimeout) {
+		return true
+	}
+	for _, prefix := range []string{"LOADING", "READONLY", "TRYAGAIN", "CLUSTERDOWN", "MASTERDOWN", "BUSY"} {
+		if redis.HasErrorPrefix(err, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryRedis runs op until it succeeds, fails with a permanent error or has
+// been retried RETRY_ATTEMPTS times, sleeping RETRY_BACKOFF before the first
+// retry and twice as long before each next one, up to maxRetryBackoff.
+// Retries take the worker's current client, which superviseRedis may have
+// replaced. samples is what the retries count in failed_samples_total.
+// Retrying stops early once Drain has given up on the queue.
+func (s *Service) retryRedis(id, samples int, rdb *redis.Client, op func(*redis.Client) error) (attempts int, err error) {
+	backoff := s.cfg.RetryBackoff
+	for attempts = 1; ; attempts++ {
+		if err = op(rdb); err == nil || attempts > s.cfg.RetryAttempts || !transientRedisError(err) || s.aborted.Load() {
+			return attempts, err
+		}
+		failedSamples.WithLabelValues("retried").Add(float64(samples))
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxRetryBackoff)
+		rdb = s.redisFor(id)
+	}
+}
+
+// deadLetter is a sample that could not be processed, with the error of
+// its last attempt.
+type deadLetter struct {
+	Metric   Metric `json:"metric"`
+	Backfill bool   `json:"backfill,omitempty"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	FailedAt int64  `json:"failedAt"`
+}
+
+// deadLetters is the in-memory dead-letter buffer: the newest size samples,
+// the oldest evicted first.
+type deadLetters struct {
+	mu      sync.Mutex
+	size    int
+	entries []deadLetter
+}
+
+// add appends entries, and put puts entries taken by take back in front of
+// the ones added since. Both return how many were evicted.
+func (d *deadLetters) add(entries []deadLetter) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = append(d.entries, entries...)
+	return d.trim()
+}
+
+func (d *deadLetters) put(entries []deadLetter) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = append(slices.Clone(entries), d.entries...)
+	return d.trim()
+}
+
+func (d *deadLetters) trim() int {
+	evicted := max(0, len(d.entries)-d.size)
+	d.entries = slices.Clone(d.entries[evicted:])
+	deadLetterSize.Set(float64(len(d.entries)))
+	return evicted
+}
+
+func (d *deadLetters) take() []deadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := d.entries
+	d.entries = nil
+	deadLetterSize.Set(0)
+	return entries
+}
+
+func (d *deadLetters) len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.entries)
+}
+
+// deadLetter parks samples that failed for good. With DEADLETTER_REDIS they
+// go to the metrics_deadletter list; the in-memory buffer takes them when
+// the list is off or cannot be written either, which is likely when Redis
+// is what failed.
+func (s *Service) deadLetter(id int, batch []Metric, err error, attempts int) {
+	now := time.Now().Unix()
+	entries := make([]deadLetter, len(batch))
+	for i, m := range batch {
+		entries[i] = deadLetter{Metric: m, Backfill: m.backfill, Error: err.Error(), Attempts: attempts, FailedAt: now}
+	}
+	failedSamples.WithLabelValues("deadlettered").Add(float64(len(entries)))
+	slog.Error("samples dead-lettered", "worker", id, "samples", len(entries), "attempts", attempts,
+		"request_ids", batchRequestIDs(batch), "err", err)
+
+	if s.cfg.DeadLetterRedis {
+		evicted, perr := s.pushDeadLetters(entries)
+		if perr == nil {
+			failedSamples.WithLabelValues("dropped").Add(float64(evicted))
+			return
+		}
+		slog.Warn("dead-letter list write failed, keeping samples in memory", "key", s.key(redisDeadLetterKey), "err", perr)
+	}
+	failedSamples.WithLabelValues("dropped").Add(float64(s.dead.add(entries)))
+}
+
+// pushDeadLetters appends entries to the list, trims it to DEADLETTER_SIZE
+// and returns how many old entries the trim removed.
+func (s *Service) pushDeadLetters(entries []deadLetter) (int, error) {
+	args := make([]any, len(entries))
+	for i, e := range entries {
+		b, _ := json.Marshal(e)
+		args[i] = b
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, deadLetterPushWait)
+	defer cancel()
+	key := s.key(redisDeadLetterKey)
+	var push *redis.IntCmd
+	_, err := s.redis().TxPipelined(ctx, func(p redis.Pipeliner) error {
+		push = p.RPush(ctx, key, args...)
+		p.LTrim(ctx, key, -int64(s.cfg.DeadLetterSize), -1)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return max(0, int(push.Val())-s.cfg.DeadLetterSize), nil
+}
+
+type replayResult struct {
+	Replayed  int    `json:"replayed"`
+	Failed    int    `json:"failed"`
+	Remaining int    `json:"remaining"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleDeadLetterReplay queues the dead-lettered samples again: first the
+// in-memory buffer of this replica, then the metrics_deadletter list. It
+// takes only what was dead-lettered when it started, so samples that fail
+// again during the replay wait for the next one. It stops at the first
+// sample the queue does not take, puts that sample and the rest back, and
+// answers 503 so the caller can try again later. Failed counts the samples
+// the replay lost: corrupt entries and those that could not be put back.
+func (s *Service) handleDeadLetterReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	var res replayResult
+	defer func() {
+		failedSamples.WithLabelValues("replayed").Add(float64(res.Replayed))
+		failedSamples.WithLabelValues("dropped").Add(float64(res.Failed))
+	}()
+	// A replay never displaces or waits for fresh samples: it stops at the
+	// first one the queue does not take.
+	requeue := func(e deadLetter) error {
+		m := e.Metric
+		m.backfill = e.Backfill
+		return s.enqueue(r.Context(), m, overloadReject)
+	}
+
+	err := func() error {
+		entries := s.dead.take()
+		for i, e := range entries {
+			if err := requeue(e); err != nil {
+				res.Failed += s.dead.put(entries[i:])
+				return err
+			}
+			res.Replayed++
+		}
+		if !s.cfg.DeadLetterRedis {
+			return nil
+		}
+		key := s.key(redisDeadLetterKey)
+		budget, err := s.redis().LLen(r.Context(), key).Result()
+		if err != nil {
+			return err
+		}
+		for budget > 0 {
+			vals, err := s.redis().LPopCount(r.Context(), key, int(min(budget, deadLetterReplayPage))).Result()
+			if errors.Is(err, redis.Nil) || (err == nil && len(vals) == 0) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			budget -= int64(len(vals))
+			for i, v := range vals {
+				var e deadLetter
+				if json.Unmarshal([]byte(v), &e) != nil {
+					res.Failed++
+					continue
+				}
+				if err := requeue(e); err != nil {
+					rest := make([]any, 0, len(vals)-i)
+					for j := len(vals) - 1; j >= i; j-- {
+						rest = append(rest, vals[j])
+					}
+					if perr := s.redis().LPush(s.ctx, key, rest...).Err(); perr != nil {
+						res.Failed += len(rest)
+						slog.Error("dead-letter list re-push failed, samples lost", "key", key, "samples", len(rest), "err", perr)
+					}
+					return err
+				}
+				res.Replayed++
+			}
+		}
+		return nil
+	}()
+
+	res.Remaining = s.dead.len()
+	if s.cfg.DeadLetterRedis {
+		if n, lerr := s.redis().LLen(s.ctx, s.key(redisDeadLetterKey)).Result(); lerr == nil {
+			res.Remaining += int(n)
+		}
+	}
+	slog.InfoContext(r.Context(), "dead letters replayed", "replayed", res.Replayed, "failed", res.Failed, "remaining", res.Remaining)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		res.Error = err.Error()
+		if errors.Is(err, errOverloaded) {
+			w.Header().Set("Retry-After", retryAfterSeconds(s.overloadRetryAfter()))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterReplay(t *testing.T) {
+	entry := func(rps float64) string {
+		b, _ := json.Marshal(deadLetter{Metric: Metric{Timestamp: 1, CPU: 1, RPS: rps, Stream: defaultStream}, Error: "boom", Attempts: 3})
+		return string(b)
+	}
+	tests := []struct {
+		name     string
+		env      []string
+		memory   int
+		list     []string
+		wantCode int
+		want     replayResult
+		wantList int
+	}{
+		{name: "memory buffer", memory: 3,
+			wantCode: http.StatusOK, want: replayResult{Replayed: 3}},
+		{name: "memory then list", env: []string{"DEADLETTER_REDIS", "true"}, memory: 2, list: []string{entry(1), entry(2)},
+			wantCode: http.StatusOK, want: replayResult{Replayed: 4}},
+		{name: "corrupt entries are counted as failed", env: []string{"DEADLETTER_REDIS", "true"}, list: []string{entry(1), "{", entry(2)},
+			wantCode: http.StatusOK, want: replayResult{Replayed: 2, Failed: 1}},
+		{name: "full queue puts the rest back", env: []string{"DEADLETTER_REDIS", "true", "CHANNEL_CAPACITY", "3"}, memory: 1, list: []string{entry(1), entry(2), entry(3), entry(4)},
+			wantCode: http.StatusServiceUnavailable, want: replayResult{Replayed: 3, Remaining: 2, Error: errOverloaded.Error()}, wantList: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, mr := newTestService(t, tt.env...)
+			for i := range tt.memory {
+				svc.dead.add([]deadLetter{{Metric: Metric{Timestamp: 1, CPU: 1, RPS: float64(i), Stream: defaultStream}}})
+			}
+			for _, v := range tt.list {
+				mr.RPush(svc.key(redisDeadLetterKey), v)
+			}
+
+			rec := httptest.NewRecorder()
+			svc.handleDeadLetterReplay(rec, httptest.NewRequest(http.MethodPost, "/deadletter/replay", nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			var got replayResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("result %+v, want %+v", got, tt.want)
+			}
+			if n := len(svc.metricsCh); n != tt.want.Replayed {
+				t.Errorf("%d metrics queued, want %d", n, tt.want.Replayed)
+			}
+			if l, _ := mr.List(svc.key(redisDeadLetterKey)); len(l) != tt.wantList {
+				t.Errorf("%d entries left in the list, want %d", len(l), tt.wantList)
+			}
+		})
+	}
+}
+
+// TestDeadLetterReplayRefailing checks that samples failing again while
+// the replay runs are left for the next replay instead of being popped
+// over and over.
+func TestDeadLetterReplayRefailing(t *testing.T) {
+	svc, mr := newTestService(t, "DEADLETTER_REDIS", "true", "CHANNEL_CAPACITY", "10000")
+	const n = 2 * deadLetterReplayPage
+	for i := range n {
+		b, _ := json.Marshal(deadLetter{Metric: Metric{Timestamp: 1, CPU: 1, RPS: float64(i), Stream: defaultStream}})
+		mr.RPush(svc.key(redisDeadLetterKey), string(b))
+	}
+	// Stands in for a worker whose Redis writes keep failing.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case m := <-svc.metricsCh:
+				b, _ := json.Marshal(deadLetter{Metric: m})
+				mr.RPush(svc.key(redisDeadLetterKey), string(b))
+			}
+		}
+	}()
+
+	done := make(chan replayResult)
+	go func() {
+		rec := httptest.NewRecorder()
+		svc.handleDeadLetterReplay(rec, httptest.NewRequest(http.MethodPost, "/deadletter/replay", nil))
+		var res replayResult
+		_ = json.Unmarshal(rec.Body.Bytes(), &res)
+		done <- res
+	}()
+	select {
+	case res := <-done:
+		if res.Replayed != n {
+			t.Errorf("replayed %d, want %d", res.Replayed, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay did not finish")
+	}
+}
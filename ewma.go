@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	detectorWindow = "window"
+	detectorEWMA   = "ewma"
+
+	redisEWMAKey   = "ewma_state"
+	ewmaTxAttempts = 5
+)
+
+// ewma is an exponentially weighted mean and variance, updated with the
+// incremental form from Finch, "Incremental calculation of weighted mean and
+// variance".
+type ewma struct {
+	Mean, Var float64
+}
+
+func (e *ewma) add(x, alpha float64, first bool) {
+	if first {
+		e.Mean, e.Var = x, 0
+		return
+	}
+	d := x - e.Mean
+	inc := alpha * d
+	e.Mean += inc
+	e.Var = (1 - alpha) * (e.Var + d*inc)
+}
+
+// ewmaState is the per-stream EWMA baseline kept in the ewma_state hash
+// instead of the window lists. Named series keep their own count, since not
+// every metric carries them.
+type ewmaState struct {
+	Count    int
+	RPS, CPU ewma
+	Series   map[string]*ewmaSeries
+}
+
+type ewmaSeries struct {
+	Count int
+	ewma
+}
+
+func parseEWMAState(h map[string]string) ewmaState {
+	f := func(k string) float64 {
+		v, err := strconv.ParseFloat(h[k], 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0
+		}
+		return v
+	}
+	n, _ := strconv.Atoi(h["count"])
+	st := ewmaState{
+		Count:  n,
+		RPS:    ewma{Mean: f("rps_mean"), Var: f("rps_var")},
+		CPU:    ewma{Mean: f("cpu_mean"), Var: f("cpu_var")},
+		Series: make(map[string]*ewmaSeries),
+	}
+	for k := range h {
+		name, ok := strings.CutPrefix(k, "series:")
+		if !ok {
+			continue
+		}
+		name, ok = strings.CutSuffix(name, ":count")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.Atoi(h[k])
+		st.Series[name] = &ewmaSeries{
+			Count: n,
+			ewma:  ewma{Mean: f("series:" + name + ":mean"), Var: f("series:" + name + ":var")},
+		}
+	}
+	return st
+}
+
+func (st ewmaState) fields() map[string]any {
+	m := map[string]any{
+		"count":    st.Count,
+		"rps_mean": st.RPS.Mean,
+		"rps_var":  st.RPS.Var,
+		"cpu_mean": st.CPU.Mean,
+		"cpu_var":  st.CPU.Var,
+	}
+	for name, se := range st.Series {
+		m["series:"+name+":count"] = se.Count
+		m["series:"+name+":mean"] = se.Mean
+		m["series:"+name+":var"] = se.Var
+	}
+	return m
+}
+
+// scoreEWMA scores each sample against the EWMA baseline built from the
+// samples before it and then folds the sample in. The state is read and
+// written under WATCH, so two workers handling the same stream retry
+// instead of overwriting each other's updates.
+func (s *Service) scoreEWMA(rdb *redis.Client, stream string, batch []Metric, values []float64, pushes []windowPush) ([]Analysis, error) {
+	key := s.streamKey(redisEWMAKey, stream)
+	anals := make([]Analysis, len(batch))
+	var st ewmaState
+
+	txf := func(tx *redis.Tx) error {
+		h, err := tx.HGetAll(s.ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		st = parseEWMAState(h)
+		for i, m := range batch {
+			anals[i] = s.analyzeEWMA(m, values[i], st)
+			first := st.Count == 0
+			st.RPS.add(values[i], s.cfg.EWMAAlpha, first)
+			st.CPU.add(m.CPU, s.cfg.EWMAAlpha, first)
+			st.Count++
+			for name, v := range m.Values {
+				se := st.Series[name]
+				if se == nil {
+					se = &ewmaSeries{}
+					st.Series[name] = se
+				}
+				se.add(v, s.cfg.EWMAAlpha, se.Count == 0)
+				se.Count++
+			}
+		}
+		_, err = tx.TxPipelined(s.ctx, func(p redis.Pipeliner) error {
+			p.HSet(s.ctx, key, st.fields())
+			s.appendWindows(s.ctx, p, pushes)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for range ewmaTxAttempts {
+		err = rdb.Watch(s.ctx, txf, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis ewma %s: %w", key, err)
+	}
+
+	fields := st.fields()
+	s.secondary.write(func(ctx context.Context, c redis.Cmdable) error {
+		_, err := c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, key, fields)
+			s.appendWindows(ctx, p, pushes)
+			return nil
+		})
+		return err
+	})
+	return anals, nil
+}
+
+func (s *Service) analyzeEWMA(m Metric, value float64, st ewmaState) Analysis {
+	stddev := math.Sqrt(st.RPS.Var)
+	cpuStdDev := math.Sqrt(st.CPU.Var)
+	anal := Analysis{
+		Detector:        detectorEWMA,
+		Alpha:           s.cfg.EWMAAlpha,
+		Count:           st.Count,
+		RollingAvg:      st.RPS.Mean,
+		StdDev:          stddev,
+		ZScore:          zScore(value, st.RPS.Mean, stddev, st.Count),
+		PercentDev:      percentDeviation(value, st.RPS.Mean),
+		ThresholdPct:    s.cfg.PercentThreshold,
+		LastRPS:         m.RPS,
+		LastCPU:         m.CPU,
+		LastTs:          m.Timestamp,
+		ComputedAt:      time.Now().Unix(),
+		SmoothingWindow: s.cfg.SmoothingWindow,
+		RollingAvgCPU:   st.CPU.Mean,
+		StdDevCPU:       cpuStdDev,
+		ZScoreCPU:       zScore(m.CPU, st.CPU.Mean, cpuStdDev, st.Count),
+	}
+	if s.cfg.SmoothingWindow > 1 {
+		anal.SmoothedRPS = value
+	}
+	for name, v := range m.Values {
+		var se ewmaSeries
+		if p := st.Series[name]; p != nil {
+			se = *p
+		}
+		sd := math.Sqrt(se.Var)
+		setSeries(&anal, name, SeriesResult{
+			Value:      v,
+			Count:      se.Count,
+			RollingAvg: se.Mean,
+			StdDev:     sd,
+			ZScore:     zScore(v, se.Mean, sd, se.Count),
+		})
+	}
+	s.rescoreBaseline(&anal, s.tuning().ZThreshold)
+	return anal
+}
+
+// warmup is the Count a baseline needs before anything is flagged:
+// EWMA_WARMUP samples for EWMA, SEASONAL_WARMUP past occurrences of the
+// hour for the seasonal baseline. A window needs none.
+func (s *Service) warmup() int {
+	switch s.tuning().Detector {
+	case detectorEWMA:
+		return s.cfg.EWMAWarmup
+	case detectorSeasonal:
+		return s.cfg.SeasonalWarmup
+	}
+	return 0
+}
+
+// rescoreBaseline applies the anomaly rules to an EWMA or seasonal analysis
+// with the given z threshold. Nothing is flagged before the warm-up, since
+// the first estimates swing wildly.
+func (s *Service) rescoreBaseline(anal *Analysis, threshold float64) {
+	anal.ThresholdZ = threshold
+	warm := anal.Count >= s.warmup()
+	anal.IsAnomalyCPU = warm && math.Abs(anal.ZScoreCPU) > threshold
+
+	anal.Reason = ""
+	switch {
+	case !warm:
+	case math.Abs(anal.ZScore) > threshold:
+		anal.Reason = reasonZScore
+	case s.cfg.PercentThreshold > 0 && math.Abs(anal.PercentDev) > s.cfg.PercentThreshold:
+		anal.Reason = reasonPercent
+	case anal.IsAnomalyCPU:
+		anal.Reason = reasonCPUZScore
+	}
+	anal.IsAnomaly = anal.Reason != ""
+	s.flagSeries(anal, threshold)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisExpectedSourcesKey is a hash of the streams that must keep
+	// sending, each with the unix time it was added; /admin/sources edits
+	// it and every replica reads it.
+	redisExpectedSourcesKey = "expected_sources"
+	// redisSourcesDownKey is a hash of the expected streams reported down,
+	// each with its last-seen time. Setting a field is what claims the
+	// report, so a source going down alerts once across replicas.
+	redisSourcesDownKey = "sources_down"
+
+	// reasonSourceDown flags an expected stream that sent nothing for
+	// SOURCE_DOWN_AFTER. No sample is behind it, so it has no z-score.
+	reasonSourceDown = "source_down"
+)
+
+var (
+	sourcesDownTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sources_down_total",
+		Help: "Expected sources reported down after sending nothing for SOURCE_DOWN_AFTER",
+	})
+	sourcesDown = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sources_down",
+		Help: "Expected sources currently down, as last checked by this replica",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(sourcesDownTotal, sourcesDown)
+	serviceRegistry.MustRegister(sourcesDownTotal, sourcesDown)
+}
+
+// expectedSource is an expected stream with when it last produced an
+// analysis. A source that never did counts as seen when it was added.
+type expectedSource struct {
+	Source   string `json:"source"`
+	AddedAt  int64  `json:"addedAt"`
+	LastSeen int64  `json:"lastSeen"`
+	Down     bool   `json:"down"`
+}
+
+// expectedSources reads the expected streams, sorted by name, with their
+// last analysis and down mark.
+func (s *Service) expectedSources(ctx context.Context) ([]expectedSource, error) {
+	rdb := s.redis()
+	var added, down *redis.MapStringStringCmd
+	if _, err := rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		added = p.HGetAll(ctx, s.key(redisExpectedSourcesKey))
+		down = p.HGetAll(ctx, s.key(redisSourcesDownKey))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(added.Val()) == 0 {
+		return nil, nil
+	}
+	out := make([]expectedSource, 0, len(added.Val()))
+	for name, v := range added.Val() {
+		at, _ := strconv.ParseInt(v, 10, 64)
+		_, isDown := down.Val()[name]
+		out = append(out, expectedSource{Source: name, AddedAt: at, LastSeen: at, Down: isDown})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Source < out[j].Source })
+
+	keys := make([]string, len(out))
+	for i, e := range out {
+		keys[i] = s.streamKey(redisLastKey, e.Source)
+	}
+	vals, err := rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range vals {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var last struct {
+			ComputedAt int64 `json:"computedAt"`
+		}
+		if json.Unmarshal([]byte(str), &last) == nil {
+			out[i].LastSeen = max(out[i].LastSeen, last.ComputedAt)
+		}
+	}
+	return out, nil
+}
+
+// sourceCheckLoop runs checkSources every SOURCE_CHECK_INTERVAL until the
+// service starts stopping.
+func (s *Service) sourceCheckLoop() {
+	t := time.NewTicker(s.cfg.SourceCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case now := <-t.C:
+			s.checkSources(now)
+		}
+	}
+}
+
+// checkSources compares every expected stream's last analysis with now. A
+// stream silent for SOURCE_DOWN_AFTER is reported down once, by whichever
+// replica marks it first; a down stream that produced an analysis since
+// is cleared.
+func (s *Service) checkSources(now time.Time) {
+	sources, err := s.expectedSources(s.ctx)
+	if err != nil {
+		slog.Error("expected sources check failed", "err", err)
+		return
+	}
+	downKey := s.key(redisSourcesDownKey)
+	n := 0
+	for _, e := range sources {
+		silent := now.Sub(time.Unix(e.LastSeen, 0))
+		if silent < s.cfg.SourceDownAfter {
+			if e.Down {
+				if err := s.redis().HDel(s.ctx, downKey, e.Source).Err(); err != nil {
+					slog.Error("redis HDEL failed", "key", downKey, "err", err)
+				} else {
+					slog.Info("expected source back", "stream", e.Source, "last_seen", e.LastSeen)
+				}
+			}
+			continue
+		}
+		n++
+		if e.Down {
+			continue
+		}
+		claimed, err := s.redis().HSetNX(s.ctx, downKey, e.Source, e.LastSeen).Result()
+		if err != nil {
+			slog.Error("redis HSETNX failed", "key", downKey, "err", err)
+			continue
+		}
+		if claimed {
+			s.reportSourceDown(e, now)
+		}
+	}
+	sourcesDown.Set(float64(n))
+}
+
+// reportSourceDown publishes, records and alerts a source_down anomaly the
+// way observe does for a scored sample.
+func (s *Service) reportSourceDown(e expectedSource, now time.Time) {
+	anal := Analysis{
+		Stream:         e.Source,
+		Detector:       s.tuning().Detector,
+		IsAnomaly:      true,
+		Reason:         reasonSourceDown,
+		Severity:       severityCritical,
+		LastTs:         e.LastSeen,
+		ComputedAt:     now.Unix(),
+		ComputedAtNano: now.UnixNano(),
+	}
+	slog.Warn("expected source down", "stream", e.Source, "last_seen", e.LastSeen,
+		"silent_for", now.Sub(time.Unix(e.LastSeen, 0)).Round(time.Second).String())
+	sourcesDownTotal.Inc()
+	anomalyTotal.WithLabelValues(reasonSourceDown).Inc()
+	anomalySeverityTotal.WithLabelValues(severityCritical).Inc()
+	s.publishUpdates(s.ctx, s.redis(), anal)
+	s.alerts.notify(anal)
+
+	if pol, _ := s.historyRetention(e.Source); pol.Size > 0 {
+		b, _ := json.Marshal(anomalyRecord{Timestamp: now.Unix(), Severity: anal.Severity, Analysis: anal})
+		_, err := s.redis().Pipelined(s.ctx, func(p redis.Pipeliner) error {
+			s.appendHistory(s.ctx, p, e.Source, []redis.Z{{Score: float64(now.Unix()), Member: b}})
+			return nil
+		})
+		if err != nil {
+			slog.Error("redis write failed", "stream", e.Source, "err", err)
+		}
+	}
+}
+
+// handleAdminSources manages the expected streams: GET lists them with
+// their last-seen time, PUT {"sources": [...]} adds streams and DELETE
+// ?source= removes one.
+func (s *Service) handleAdminSources(w http.ResponseWriter, r *http.Request) {
+	key := s.key(redisExpectedSourcesKey)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Sources []string `json:"sources"`
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			writeBodyError(w, "bad json", err)
+			return
+		}
+		if len(req.Sources) == 0 {
+			http.Error(w, "sources must list at least one stream", http.StatusBadRequest)
+			return
+		}
+		for _, name := range req.Sources {
+			if err := s.validateStreamName(name); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		now := time.Now().Unix()
+		_, err := s.redis().Pipelined(r.Context(), func(p redis.Pipeliner) error {
+			for _, name := range req.Sources {
+				p.HSetNX(r.Context(), key, name, now)
+			}
+			return nil
+		})
+		if err != nil {
+			http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	case http.MethodDelete:
+		name := r.URL.Query().Get("source")
+		if err := s.validateStreamName(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err := s.redis().Pipelined(r.Context(), func(p redis.Pipeliner) error {
+			p.HDel(r.Context(), key, name)
+			p.HDel(r.Context(), s.key(redisSourcesDownKey), name)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	default:
+		http.Error(w, "GET, PUT or DELETE only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sources, err := s.expectedSources(r.Context())
+	if err != nil {
+		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if sources == nil {
+		sources = []expectedSource{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(sources)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSources(t *testing.T) {
+	svc, mr := newTestService(t, "SOURCE_DOWN_AFTER", "1m")
+	start := time.Now().Truncate(time.Second)
+	mr.HSet(svc.key(redisExpectedSourcesKey), "web", strconv.FormatInt(start.Unix(), 10))
+	mr.HSet(svc.key(redisExpectedSourcesKey), "api", strconv.FormatInt(start.Unix(), 10))
+	updates := svc.updates.subscribe("web", 4)
+	defer svc.updates.unsubscribe(updates)
+
+	setLast := func(stream string, at time.Time) {
+		b, _ := json.Marshal(Analysis{Stream: stream, ComputedAt: at.Unix()})
+		mr.Set(svc.streamKey(redisLastKey, stream), string(b))
+	}
+	down := func() []string {
+		keys, _ := mr.HKeys(svc.key(redisSourcesDownKey))
+		slices.Sort(keys)
+		return keys
+	}
+
+	// api keeps sending, web never did.
+	setLast("api", start.Add(10*time.Minute))
+	svc.checkSources(start.Add(30 * time.Second))
+	if got := down(); len(got) != 0 {
+		t.Fatalf("down before SOURCE_DOWN_AFTER: %v", got)
+	}
+	svc.checkSources(start.Add(2 * time.Minute))
+	if got := down(); !slices.Equal(got, []string{"web"}) {
+		t.Fatalf("down = %v, want [web]", got)
+	}
+	select {
+	case a := <-updates:
+		if a.Reason != reasonSourceDown || !a.IsAnomaly || a.Severity != severityCritical || a.LastTs != start.Unix() {
+			t.Errorf("published %+v", a)
+		}
+	default:
+		t.Fatal("source_down not published")
+	}
+
+	// Still down: reported once only.
+	svc.checkSources(start.Add(3 * time.Minute))
+	select {
+	case a := <-updates:
+		t.Fatalf("reported again: %+v", a)
+	default:
+	}
+	if n, _ := svc.redis().ZCard(svc.ctx, svc.streamKey(redisHistoryKey, "web")).Result(); n != 1 {
+		t.Errorf("history holds %d records, want 1", n)
+	}
+
+	// web comes back.
+	setLast("web", start.Add(3*time.Minute))
+	svc.checkSources(start.Add(3*time.Minute + time.Second))
+	if got := down(); len(got) != 0 {
+		t.Errorf("down after the source came back: %v", got)
+	}
+}
+
+func TestAdminSources(t *testing.T) {
+	svc, mr := newTestService(t)
+	do := func(method, target, body string) ([]expectedSource, int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		svc.handleAdminSources(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var got []expectedSource
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return got, rec.Code
+	}
+	names := func(got []expectedSource) []string {
+		var out []string
+		for _, e := range got {
+			out = append(out, e.Source)
+		}
+		return out
+	}
+
+	if got, code := do(http.MethodGet, "/admin/sources", ""); code != http.StatusOK || len(got) != 0 {
+		t.Fatalf("empty GET: %d %v", code, got)
+	}
+	got, code := do(http.MethodPut, "/admin/sources", `{"sources":["web","api"]}`)
+	if code != http.StatusOK || !slices.Equal(names(got), []string{"api", "web"}) {
+		t.Fatalf("PUT: %d %v", code, got)
+	}
+	mr.HSet(svc.key(redisSourcesDownKey), "web", "1")
+	got, code = do(http.MethodDelete, "/admin/sources?source=web", "")
+	if code != http.StatusOK || !slices.Equal(names(got), []string{"api"}) {
+		t.Fatalf("DELETE: %d %v", code, got)
+	}
+	if mr.HGet(svc.key(redisSourcesDownKey), "web") != "" {
+		t.Error("DELETE left the down mark")
+	}
+
+	for _, tt := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodPut, "/admin/sources", `{"sources":[]}`, http.StatusBadRequest},
+		{http.MethodPut, "/admin/sources", `{"sources":["bad name"]}`, http.StatusBadRequest},
+		{http.MethodPut, "/admin/sources", `{"streams":["web"]}`, http.StatusBadRequest},
+		{http.MethodDelete, "/admin/sources", "", http.StatusBadRequest},
+		{http.MethodPost, "/admin/sources", "", http.StatusMethodNotAllowed},
+	} {
+		if _, code := do(tt.method, tt.target, tt.body); code != tt.want {
+			t.Errorf("%s %s %s: got %d, want %d", tt.method, tt.target, tt.body, code, tt.want)
+		}
+	}
+}
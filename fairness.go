@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Worker fairness policies (WORKER_FAIRNESS), channel mode only.
+const (
+	// fairnessFIFO processes metrics in arrival order, whatever stream
+	// they belong to.
+	fairnessFIFO = "fifo"
+	// fairnessStreamCap lets one stream occupy at most WORKER_STREAM_SHARE
+	// of the workers at a time; see fairScheduler.
+	fairnessStreamCap = "stream_cap"
+
+	defaultWorkerStreamShare = 0.5
+)
+
+var (
+	streamProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stream_processed_total",
+		Help: "Samples processed by this replica, by stream",
+	}, []string{"stream"})
+	fairnessDeferred = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "worker_fairness_deferred_total",
+		Help: "Samples set aside with WORKER_FAIRNESS=stream_cap because their stream already had its share of workers",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(streamProcessed, fairnessDeferred)
+	serviceRegistry.MustRegister(streamProcessed, fairnessDeferred)
+}
+
+// fairScheduler keeps a noisy stream from taking every worker. A worker
+// takes a slot of each stream in its batch; when a stream already has its
+// share of slots, its samples are set aside instead, and the worker goes
+// on with the other streams and then back to the queue, which is how the
+// samples of quiet streams behind a burst get picked up. The set-aside
+// samples are processed by a worker that holds a slot of their stream,
+// when it finishes its own, so nothing of a stream waits without a worker
+// on it. At most CHANNEL_CAPACITY samples are set aside; past that, a
+// batch is processed over the share rather than blocking a worker that
+// may itself hold slots the others wait for.
+type fairScheduler struct {
+	share       float64
+	maxDeferred int
+	workers     func() int
+
+	mu        sync.Mutex
+	active    map[string]int
+	deferred  map[string][]Metric
+	nDeferred int
+}
+
+// newFairScheduler returns nil, which schedules in arrival order, unless
+// WORKER_FAIRNESS is stream_cap.
+func newFairScheduler(cfg Config, workers func() int) *fairScheduler {
+	if cfg.WorkerFairness != fairnessStreamCap {
+		return nil
+	}
+	return &fairScheduler{
+		share:       cfg.WorkerStreamShare,
+		maxDeferred: cfg.ChannelCapacity,
+		workers:     workers,
+		active:      make(map[string]int),
+		deferred:    make(map[string][]Metric),
+	}
+}
+
+// limit is how many workers may process one stream at once.
+func (f *fairScheduler) limit() int {
+	return max(1, int(math.Floor(f.share*float64(f.workers()))))
+}
+
+// acquire takes a slot of every stream in batch and returns the samples
+// the worker should process: those of the streams it got a slot for. It
+// never blocks.
+func (f *fairScheduler) acquire(batch []Metric) []Metric {
+	if f == nil {
+		return batch
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	limit := f.limit()
+	var keep []Metric
+	for _, group := range groupByStream(batch) {
+		stream := streamOf(group[0])
+		if f.active[stream] >= limit && f.nDeferred+len(group) <= f.maxDeferred {
+			f.deferred[stream] = append(f.deferred[stream], group...)
+			f.nDeferred += len(group)
+			fairnessDeferred.Add(float64(len(group)))
+			continue
+		}
+		f.active[stream]++
+		keep = append(keep, group...)
+	}
+	return keep
+}
+
+// release is called with the batch acquire returned once it is processed.
+// It returns the samples set aside for those streams meanwhile, keeping
+// their slots for the worker to process them, and frees the other slots.
+func (f *fairScheduler) release(batch []Metric) []Metric {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var next []Metric
+	for _, group := range groupByStream(batch) {
+		stream := streamOf(group[0])
+		if pending := f.deferred[stream]; len(pending) > 0 {
+			delete(f.deferred, stream)
+			f.nDeferred -= len(pending)
+			next = append(next, pending...)
+			continue
+		}
+		if f.active[stream]--; f.active[stream] <= 0 {
+			delete(f.active, stream)
+		}
+	}
+	return next
+}
+
+func streamOf(m Metric) string {
+	if m.Stream == "" {
+		return defaultStream
+	}
+	return m.Stream
+}
+
+// streamRates tracks how many samples per second this replica processes
+// for each stream, smoothed like the drain rate; see backpressureLoop.
+type streamRates struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	rates  map[string]float64
+}
+
+func newStreamRates() *streamRates {
+	return &streamRates{counts: make(map[string]int64), rates: make(map[string]float64)}
+}
+
+func (r *streamRates) add(stream string, n int) {
+	streamProcessed.WithLabelValues(stream).Add(float64(n))
+	r.mu.Lock()
+	r.counts[stream] += int64(n)
+	r.mu.Unlock()
+}
+
+// tick folds the samples counted over elapsed into the rates.
+func (r *streamRates) tick(elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for stream := range r.rates {
+		if _, ok := r.counts[stream]; !ok {
+			r.counts[stream] = 0
+		}
+	}
+	for stream, n := range r.counts {
+		rate := float64(n) / elapsed.Seconds()
+		if prev, ok := r.rates[stream]; ok {
+			rate = drainRateSmoothing*rate + (1-drainRateSmoothing)*prev
+		}
+		r.rates[stream] = rate
+	}
+	clear(r.counts)
+}
+
+func (r *streamRates) rate(stream string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rates[stream]
+}
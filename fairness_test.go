@@ -0,0 +1,128 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFairScheduler(t *testing.T) {
+	metrics := func(streams ...string) []Metric {
+		batch := make([]Metric, len(streams))
+		for i, s := range streams {
+			batch[i] = Metric{Stream: s, RPS: float64(i)}
+		}
+		return batch
+	}
+	streams := func(batch []Metric) []string {
+		out := make([]string, len(batch))
+		for i, m := range batch {
+			out[i] = streamOf(m)
+		}
+		return out
+	}
+
+	// Four workers with a share of 0.5: two may work on one stream.
+	f := newFairScheduler(Config{WorkerFairness: fairnessStreamCap, WorkerStreamShare: 0.5, ChannelCapacity: 3}, func() int { return 4 })
+	w1 := f.acquire(metrics("noisy", "noisy"))
+	w2 := f.acquire(metrics("noisy", "quiet"))
+	if got := streams(w1); !slices.Equal(got, []string{"noisy", "noisy"}) {
+		t.Fatalf("worker 1 got %v", got)
+	}
+	if got := streams(w2); !slices.Equal(got, []string{"noisy", "quiet"}) {
+		t.Fatalf("worker 2 got %v", got)
+	}
+	// A third worker gets only the quiet sample; the noisy ones wait for
+	// a worker that holds a noisy slot.
+	w3 := f.acquire(metrics("noisy", "", "noisy"))
+	if got := streams(w3); !slices.Equal(got, []string{defaultStream}) {
+		t.Fatalf("worker 3 got %v, want only the default stream", got)
+	}
+	// Past CHANNEL_CAPACITY set-aside samples, the share is exceeded
+	// rather than blocking.
+	if got := streams(f.acquire(metrics("noisy", "noisy"))); len(got) != 2 {
+		t.Fatalf("over the set-aside limit got %v, want both samples", got)
+	}
+
+	// Worker 2 finishes first and takes over the set-aside noisy samples,
+	// in their order; its quiet slot is freed.
+	next := f.release(w2)
+	if !slices.Equal(streams(next), []string{"noisy", "noisy"}) || next[0].RPS != 0 || next[1].RPS != 2 {
+		t.Fatalf("worker 2 got back %v", next)
+	}
+	if n := f.active["quiet"]; n != 0 {
+		t.Errorf("quiet slot still held: %d", n)
+	}
+	if got := f.release(next); got != nil {
+		t.Errorf("nothing left, got %v", got)
+	}
+	f.release(w1)
+	f.release(w3)
+	if len(f.active) != 1 || f.active["noisy"] != 1 || f.nDeferred != 0 {
+		t.Errorf("state after release: active %v, deferred %d", f.active, f.nDeferred)
+	}
+}
+
+func TestFairSchedulerOff(t *testing.T) {
+	f := newFairScheduler(Config{WorkerFairness: fairnessFIFO}, func() int { return 1 })
+	batch := []Metric{{Stream: "a"}, {Stream: "a"}}
+	if got := f.acquire(batch); len(got) != 2 {
+		t.Errorf("acquire %v", got)
+	}
+	if got := f.release(batch); got != nil {
+		t.Errorf("release %v", got)
+	}
+}
+
+func TestStreamRates(t *testing.T) {
+	r := newStreamRates()
+	r.add("a", 10)
+	r.tick(time.Second)
+	if got := r.rate("a"); got != 10 {
+		t.Fatalf("rate %v, want 10", got)
+	}
+	// A stream that processed nothing decays instead of keeping its rate.
+	r.tick(time.Second)
+	if got := r.rate("a"); got != 10*(1-drainRateSmoothing) {
+		t.Errorf("rate %v, want %v", got, 10*(1-drainRateSmoothing))
+	}
+}
+
+// TestFairWorkers checks that with stream_cap every sample is still
+// processed, in its stream's order.
+func TestFairWorkers(t *testing.T) {
+	svc, mr := newTestService(t, "WORKER_FAIRNESS", fairnessStreamCap, "WORKER_STREAM_SHARE", "0.25",
+		"WORKER_COUNT", "4", "CHANNEL_CAPACITY", "1000", "WINDOW_SIZE", "1000")
+	now := time.Now().Unix()
+	for i := range 500 {
+		stream := "noisy"
+		if i%50 == 0 {
+			stream = "quiet"
+		}
+		if err := svc.enqueue(svc.ctx, Metric{Timestamp: now, CPU: 1, RPS: float64(i), Stream: stream}, overloadReject); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := svc.StartWorkers(4); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.processed.Load() < 500 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := svc.processed.Load(); n != 500 {
+		t.Fatalf("processed %d, want 500", n)
+	}
+	for stream, want := range map[string]int{"noisy": 490, "quiet": 10} {
+		l, _ := mr.List(svc.streamKey(redisWindowKey, stream))
+		if len(l) != want {
+			t.Errorf("%s window holds %d, want %d", stream, len(l), want)
+		}
+		// One worker at a time per stream: the window is newest first.
+		nums := parseWindow(l)
+		if !slices.IsSortedFunc(nums, func(a, b float64) int { return cmp.Compare(b, a) }) {
+			t.Errorf("%s processed out of order: %v", stream, nums)
+		}
+	}
+}
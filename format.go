@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Output formats of /analyze, chosen with ?format= or the Accept header.
+const (
+	formatJSON       = "json"
+	formatMsgpack    = "msgpack"
+	formatCSV        = "csv"
+	formatPrometheus = "prometheus"
+
+	// analysisMetricPrefix prefixes the metric names of the Prometheus
+	// format, e.g. analysis_z_score.
+	analysisMetricPrefix = "analysis_"
+)
+
+// errNotAcceptable is returned by analysisFormat when Accept rules out every
+// format, which is answered with 406 rather than 400.
+var errNotAcceptable = errors.New("none of the accepted media types is available: want application/json, application/msgpack, text/csv or text/plain")
+
+// analysisMediaTypes maps each format to its media type, in the order
+// preferred when the Accept header ranks several equally.
+var analysisMediaTypes = []struct{ format, mediaType string }{
+	{formatJSON, "application/json"},
+	{formatMsgpack, "application/msgpack"},
+	{formatCSV, "text/csv"},
+	{formatPrometheus, "text/plain"},
+}
+
+// analysisFormat picks the output format of a request: ?format= if given,
+// else the acceptable media type with the highest q-value in Accept. A
+// missing Accept, */* and application/* mean JSON, so browsers and curl get
+// what they got before; a Prometheus scrape, which ranks text/plain above
+// */*, gets the exposition format.
+func analysisFormat(r *http.Request) (string, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		for _, mt := range analysisMediaTypes {
+			if f == mt.format {
+				return f, nil
+			}
+		}
+		return "", fmt.Errorf("format must be %s, %s, %s or %s, got %q", formatJSON, formatMsgpack, formatCSV, formatPrometheus, f)
+	}
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return formatJSON, nil
+	}
+
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		for _, mt := range analysisMediaTypes {
+			if !mediaMatches(mediaType, mt.mediaType) {
+				continue
+			}
+			if q > bestQ || (q == bestQ && preference(mt.format) < preference(best)) {
+				best, bestQ = mt.format, q
+			}
+		}
+	}
+	if best == "" {
+		return "", errNotAcceptable
+	}
+	return best, nil
+}
+
+func mediaMatches(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	group, _, _ := strings.Cut(mediaType, "/")
+	// application/* only stands for JSON, not for MessagePack.
+	return pattern == group+"/*" && (group != "application" || mediaType == "application/json")
+}
+
+func preference(format string) int {
+	for i, mt := range analysisMediaTypes {
+		if mt.format == format {
+			return i
+		}
+	}
+	return len(analysisMediaTypes)
+}
+
+// writeAnalysis renders anal in format.
+func writeAnalysis(w http.ResponseWriter, format string, anal Analysis) {
+	w.Header().Add("Vary", "Accept")
+	switch format {
+	case formatMsgpack:
+		b, err := msgpack.Marshal(anal)
+		if err != nil {
+			http.Error(w, "msgpack error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/msgpack")
+		_, _ = w.Write(b)
+	case formatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		_ = writeAnalysisCSV(w, anal)
+	case formatPrometheus:
+		w.Header().Set("Content-Type", string(expfmt.NewFormat(expfmt.TypeTextPlain)))
+		_ = writeAnalysisPrometheus(w, anal)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(anal)
+	}
+}
+
+// analysisField is a scalar leaf of an Analysis: a bool, an int64, a
+// float64 or a string. Arrays (samples, vote.votes) have no flat form and
+// are only in the JSON and MessagePack formats.
+type analysisField struct {
+	name   string // dotted JSON name, e.g. joint.zScoreRps or series.latency.zScore
+	metric string // Prometheus name without the prefix, e.g. joint_z_score_rps
+	series string // series name of a series.* field
+	desc   string
+	value  any
+}
+
+// analysisFields flattens anal in field order, like /analyze/schema. Absent
+// nested objects (joint, vote, season) are left out; named series come
+// last, sorted by name.
+func analysisFields(anal Analysis) []analysisField {
+	var out []analysisField
+	var walk func(v reflect.Value, name, metric, series string)
+	walk = func(v reflect.Value, name, metric, series string) {
+		t := v.Type()
+		for i := range t.NumField() {
+			f := t.Field(i)
+			tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || tag == "-" || tag == "" {
+				continue
+			}
+			fv := v.Field(i)
+			fname, fmetric := name+tag, metric+snakeCase(tag)
+			switch fv.Kind() {
+			case reflect.Pointer:
+				if !fv.IsNil() {
+					walk(fv.Elem(), fname+".", fmetric+"_", series)
+				}
+			case reflect.Map:
+				keys := make([]string, 0, fv.Len())
+				for _, k := range fv.MapKeys() {
+					keys = append(keys, k.String())
+				}
+				slices.Sort(keys)
+				for _, k := range keys {
+					walk(fv.MapIndex(reflect.ValueOf(k)), fname+"."+k+".", fmetric+"_", k)
+				}
+			case reflect.Bool:
+				out = append(out, analysisField{fname, fmetric, series, f.Tag.Get("desc"), fv.Bool()})
+			case reflect.Int, reflect.Int32, reflect.Int64:
+				out = append(out, analysisField{fname, fmetric, series, f.Tag.Get("desc"), fv.Int()})
+			case reflect.Float64:
+				out = append(out, analysisField{fname, fmetric, series, f.Tag.Get("desc"), fv.Float()})
+			case reflect.String:
+				out = append(out, analysisField{fname, fmetric, series, f.Tag.Get("desc"), fv.String()})
+			}
+		}
+	}
+	walk(reflect.ValueOf(anal), "", "", "")
+	return out
+}
+
+// snakeCase turns a JSON name into a metric name part: zScoreCpu becomes
+// z_score_cpu.
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, c := range name {
+		if c >= 'A' && c <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			c += 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// writeAnalysisCSV writes a header row of dotted field names and one row of
+// values.
+func writeAnalysisCSV(w http.ResponseWriter, anal Analysis) error {
+	fields := analysisFields(anal)
+	header := make([]string, len(fields))
+	row := make([]string, len(fields))
+	for i, f := range fields {
+		header[i] = f.name
+		switch v := f.value.(type) {
+		case bool:
+			row[i] = strconv.FormatBool(v)
+		case int64:
+			row[i] = strconv.FormatInt(v, 10)
+		case float64:
+			row[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		case string:
+			row[i] = v
+		}
+	}
+	cw := csv.NewWriter(w)
+	_ = cw.Write(header)
+	_ = cw.Write(row)
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeAnalysisPrometheus writes every numeric and boolean field as a gauge
+// labeled with the stream (and the series, for series fields), booleans as
+// 0 or 1. The string fields that are set become the labels of
+// analysis_info, which is always 1, as is usual for info metrics.
+func writeAnalysisPrometheus(w http.ResponseWriter, anal Analysis) error {
+	gauge := dto.MetricType_GAUGE
+	label := func(name, value string) *dto.LabelPair {
+		return &dto.LabelPair{Name: &name, Value: &value}
+	}
+	info := &dto.Metric{
+		Label: []*dto.LabelPair{label("stream", anal.Stream)},
+		Gauge: &dto.Gauge{Value: ptr(1.0)},
+	}
+	families := []*dto.MetricFamily{{
+		Name:   ptr(analysisMetricPrefix + "info"),
+		Help:   ptr("String fields of the analysis as labels"),
+		Type:   &gauge,
+		Metric: []*dto.Metric{info},
+	}}
+	byName := make(map[string]*dto.MetricFamily)
+
+	for _, f := range analysisFields(anal) {
+		var v float64
+		switch x := f.value.(type) {
+		case bool:
+			if x {
+				v = 1
+			}
+		case int64:
+			v = float64(x)
+		case float64:
+			v = x
+		case string:
+			if f.metric != "stream" && f.series == "" && x != "" {
+				info.Label = append(info.Label, label(f.metric, x))
+			}
+			continue
+		}
+		name := analysisMetricPrefix + f.metric
+		labels := []*dto.LabelPair{label("stream", anal.Stream)}
+		if f.series != "" {
+			labels = append(labels, label("series", f.series))
+		}
+		mf := byName[name]
+		if mf == nil {
+			mf = &dto.MetricFamily{Name: ptr(name), Help: ptr(f.desc), Type: &gauge}
+			byName[name] = mf
+			families = append(families, mf)
+		}
+		mf.Metric = append(mf.Metric, &dto.Metric{Label: labels, Gauge: &dto.Gauge{Value: &v}})
+	}
+
+	// The text format wants the labels of a metric sorted by name.
+	slices.SortFunc(info.Label, func(a, b *dto.LabelPair) int { return strings.Compare(a.GetName(), b.GetName()) })
+	for _, mf := range families {
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
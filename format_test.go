@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestAnalyzeMsgpackRoundTrip(t *testing.T) {
+	svc, _ := newTestService(t, "PERCENT_THRESHOLD", "50")
+	now := time.Now().Unix()
+	var batch []Metric
+	for i := range 20 {
+		batch = append(batch, Metric{
+			Timestamp: now - int64(20-i),
+			CPU:       40 + float64(i%3),
+			RPS:       100 + float64(i%5),
+			Values:    map[string]float64{"latency": 20 + float64(i%4)},
+		})
+	}
+	batch = append(batch, Metric{Timestamp: now, CPU: 95, RPS: 400, Values: map[string]float64{"latency": 90}})
+	if err := svc.processBatch(0, svc.redis(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := svc.newMux()
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/analyze", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("Accept %s: status %d: %s", accept, rec.Code, rec.Body)
+		}
+		return rec
+	}
+
+	rec := get("application/msgpack")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/msgpack" {
+		t.Fatalf("Content-Type = %q, want application/msgpack", ct)
+	}
+	var fromMsgpack Analysis
+	if err := msgpack.Unmarshal(rec.Body.Bytes(), &fromMsgpack); err != nil {
+		t.Fatal(err)
+	}
+	var fromJSON Analysis
+	if err := json.Unmarshal(get("application/json").Body.Bytes(), &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	if !fromJSON.IsAnomaly || fromJSON.Series["latency"].Value != 90 {
+		t.Fatalf("unexpected analysis: %+v", fromJSON)
+	}
+	if !reflect.DeepEqual(fromMsgpack, fromJSON) {
+		t.Errorf("msgpack and JSON differ:\nmsgpack %+v\njson    %+v", fromMsgpack, fromJSON)
+	}
+
+	// Encoding the decoded value again gives the same bytes.
+	again, err := msgpack.Marshal(fromMsgpack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := msgpack.Marshal(fromJSON); string(again) != string(want) {
+		t.Error("msgpack re-encoding differs from the JSON-decoded value")
+	}
+}
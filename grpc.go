@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	"go-service/ingestpb"
+)
+
+// ingestServer serves the gRPC API of ingestpb on GRPC_LISTEN_ADDR. It goes
+// through the same queue and stored analyses as the HTTP handlers.
+type ingestServer struct {
+	ingestpb.UnimplementedIngestServer
+	s *Service
+}
+
+// newGRPCServer returns the gRPC server, over TLS with the same
+// certificate and client CA as HTTP when tlsConfig is not nil.
+func (s *Service) newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.logUnary),
+		grpc.ChainStreamInterceptor(s.logStream, s.protectStream),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	srv := grpc.NewServer(opts...)
+	ingestpb.RegisterIngestServer(srv, &ingestServer{s: s})
+	return srv
+}
+
+// stopGRPC lets running calls finish for at most timeout and then closes the
+// remaining streams; an agent may keep IngestStream open indefinitely.
+func stopGRPC(srv *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		srv.Stop()
+	}
+}
+
+// IngestStream queues every request as a batch, like /ingest/batch, and
+// answers it with the result of that batch.
+func (g *ingestServer) IngestStream(stream ingestpb.Ingest_IngestStreamServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(req.GetMetrics()) > maxIngestBatch {
+			return status.Errorf(codes.InvalidArgument, "batch too large: max %d metrics", maxIngestBatch)
+		}
+		batch := make([]Metric, len(req.GetMetrics()))
+		for i, m := range req.GetMetrics() {
+			batch[i] = Metric{
+				Timestamp: m.GetTimestamp(),
+				CPU:       m.GetCpu(),
+				RPS:       m.GetRps(),
+				Stream:    m.GetStream(),
+				Values:    m.GetValues(),
+			}
+		}
+		res := g.s.queueBatch(stream.Context(), batch)
+
+		resp := &ingestpb.IngestResponse{
+			Accepted: int32(res.Accepted),
+			Rejected: int32(res.Rejected),
+			Dropped:  int32(res.Dropped),
+		}
+		for _, e := range res.Errors {
+			resp.Errors = append(resp.Errors, &ingestpb.BatchError{Index: int32(e.Index), Error: e.Error})
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Analyze returns the latest analysis of a stream, like GET /analyze. Zero
+// window_size and threshold keep the configured values.
+func (g *ingestServer) Analyze(ctx context.Context, req *ingestpb.AnalyzeRequest) (*ingestpb.Analysis, error) {
+	s := g.s
+	stream := req.GetStream()
+	if stream == "" {
+		stream = defaultStream
+	} else if err := s.validateStreamName(stream); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	t := s.tuning()
+	size, threshold := t.WindowSize, t.ZThreshold
+	if n := int(req.GetWindowSize()); n != 0 {
+		if t.Detector != detectorWindow {
+			return nil, status.Error(codes.InvalidArgument, "window_size is not supported with DETECTOR="+t.Detector)
+		}
+		if n < 2 || n > t.WindowSize {
+			return nil, status.Errorf(codes.InvalidArgument, "window_size must be between 2 and %d", t.WindowSize)
+		}
+		size = n
+	}
+	if f := req.GetThreshold(); f != 0 {
+		if !(f > 0) || math.IsInf(f, 0) {
+			return nil, status.Error(codes.InvalidArgument, "threshold must be a positive number")
+		}
+		threshold = f
+	}
+
+	anal, err := s.latestAnalysis(stream, size, threshold, req.GetSamples())
+	switch {
+	case errors.Is(err, redis.Nil):
+		return nil, status.Errorf(codes.NotFound, "no analysis for stream %s yet", stream)
+	case errors.Is(err, errCorruptAnalysis):
+		return nil, status.Error(codes.Internal, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Unavailable, "redis error: "+err.Error())
+	}
+	return analysisProto(anal), nil
+}
+
+func analysisProto(a Analysis) *ingestpb.Analysis {
+	pa := &ingestpb.Analysis{
+		Stream:           a.Stream,
+		Detector:         a.Detector,
+		Alpha:            a.Alpha,
+		Count:            int32(a.Count),
+		WindowSize:       int32(a.WindowSize),
+		RollingAvg:       a.RollingAvg,
+		StdDev:           a.StdDev,
+		ZScore:           a.ZScore,
+		IsAnomaly:        a.IsAnomaly,
+		Reason:           a.Reason,
+		Severity:         a.Severity,
+		PercentDeviation: a.PercentDev,
+		LastRps:          a.LastRPS,
+		LastCpu:          a.LastCPU,
+		LastTimestamp:    a.LastTs,
+		ThresholdZ:       a.ThresholdZ,
+		ThresholdPercent: a.ThresholdPct,
+		ComputedAt:       a.ComputedAt,
+		SmoothingWindow:  int32(a.SmoothingWindow),
+		SmoothedRps:      a.SmoothedRPS,
+		BaselineDecay:    a.BaselineDecay,
+		RollingAvgCpu:    a.RollingAvgCPU,
+		StdDevCpu:        a.StdDevCPU,
+		ZScoreCpu:        a.ZScoreCPU,
+		IsAnomalyCpu:     a.IsAnomalyCPU,
+		Samples:          a.Samples,
+	}
+	if j := a.Joint; j != nil {
+		pa.Joint = &ingestpb.JointAnomaly{
+			Detected:    j.Detected,
+			Pattern:     j.Pattern,
+			Correlation: j.Correlation,
+			ZScoreRps:   j.ZScoreRPS,
+			ZScoreCpu:   j.ZScoreCPU,
+		}
+	}
+	if v := a.Vote; v != nil {
+		pa.Vote = &ingestpb.VoteResult{Policy: v.Policy, Required: int32(v.Required), Passed: v.Passed}
+		for _, w := range v.Votes {
+			pa.Vote.Votes = append(pa.Vote.Votes, &ingestpb.WindowVote{Window: int32(w.Window), ZScore: w.ZScore, Anomaly: w.Anomaly})
+		}
+	}
+	if se := a.Season; se != nil {
+		pa.Season = &ingestpb.SeasonInfo{Period: se.Period, Bucket: int32(se.Bucket)}
+	}
+	if len(a.Series) > 0 {
+		pa.Series = make(map[string]*ingestpb.SeriesResult, len(a.Series))
+		for name, r := range a.Series {
+			pa.Series[name] = &ingestpb.SeriesResult{
+				Value:      r.Value,
+				Count:      int32(r.Count),
+				RollingAvg: r.RollingAvg,
+				StdDev:     r.StdDev,
+				ZScore:     r.ZScore,
+				IsAnomaly:  r.IsAnomaly,
+			}
+		}
+	}
+	return pa
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	readinessPingTimeout = 500 * time.Millisecond
+
+	defaultReadyQueueThreshold = 0.9
+)
+
+type readiness struct {
+	Status        string `json:"status"`
+	Redis         string `json:"redis"`
+	QueueDepth    int    `json:"queueDepth"`
+	QueueCapacity int    `json:"queueCapacity"`
+	Workers       int    `json:"workers"`
+	WorkersAlive  int    `json:"workersAlive"`
+}
+
+// serviceStatus is the /status body: the readiness checks plus what an
+// operator looks at first when the service seems stuck.
+type serviceStatus struct {
+	readiness
+	Queue          string  `json:"queue"`
+	StartedAt      int64   `json:"startedAt"`
+	UptimeSeconds  float64 `json:"uptimeSeconds"`
+	RedisLatencyMs float64 `json:"redisLatencyMs"`
+	Processed      int64   `json:"processed"`
+	DrainRate      float64 `json:"drainRate"`
+	LastAnalysisAt int64   `json:"lastAnalysisAt"`
+}
+
+// handleHealthz is the liveness probe: answering at all is the signal.
+func (s *Service) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
+// checkReadiness pings Redis with a short timeout so a hung Redis cannot
+// hang the probe, and reports the service unready while Redis is
+// unreachable, the intake channel is fuller than READY_QUEUE_THRESHOLD,
+// a worker has exited or the service is draining for shutdown. It also
+// returns the round trip of the ping.
+func (s *Service) checkReadiness(ctx context.Context) (readiness, time.Duration) {
+	res := readiness{
+		Status:        "ok",
+		Redis:         "ok",
+		QueueDepth:    len(s.metricsCh),
+		QueueCapacity: cap(s.metricsCh),
+		Workers:       int(s.workers.Load()),
+		WorkersAlive:  int(s.alive.Load()),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessPingTimeout)
+	defer cancel()
+	start := time.Now()
+	err := s.redis().Ping(ctx).Err()
+	latency := time.Since(start)
+
+	switch {
+	case err != nil:
+		res.Status = "unavailable"
+		res.Redis = err.Error()
+	case s.cfg.Queue == queueChannel && res.QueueDepth > 0 &&
+		float64(res.QueueDepth) >= s.cfg.ReadyQueueThreshold*float64(res.QueueCapacity):
+		res.Status = "saturated"
+	case res.Workers == 0:
+		res.Status = "starting"
+	case res.WorkersAlive < res.Workers:
+		res.Status = fmt.Sprintf("%d of %d workers running", res.WorkersAlive, res.Workers)
+	}
+	select {
+	case <-s.stopping:
+		res.Status = "shutting down"
+	default:
+	}
+	return res, latency
+}
+
+// handleReadyz is the readiness probe: 503 unless every check passes. The
+// metricsCh depth is included to show when the buffer is backing up.
+func (s *Service) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	res, _ := s.checkReadiness(r.Context())
+	status := http.StatusOK
+	if res.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// handleStatus reports the readiness checks with uptime, Redis latency and
+// progress counters. It always answers 200; the verdict is in status.
+func (s *Service) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	res, latency := s.checkReadiness(r.Context())
+	st := serviceStatus{
+		readiness:      res,
+		Queue:          s.cfg.Queue,
+		StartedAt:      s.started.Unix(),
+		UptimeSeconds:  time.Since(s.started).Seconds(),
+		RedisLatencyMs: float64(latency.Microseconds()) / 1000,
+		Processed:      s.processed.Load(),
+		DrainRate:      math.Round(s.drainRate()*10) / 10,
+		LastAnalysisAt: s.lastAnalysis.Load(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisHistoryKey is a sorted set of anomaly records scored by sample
+	// timestamp. It replaces the anomaly_history list of earlier versions,
+	// which is no longer written.
+	redisHistoryKey = "anomaly_events"
+
+	defaultHistoryLimit = 100
+	// defaultAnomaliesMaxLimit is the default of ANOMALIES_MAX_LIMIT, the
+	// most records one /anomalies page returns.
+	defaultAnomaliesMaxLimit = 1000
+	maxHistorySize           = 100_000
+)
+
+type anomalyRecord struct {
+	Timestamp int64    `json:"timestamp"`
+	Severity  string   `json:"severity,omitempty"`
+	Analysis  Analysis `json:"analysis"`
+}
+
+// historyRetention is how much anomaly history a stream keeps: records no
+// older than Retention (0 keeps them regardless of age) and at most the
+// newest Size (0 keeps none).
+type historyRetention struct {
+	Retention time.Duration
+	Size      int
+}
+
+// parseHistoryRetention reads ANOMALY_RETENTION_BY_STREAM, a comma-separated
+// list of stream=retention[:size] entries such as
+// "payments=720h:10000,dev=1h". An empty retention or a missing size takes
+// the value of def, the global ANOMALY_RETENTION and ANOMALY_HISTORY_SIZE.
+func parseHistoryRetention(v string, pattern *regexp.Regexp, def historyRetention) (map[string]historyRetention, error) {
+	if v == "" {
+		return nil, nil
+	}
+	m := make(map[string]historyRetention)
+	for _, part := range strings.Split(v, ",") {
+		name, spec, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" || spec == "" {
+			return nil, fmt.Errorf("ANOMALY_RETENTION_BY_STREAM entry %q: want stream=retention[:size]", part)
+		}
+		if err := validateName(pattern, name, errInvalidStream); err != nil {
+			return nil, fmt.Errorf("ANOMALY_RETENTION_BY_STREAM entry %q: %w", part, err)
+		}
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("ANOMALY_RETENTION_BY_STREAM: %s is listed twice", name)
+		}
+		pol := def
+		retention, size, hasSize := strings.Cut(spec, ":")
+		if retention != "" {
+			d, err := time.ParseDuration(retention)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("ANOMALY_RETENTION_BY_STREAM entry %q: retention must be a non-negative duration", part)
+			}
+			pol.Retention = d
+		}
+		if hasSize {
+			n, err := strconv.Atoi(size)
+			if err != nil || n < 0 || n > maxHistorySize {
+				return nil, fmt.Errorf("ANOMALY_RETENTION_BY_STREAM entry %q: size must be between 0 and %d", part, maxHistorySize)
+			}
+			pol.Size = n
+		}
+		m[name] = pol
+	}
+	return m, nil
+}
+
+// historyRetention returns the retention of stream's anomaly history and
+// whether it comes from ANOMALY_RETENTION_BY_STREAM.
+func (s *Service) historyRetention(stream string) (historyRetention, bool) {
+	if pol, ok := s.cfg.AnomalyRetentionByStream[stream]; ok {
+		return pol, true
+	}
+	return historyRetention{Retention: s.cfg.AnomalyRetention, Size: s.cfg.AnomalyHistorySize}, false
+}
+
+// anomalyEntries encodes the anomalous analyses of a batch of stream for
+// the history. Backfill samples are left out, as they are for
+// anomalies_total.
+func (s *Service) anomalyEntries(stream string, batch []Metric, anals []Analysis) []redis.Z {
+	if pol, _ := s.historyRetention(stream); pol.Size == 0 {
+		return nil
+	}
+	var entries []redis.Z
+	for i, a := range anals {
+		if !a.IsAnomaly || batch[i].backfill {
+			continue
+		}
+		b, _ := json.Marshal(anomalyRecord{Timestamp: batch[i].Timestamp, Severity: a.Severity, Analysis: a})
+		entries = append(entries, redis.Z{Score: float64(batch[i].Timestamp), Member: b})
+	}
+	return entries
+}
+
+// appendHistory queues entries onto the stream's history and drops records
+// beyond the stream's retention. With a retention the whole set also
+// expires that long after its last write, so the history of a stream that
+// stopped alerting does not stay behind.
+func (s *Service) appendHistory(ctx context.Context, p redis.Pipeliner, stream string, entries []redis.Z) {
+	if len(entries) == 0 {
+		return
+	}
+	pol, _ := s.historyRetention(stream)
+	key := s.streamKey(redisHistoryKey, stream)
+	p.ZAdd(ctx, key, entries...)
+	if pol.Retention > 0 {
+		cutoff := time.Now().Add(-pol.Retention).Unix()
+		p.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(cutoff, 10))
+		p.Expire(ctx, key, pol.Retention)
+	}
+	p.ZRemRangeByRank(ctx, key, 0, -int64(pol.Size)-1)
+}
+
+// handleAnomalies returns the recorded anomalies of ?stream= with a sample
+// timestamp in [from, to], newest first, a page of at most limit records
+// (no more than ANOMALIES_MAX_LIMIT) at a time. since is accepted as an
+// alias of from. When there are older records, the X-Next-Cursor header
+// and a Link rel="next" carry the cursor of the next page; see
+// parseAnomalyCursor. The array is written record by record rather than
+// built in memory.
+func (s *Service) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+
+	limit := min(defaultHistoryLimit, s.cfg.AnomaliesMaxLimit)
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, s.cfg.AnomaliesMaxLimit)
+	}
+
+	bound := func(names ...string) (string, error) {
+		for _, name := range names {
+			v := q.Get(name)
+			if v == "" {
+				continue
+			}
+			if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+				return "", fmt.Errorf("bad %s: must be a unix timestamp", name)
+			}
+			return v, nil
+		}
+		return "", nil
+	}
+	from, err := bound("from", "since")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := bound("to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from == "" {
+		from = "-inf"
+	}
+	if to == "" {
+		to = "+inf"
+	}
+	var cur anomalyCursor
+	if v := q.Get("cursor"); v != "" {
+		if cur, err = parseAnomalyCursor(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The cursor picks up where the previous page of the same query
+		// ended; one past to has nothing left to skip.
+		if bound, _ := strconv.ParseInt(to, 10, 64); to != "+inf" && bound < cur.ts {
+			cur.skip = 0
+		} else {
+			to = strconv.FormatInt(cur.ts, 10)
+		}
+	}
+
+	stream, err := s.streamParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// One record more than the page tells whether there is a next one.
+	raw, err := s.redis().ZRevRangeByScoreWithScores(s.ctx, s.streamKey(redisHistoryKey, stream), &redis.ZRangeBy{
+		Min:    from,
+		Max:    to,
+		Offset: int64(cur.skip),
+		Count:  int64(limit) + 1,
+	}).Result()
+	if err != nil {
+		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if len(raw) > limit {
+		raw = raw[:limit]
+		next := nextAnomalyCursor(cur, raw)
+		w.Header().Set("X-Next-Cursor", next.String())
+		nq := r.URL.Query()
+		nq.Set("cursor", next.String())
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, nq.Encode()))
+	}
+
+	samples := wantSamples(r)
+	w.Header().Set("Content-Type", "application/json")
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('[')
+	first := true
+	for _, z := range raw {
+		v, _ := z.Member.(string)
+		var rec anomalyRecord
+		if json.Unmarshal([]byte(v), &rec) != nil {
+			continue
+		}
+		if !samples {
+			rec.Analysis.Samples = nil
+		}
+		b, _ := json.Marshal(rec)
+		if !first {
+			bw.WriteByte(',')
+		}
+		first = false
+		bw.Write(b)
+	}
+	bw.WriteString("]\n")
+	_ = bw.Flush()
+}
+
+// anomalyCursor is where the next /anomalies page starts: at records with
+// timestamp ts or older, skipping the skip records with timestamp exactly
+// ts that earlier pages returned. Records sharing a timestamp are thus
+// neither repeated nor lost across pages.
+type anomalyCursor struct {
+	ts   int64
+	skip int
+}
+
+// String encodes the cursor as "<ts>:<skip>". Clients pass it back as is.
+func (c anomalyCursor) String() string {
+	return strconv.FormatInt(c.ts, 10) + ":" + strconv.Itoa(c.skip)
+}
+
+func parseAnomalyCursor(v string) (anomalyCursor, error) {
+	ts, skip, ok := strings.Cut(v, ":")
+	var c anomalyCursor
+	var err1, err2 error
+	c.ts, err1 = strconv.ParseInt(ts, 10, 64)
+	c.skip, err2 = strconv.Atoi(skip)
+	if !ok || err1 != nil || err2 != nil || c.skip < 0 {
+		return anomalyCursor{}, fmt.Errorf("bad cursor %q: pass the X-Next-Cursor of the previous page", v)
+	}
+	return c, nil
+}
+
+// nextAnomalyCursor returns the cursor after page, which was read from
+// cur: the timestamp of its last record and how many records with that
+// timestamp have been returned so far.
+func nextAnomalyCursor(cur anomalyCursor, page []redis.Z) anomalyCursor {
+	last := int64(page[len(page)-1].Score)
+	next := anomalyCursor{ts: last}
+	for i := len(page) - 1; i >= 0 && int64(page[i].Score) == last; i-- {
+		next.skip++
+	}
+	if next.skip == len(page) && cur.ts == last && cur.skip > 0 {
+		next.skip += cur.skip
+	}
+	return next
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryRetention(t *testing.T) {
+	pattern := regexp.MustCompile(`^(?:` + defaultStreamNamePattern + `)$`)
+	def := historyRetention{Retention: time.Hour, Size: 100}
+	tests := []struct {
+		in      string
+		want    map[string]historyRetention
+		wantErr string
+	}{
+		{in: "", want: nil},
+		{in: "payments=720h:10000, dev=1m", want: map[string]historyRetention{
+			"payments": {Retention: 720 * time.Hour, Size: 10000},
+			"dev":      {Retention: time.Minute, Size: 100},
+		}},
+		{in: "a=:5", want: map[string]historyRetention{"a": {Retention: time.Hour, Size: 5}}},
+		{in: "a=0:0", want: map[string]historyRetention{"a": {}}},
+		{in: "a", wantErr: "want stream=retention[:size]"},
+		{in: "a=", wantErr: "want stream=retention[:size]"},
+		{in: "a b=1h", wantErr: "invalid stream name"},
+		{in: "a=1h,a=2h", wantErr: "listed twice"},
+		{in: "a=soon", wantErr: "non-negative duration"},
+		{in: "a=-1h", wantErr: "non-negative duration"},
+		{in: "a=1h:lots", wantErr: "size must be between 0 and"},
+		{in: "a=1h:100001", wantErr: "size must be between 0 and"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseHistoryRetention(tt.in, pattern, def)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestHistoryRetentionApplied checks that the workers trim and expire each
+// stream's anomaly history by its own retention.
+func TestHistoryRetentionApplied(t *testing.T) {
+	svc, mr := newTestService(t, "ANOMALY_HISTORY_SIZE", "5", "ANOMALY_RETENTION", "1h",
+		"ANOMALY_RETENTION_BY_STREAM", "vip=720h:10,dev=:2,quiet=1h:0")
+	now := time.Now().Unix()
+	for _, stream := range []string{"vip", "dev", "other", "quiet"} {
+		mr.ZAdd(svc.streamKey(redisHistoryKey, stream), float64(now-2*3600), "old")
+		for i := range 20 {
+			appendAnomaly(t, svc, stream, now+int64(i))
+		}
+	}
+
+	for stream, want := range map[string]struct {
+		n   int
+		ttl time.Duration
+	}{
+		"vip":   {n: 10, ttl: 720 * time.Hour},
+		"dev":   {n: 2, ttl: time.Hour},
+		"other": {n: 5, ttl: time.Hour},
+		"quiet": {n: 1},
+	} {
+		key := svc.streamKey(redisHistoryKey, stream)
+		members, _ := mr.ZMembers(key)
+		if len(members) != want.n {
+			t.Errorf("%s: %d records, want %d", stream, len(members), want.n)
+		}
+		if ttl := mr.TTL(key); ttl != want.ttl {
+			t.Errorf("%s: TTL %s, want %s", stream, ttl, want.ttl)
+		}
+	}
+}
+
+// appendAnomaly writes one anomaly of stream to the history the way
+// processStreamBatch does.
+func appendAnomaly(t *testing.T, s *Service, stream string, ts int64) {
+	t.Helper()
+	batch := []Metric{{Timestamp: ts, Stream: stream}}
+	entries := s.anomalyEntries(stream, batch, []Analysis{{Stream: stream, IsAnomaly: true}})
+	ctx := context.Background()
+	p := s.redis().Pipeline()
+	s.appendHistory(ctx, p, stream, entries)
+	if _, err := p.Exec(ctx); err != nil && len(entries) > 0 {
+		t.Fatal(err)
+	}
+}
+
+func TestAnomaliesPagination(t *testing.T) {
+	svc, mr := newTestService(t, "ANOMALIES_MAX_LIMIT", "4")
+	key := svc.streamKey(redisHistoryKey, defaultStream)
+	// Newest first: three records share timestamp 9 and two share 7.
+	timestamps := []int64{10, 9, 9, 9, 8, 7, 7, 5}
+	for i, ts := range timestamps {
+		b, _ := json.Marshal(anomalyRecord{Timestamp: ts, Analysis: Analysis{LastRPS: float64(i)}})
+		mr.ZAdd(key, float64(ts), string(b))
+	}
+	get := func(query string) (*httptest.ResponseRecorder, []anomalyRecord) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		svc.handleAnomalies(rec, httptest.NewRequest(http.MethodGet, "/anomalies?"+query, nil))
+		var page []anomalyRecord
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatalf("%s: %v: %s", query, err, rec.Body)
+			}
+		}
+		return rec, page
+	}
+
+	for _, tt := range []struct {
+		name  string
+		query string
+		want  []int64
+	}{
+		{name: "limit above ANOMALIES_MAX_LIMIT", query: "limit=100", want: timestamps[:4]},
+		{name: "pages of two", query: "limit=2", want: timestamps},
+		{name: "pages of three", query: "limit=3", want: timestamps},
+		{name: "pages of one within from and to", query: "limit=1&from=7&to=9", want: timestamps[1:7]},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int64
+			seen := make(map[float64]bool)
+			query := tt.query
+			for pages := 0; ; pages++ {
+				if pages > len(timestamps) {
+					t.Fatal("pagination does not end")
+				}
+				rec, page := get(query)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status %d: %s", query, rec.Code, rec.Body)
+				}
+				for _, r := range page {
+					if seen[r.Analysis.LastRPS] {
+						t.Fatalf("record %v returned twice", r.Analysis.LastRPS)
+					}
+					seen[r.Analysis.LastRPS] = true
+					got = append(got, r.Timestamp)
+				}
+				next := rec.Header().Get("X-Next-Cursor")
+				if next == "" || strings.HasPrefix(tt.name, "limit above") {
+					break
+				}
+				if link := rec.Header().Get("Link"); !strings.Contains(link, `rel="next"`) {
+					t.Errorf("Link %q", link)
+				}
+				query = tt.query + "&cursor=" + next
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("timestamps %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, cursor := range []string{"x", "9", "9:-1", "9:x"} {
+		if rec, _ := get("cursor=" + cursor); rec.Code != http.StatusBadRequest {
+			t.Errorf("cursor %q: status %d, want 400", cursor, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,1136 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: ingest.proto
+
+package ingestpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Metric struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Unix seconds; 0 means the time the metric is received.
+	Timestamp int64   `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Cpu       float64 `protobuf:"fixed64,2,opt,name=cpu,proto3" json:"cpu,omitempty"`
+	Rps       float64 `protobuf:"fixed64,3,opt,name=rps,proto3" json:"rps,omitempty"`
+	// Empty means the default stream.
+	Stream string `protobuf:"bytes,4,opt,name=stream,proto3" json:"stream,omitempty"`
+	// Extra named series, each scored against its own window.
+	Values        map[string]float64 `protobuf:"bytes,5,rep,name=values,proto3" json:"values,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"fixed64,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Metric) Reset() {
+	*x = Metric{}
+	mi := &file_ingest_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Metric) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Metric) ProtoMessage() {}
+
+func (x *Metric) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Metric.ProtoReflect.Descriptor instead.
+func (*Metric) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Metric) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *Metric) GetCpu() float64 {
+	if x != nil {
+		return x.Cpu
+	}
+	return 0
+}
+
+func (x *Metric) GetRps() float64 {
+	if x != nil {
+		return x.Rps
+	}
+	return 0
+}
+
+func (x *Metric) GetStream() string {
+	if x != nil {
+		return x.Stream
+	}
+	return ""
+}
+
+func (x *Metric) GetValues() map[string]float64 {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+type IngestRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// At most 10000 metrics.
+	Metrics       []*Metric `protobuf:"bytes,1,rep,name=metrics,proto3" json:"metrics,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IngestRequest) Reset() {
+	*x = IngestRequest{}
+	mi := &file_ingest_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IngestRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IngestRequest) ProtoMessage() {}
+
+func (x *IngestRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IngestRequest.ProtoReflect.Descriptor instead.
+func (*IngestRequest) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *IngestRequest) GetMetrics() []*Metric {
+	if x != nil {
+		return x.Metrics
+	}
+	return nil
+}
+
+type IngestResponse struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Accepted int32                  `protobuf:"varint,1,opt,name=accepted,proto3" json:"accepted,omitempty"`
+	Rejected int32                  `protobuf:"varint,2,opt,name=rejected,proto3" json:"rejected,omitempty"`
+	// Metrics not queued because the queue was full or the service is stopping.
+	Dropped int32 `protobuf:"varint,3,opt,name=dropped,proto3" json:"dropped,omitempty"`
+	// Errors of the rejected metrics by index, at most 100.
+	Errors        []*BatchError `protobuf:"bytes,4,rep,name=errors,proto3" json:"errors,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *IngestResponse) Reset() {
+	*x = IngestResponse{}
+	mi := &file_ingest_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *IngestResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IngestResponse) ProtoMessage() {}
+
+func (x *IngestResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IngestResponse.ProtoReflect.Descriptor instead.
+func (*IngestResponse) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *IngestResponse) GetAccepted() int32 {
+	if x != nil {
+		return x.Accepted
+	}
+	return 0
+}
+
+func (x *IngestResponse) GetRejected() int32 {
+	if x != nil {
+		return x.Rejected
+	}
+	return 0
+}
+
+func (x *IngestResponse) GetDropped() int32 {
+	if x != nil {
+		return x.Dropped
+	}
+	return 0
+}
+
+func (x *IngestResponse) GetErrors() []*BatchError {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+type BatchError struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Index         int32                  `protobuf:"varint,1,opt,name=index,proto3" json:"index,omitempty"`
+	Error         string                 `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BatchError) Reset() {
+	*x = BatchError{}
+	mi := &file_ingest_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BatchError) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchError) ProtoMessage() {}
+
+func (x *BatchError) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchError.ProtoReflect.Descriptor instead.
+func (*BatchError) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *BatchError) GetIndex() int32 {
+	if x != nil {
+		return x.Index
+	}
+	return 0
+}
+
+func (x *BatchError) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type AnalyzeRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Empty means the default stream.
+	Stream string `protobuf:"bytes,1,opt,name=stream,proto3" json:"stream,omitempty"`
+	// Re-score against the newest window_size samples; 0 means WINDOW_SIZE.
+	WindowSize int32 `protobuf:"varint,2,opt,name=window_size,json=windowSize,proto3" json:"window_size,omitempty"`
+	// Z-score threshold; 0 means Z_THRESHOLD.
+	Threshold float64 `protobuf:"fixed64,3,opt,name=threshold,proto3" json:"threshold,omitempty"`
+	// Include the window values of an anomalous analysis.
+	Samples       bool `protobuf:"varint,4,opt,name=samples,proto3" json:"samples,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AnalyzeRequest) Reset() {
+	*x = AnalyzeRequest{}
+	mi := &file_ingest_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AnalyzeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AnalyzeRequest) ProtoMessage() {}
+
+func (x *AnalyzeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AnalyzeRequest.ProtoReflect.Descriptor instead.
+func (*AnalyzeRequest) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *AnalyzeRequest) GetStream() string {
+	if x != nil {
+		return x.Stream
+	}
+	return ""
+}
+
+func (x *AnalyzeRequest) GetWindowSize() int32 {
+	if x != nil {
+		return x.WindowSize
+	}
+	return 0
+}
+
+func (x *AnalyzeRequest) GetThreshold() float64 {
+	if x != nil {
+		return x.Threshold
+	}
+	return 0
+}
+
+func (x *AnalyzeRequest) GetSamples() bool {
+	if x != nil {
+		return x.Samples
+	}
+	return false
+}
+
+// Analysis mirrors the JSON body of GET /analyze; see GET /analyze/schema
+// for the meaning of each field.
+type Analysis struct {
+	state            protoimpl.MessageState   `protogen:"open.v1"`
+	Stream           string                   `protobuf:"bytes,1,opt,name=stream,proto3" json:"stream,omitempty"`
+	Detector         string                   `protobuf:"bytes,2,opt,name=detector,proto3" json:"detector,omitempty"`
+	Alpha            float64                  `protobuf:"fixed64,3,opt,name=alpha,proto3" json:"alpha,omitempty"`
+	Count            int32                    `protobuf:"varint,4,opt,name=count,proto3" json:"count,omitempty"`
+	WindowSize       int32                    `protobuf:"varint,5,opt,name=window_size,json=windowSize,proto3" json:"window_size,omitempty"`
+	RollingAvg       float64                  `protobuf:"fixed64,6,opt,name=rolling_avg,json=rollingAvg,proto3" json:"rolling_avg,omitempty"`
+	StdDev           float64                  `protobuf:"fixed64,7,opt,name=std_dev,json=stdDev,proto3" json:"std_dev,omitempty"`
+	ZScore           float64                  `protobuf:"fixed64,8,opt,name=z_score,json=zScore,proto3" json:"z_score,omitempty"`
+	IsAnomaly        bool                     `protobuf:"varint,9,opt,name=is_anomaly,json=isAnomaly,proto3" json:"is_anomaly,omitempty"`
+	Reason           string                   `protobuf:"bytes,10,opt,name=reason,proto3" json:"reason,omitempty"`
+	Severity         string                   `protobuf:"bytes,30,opt,name=severity,proto3" json:"severity,omitempty"`
+	PercentDeviation float64                  `protobuf:"fixed64,11,opt,name=percent_deviation,json=percentDeviation,proto3" json:"percent_deviation,omitempty"`
+	LastRps          float64                  `protobuf:"fixed64,12,opt,name=last_rps,json=lastRps,proto3" json:"last_rps,omitempty"`
+	LastCpu          float64                  `protobuf:"fixed64,13,opt,name=last_cpu,json=lastCpu,proto3" json:"last_cpu,omitempty"`
+	LastTimestamp    int64                    `protobuf:"varint,14,opt,name=last_timestamp,json=lastTimestamp,proto3" json:"last_timestamp,omitempty"`
+	ThresholdZ       float64                  `protobuf:"fixed64,15,opt,name=threshold_z,json=thresholdZ,proto3" json:"threshold_z,omitempty"`
+	ThresholdPercent float64                  `protobuf:"fixed64,16,opt,name=threshold_percent,json=thresholdPercent,proto3" json:"threshold_percent,omitempty"`
+	ComputedAt       int64                    `protobuf:"varint,17,opt,name=computed_at,json=computedAt,proto3" json:"computed_at,omitempty"`
+	SmoothingWindow  int32                    `protobuf:"varint,18,opt,name=smoothing_window,json=smoothingWindow,proto3" json:"smoothing_window,omitempty"`
+	SmoothedRps      float64                  `protobuf:"fixed64,19,opt,name=smoothed_rps,json=smoothedRps,proto3" json:"smoothed_rps,omitempty"`
+	BaselineDecay    float64                  `protobuf:"fixed64,20,opt,name=baseline_decay,json=baselineDecay,proto3" json:"baseline_decay,omitempty"`
+	RollingAvgCpu    float64                  `protobuf:"fixed64,21,opt,name=rolling_avg_cpu,json=rollingAvgCpu,proto3" json:"rolling_avg_cpu,omitempty"`
+	StdDevCpu        float64                  `protobuf:"fixed64,22,opt,name=std_dev_cpu,json=stdDevCpu,proto3" json:"std_dev_cpu,omitempty"`
+	ZScoreCpu        float64                  `protobuf:"fixed64,23,opt,name=z_score_cpu,json=zScoreCpu,proto3" json:"z_score_cpu,omitempty"`
+	IsAnomalyCpu     bool                     `protobuf:"varint,24,opt,name=is_anomaly_cpu,json=isAnomalyCpu,proto3" json:"is_anomaly_cpu,omitempty"`
+	Joint            *JointAnomaly            `protobuf:"bytes,25,opt,name=joint,proto3" json:"joint,omitempty"`
+	Vote             *VoteResult              `protobuf:"bytes,26,opt,name=vote,proto3" json:"vote,omitempty"`
+	Season           *SeasonInfo              `protobuf:"bytes,27,opt,name=season,proto3" json:"season,omitempty"`
+	Series           map[string]*SeriesResult `protobuf:"bytes,28,rep,name=series,proto3" json:"series,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Samples          []float64                `protobuf:"fixed64,29,rep,packed,name=samples,proto3" json:"samples,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *Analysis) Reset() {
+	*x = Analysis{}
+	mi := &file_ingest_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Analysis) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Analysis) ProtoMessage() {}
+
+func (x *Analysis) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Analysis.ProtoReflect.Descriptor instead.
+func (*Analysis) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *Analysis) GetStream() string {
+	if x != nil {
+		return x.Stream
+	}
+	return ""
+}
+
+func (x *Analysis) GetDetector() string {
+	if x != nil {
+		return x.Detector
+	}
+	return ""
+}
+
+func (x *Analysis) GetAlpha() float64 {
+	if x != nil {
+		return x.Alpha
+	}
+	return 0
+}
+
+func (x *Analysis) GetCount() int32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *Analysis) GetWindowSize() int32 {
+	if x != nil {
+		return x.WindowSize
+	}
+	return 0
+}
+
+func (x *Analysis) GetRollingAvg() float64 {
+	if x != nil {
+		return x.RollingAvg
+	}
+	return 0
+}
+
+func (x *Analysis) GetStdDev() float64 {
+	if x != nil {
+		return x.StdDev
+	}
+	return 0
+}
+
+func (x *Analysis) GetZScore() float64 {
+	if x != nil {
+		return x.ZScore
+	}
+	return 0
+}
+
+func (x *Analysis) GetIsAnomaly() bool {
+	if x != nil {
+		return x.IsAnomaly
+	}
+	return false
+}
+
+func (x *Analysis) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *Analysis) GetSeverity() string {
+	if x != nil {
+		return x.Severity
+	}
+	return ""
+}
+
+func (x *Analysis) GetPercentDeviation() float64 {
+	if x != nil {
+		return x.PercentDeviation
+	}
+	return 0
+}
+
+func (x *Analysis) GetLastRps() float64 {
+	if x != nil {
+		return x.LastRps
+	}
+	return 0
+}
+
+func (x *Analysis) GetLastCpu() float64 {
+	if x != nil {
+		return x.LastCpu
+	}
+	return 0
+}
+
+func (x *Analysis) GetLastTimestamp() int64 {
+	if x != nil {
+		return x.LastTimestamp
+	}
+	return 0
+}
+
+func (x *Analysis) GetThresholdZ() float64 {
+	if x != nil {
+		return x.ThresholdZ
+	}
+	return 0
+}
+
+func (x *Analysis) GetThresholdPercent() float64 {
+	if x != nil {
+		return x.ThresholdPercent
+	}
+	return 0
+}
+
+func (x *Analysis) GetComputedAt() int64 {
+	if x != nil {
+		return x.ComputedAt
+	}
+	return 0
+}
+
+func (x *Analysis) GetSmoothingWindow() int32 {
+	if x != nil {
+		return x.SmoothingWindow
+	}
+	return 0
+}
+
+func (x *Analysis) GetSmoothedRps() float64 {
+	if x != nil {
+		return x.SmoothedRps
+	}
+	return 0
+}
+
+func (x *Analysis) GetBaselineDecay() float64 {
+	if x != nil {
+		return x.BaselineDecay
+	}
+	return 0
+}
+
+func (x *Analysis) GetRollingAvgCpu() float64 {
+	if x != nil {
+		return x.RollingAvgCpu
+	}
+	return 0
+}
+
+func (x *Analysis) GetStdDevCpu() float64 {
+	if x != nil {
+		return x.StdDevCpu
+	}
+	return 0
+}
+
+func (x *Analysis) GetZScoreCpu() float64 {
+	if x != nil {
+		return x.ZScoreCpu
+	}
+	return 0
+}
+
+func (x *Analysis) GetIsAnomalyCpu() bool {
+	if x != nil {
+		return x.IsAnomalyCpu
+	}
+	return false
+}
+
+func (x *Analysis) GetJoint() *JointAnomaly {
+	if x != nil {
+		return x.Joint
+	}
+	return nil
+}
+
+func (x *Analysis) GetVote() *VoteResult {
+	if x != nil {
+		return x.Vote
+	}
+	return nil
+}
+
+func (x *Analysis) GetSeason() *SeasonInfo {
+	if x != nil {
+		return x.Season
+	}
+	return nil
+}
+
+func (x *Analysis) GetSeries() map[string]*SeriesResult {
+	if x != nil {
+		return x.Series
+	}
+	return nil
+}
+
+func (x *Analysis) GetSamples() []float64 {
+	if x != nil {
+		return x.Samples
+	}
+	return nil
+}
+
+type JointAnomaly struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Detected      bool                   `protobuf:"varint,1,opt,name=detected,proto3" json:"detected,omitempty"`
+	Pattern       string                 `protobuf:"bytes,2,opt,name=pattern,proto3" json:"pattern,omitempty"`
+	Correlation   float64                `protobuf:"fixed64,3,opt,name=correlation,proto3" json:"correlation,omitempty"`
+	ZScoreRps     float64                `protobuf:"fixed64,4,opt,name=z_score_rps,json=zScoreRps,proto3" json:"z_score_rps,omitempty"`
+	ZScoreCpu     float64                `protobuf:"fixed64,5,opt,name=z_score_cpu,json=zScoreCpu,proto3" json:"z_score_cpu,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *JointAnomaly) Reset() {
+	*x = JointAnomaly{}
+	mi := &file_ingest_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *JointAnomaly) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*JointAnomaly) ProtoMessage() {}
+
+func (x *JointAnomaly) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use JointAnomaly.ProtoReflect.Descriptor instead.
+func (*JointAnomaly) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *JointAnomaly) GetDetected() bool {
+	if x != nil {
+		return x.Detected
+	}
+	return false
+}
+
+func (x *JointAnomaly) GetPattern() string {
+	if x != nil {
+		return x.Pattern
+	}
+	return ""
+}
+
+func (x *JointAnomaly) GetCorrelation() float64 {
+	if x != nil {
+		return x.Correlation
+	}
+	return 0
+}
+
+func (x *JointAnomaly) GetZScoreRps() float64 {
+	if x != nil {
+		return x.ZScoreRps
+	}
+	return 0
+}
+
+func (x *JointAnomaly) GetZScoreCpu() float64 {
+	if x != nil {
+		return x.ZScoreCpu
+	}
+	return 0
+}
+
+type VoteResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Policy        string                 `protobuf:"bytes,1,opt,name=policy,proto3" json:"policy,omitempty"`
+	Required      int32                  `protobuf:"varint,2,opt,name=required,proto3" json:"required,omitempty"`
+	Votes         []*WindowVote          `protobuf:"bytes,3,rep,name=votes,proto3" json:"votes,omitempty"`
+	Passed        bool                   `protobuf:"varint,4,opt,name=passed,proto3" json:"passed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VoteResult) Reset() {
+	*x = VoteResult{}
+	mi := &file_ingest_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VoteResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VoteResult) ProtoMessage() {}
+
+func (x *VoteResult) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VoteResult.ProtoReflect.Descriptor instead.
+func (*VoteResult) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *VoteResult) GetPolicy() string {
+	if x != nil {
+		return x.Policy
+	}
+	return ""
+}
+
+func (x *VoteResult) GetRequired() int32 {
+	if x != nil {
+		return x.Required
+	}
+	return 0
+}
+
+func (x *VoteResult) GetVotes() []*WindowVote {
+	if x != nil {
+		return x.Votes
+	}
+	return nil
+}
+
+func (x *VoteResult) GetPassed() bool {
+	if x != nil {
+		return x.Passed
+	}
+	return false
+}
+
+type WindowVote struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Window        int32                  `protobuf:"varint,1,opt,name=window,proto3" json:"window,omitempty"`
+	ZScore        float64                `protobuf:"fixed64,2,opt,name=z_score,json=zScore,proto3" json:"z_score,omitempty"`
+	Anomaly       bool                   `protobuf:"varint,3,opt,name=anomaly,proto3" json:"anomaly,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WindowVote) Reset() {
+	*x = WindowVote{}
+	mi := &file_ingest_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WindowVote) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WindowVote) ProtoMessage() {}
+
+func (x *WindowVote) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WindowVote.ProtoReflect.Descriptor instead.
+func (*WindowVote) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *WindowVote) GetWindow() int32 {
+	if x != nil {
+		return x.Window
+	}
+	return 0
+}
+
+func (x *WindowVote) GetZScore() float64 {
+	if x != nil {
+		return x.ZScore
+	}
+	return 0
+}
+
+func (x *WindowVote) GetAnomaly() bool {
+	if x != nil {
+		return x.Anomaly
+	}
+	return false
+}
+
+type SeasonInfo struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Period        string                 `protobuf:"bytes,1,opt,name=period,proto3" json:"period,omitempty"`
+	Bucket        int32                  `protobuf:"varint,2,opt,name=bucket,proto3" json:"bucket,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SeasonInfo) Reset() {
+	*x = SeasonInfo{}
+	mi := &file_ingest_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SeasonInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SeasonInfo) ProtoMessage() {}
+
+func (x *SeasonInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SeasonInfo.ProtoReflect.Descriptor instead.
+func (*SeasonInfo) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *SeasonInfo) GetPeriod() string {
+	if x != nil {
+		return x.Period
+	}
+	return ""
+}
+
+func (x *SeasonInfo) GetBucket() int32 {
+	if x != nil {
+		return x.Bucket
+	}
+	return 0
+}
+
+type SeriesResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Value         float64                `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+	Count         int32                  `protobuf:"varint,2,opt,name=count,proto3" json:"count,omitempty"`
+	RollingAvg    float64                `protobuf:"fixed64,3,opt,name=rolling_avg,json=rollingAvg,proto3" json:"rolling_avg,omitempty"`
+	StdDev        float64                `protobuf:"fixed64,4,opt,name=std_dev,json=stdDev,proto3" json:"std_dev,omitempty"`
+	ZScore        float64                `protobuf:"fixed64,5,opt,name=z_score,json=zScore,proto3" json:"z_score,omitempty"`
+	IsAnomaly     bool                   `protobuf:"varint,6,opt,name=is_anomaly,json=isAnomaly,proto3" json:"is_anomaly,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SeriesResult) Reset() {
+	*x = SeriesResult{}
+	mi := &file_ingest_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SeriesResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SeriesResult) ProtoMessage() {}
+
+func (x *SeriesResult) ProtoReflect() protoreflect.Message {
+	mi := &file_ingest_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SeriesResult.ProtoReflect.Descriptor instead.
+func (*SeriesResult) Descriptor() ([]byte, []int) {
+	return file_ingest_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *SeriesResult) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+func (x *SeriesResult) GetCount() int32 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *SeriesResult) GetRollingAvg() float64 {
+	if x != nil {
+		return x.RollingAvg
+	}
+	return 0
+}
+
+func (x *SeriesResult) GetStdDev() float64 {
+	if x != nil {
+		return x.StdDev
+	}
+	return 0
+}
+
+func (x *SeriesResult) GetZScore() float64 {
+	if x != nil {
+		return x.ZScore
+	}
+	return 0
+}
+
+func (x *SeriesResult) GetIsAnomaly() bool {
+	if x != nil {
+		return x.IsAnomaly
+	}
+	return false
+}
+
+var File_ingest_proto protoreflect.FileDescriptor
+
+const file_ingest_proto_rawDesc = "" +
+	"\n" +
+	"\fingest.proto\x12\vhighload.v1\"\xd6\x01\n" +
+	"\x06Metric\x12\x1c\n" +
+	"\ttimestamp\x18\x01 \x01(\x03R\ttimestamp\x12\x10\n" +
+	"\x03cpu\x18\x02 \x01(\x01R\x03cpu\x12\x10\n" +
+	"\x03rps\x18\x03 \x01(\x01R\x03rps\x12\x16\n" +
+	"\x06stream\x18\x04 \x01(\tR\x06stream\x127\n" +
+	"\x06values\x18\x05 \x03(\v2\x1f.highload.v1.Metric.ValuesEntryR\x06values\x1a9\n" +
+	"\vValuesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x01R\x05value:\x028\x01\">\n" +
+	"\rIngestRequest\x12-\n" +
+	"\ametrics\x18\x01 \x03(\v2\x13.highload.v1.MetricR\ametrics\"\x93\x01\n" +
+	"\x0eIngestResponse\x12\x1a\n" +
+	"\baccepted\x18\x01 \x01(\x05R\baccepted\x12\x1a\n" +
+	"\brejected\x18\x02 \x01(\x05R\brejected\x12\x18\n" +
+	"\adropped\x18\x03 \x01(\x05R\adropped\x12/\n" +
+	"\x06errors\x18\x04 \x03(\v2\x17.highload.v1.BatchErrorR\x06errors\"8\n" +
+	"\n" +
+	"BatchError\x12\x14\n" +
+	"\x05index\x18\x01 \x01(\x05R\x05index\x12\x14\n" +
+	"\x05error\x18\x02 \x01(\tR\x05error\"\x81\x01\n" +
+	"\x0eAnalyzeRequest\x12\x16\n" +
+	"\x06stream\x18\x01 \x01(\tR\x06stream\x12\x1f\n" +
+	"\vwindow_size\x18\x02 \x01(\x05R\n" +
+	"windowSize\x12\x1c\n" +
+	"\tthreshold\x18\x03 \x01(\x01R\tthreshold\x12\x18\n" +
+	"\asamples\x18\x04 \x01(\bR\asamples\"\xe7\b\n" +
+	"\bAnalysis\x12\x16\n" +
+	"\x06stream\x18\x01 \x01(\tR\x06stream\x12\x1a\n" +
+	"\bdetector\x18\x02 \x01(\tR\bdetector\x12\x14\n" +
+	"\x05alpha\x18\x03 \x01(\x01R\x05alpha\x12\x14\n" +
+	"\x05count\x18\x04 \x01(\x05R\x05count\x12\x1f\n" +
+	"\vwindow_size\x18\x05 \x01(\x05R\n" +
+	"windowSize\x12\x1f\n" +
+	"\vrolling_avg\x18\x06 \x01(\x01R\n" +
+	"rollingAvg\x12\x17\n" +
+	"\astd_dev\x18\a \x01(\x01R\x06stdDev\x12\x17\n" +
+	"\az_score\x18\b \x01(\x01R\x06zScore\x12\x1d\n" +
+	"\n" +
+	"is_anomaly\x18\t \x01(\bR\tisAnomaly\x12\x16\n" +
+	"\x06reason\x18\n" +
+	" \x01(\tR\x06reason\x12\x1a\n" +
+	"\bseverity\x18\x1e \x01(\tR\bseverity\x12+\n" +
+	"\x11percent_deviation\x18\v \x01(\x01R\x10percentDeviation\x12\x19\n" +
+	"\blast_rps\x18\f \x01(\x01R\alastRps\x12\x19\n" +
+	"\blast_cpu\x18\r \x01(\x01R\alastCpu\x12%\n" +
+	"\x0elast_timestamp\x18\x0e \x01(\x03R\rlastTimestamp\x12\x1f\n" +
+	"\vthreshold_z\x18\x0f \x01(\x01R\n" +
+	"thresholdZ\x12+\n" +
+	"\x11threshold_percent\x18\x10 \x01(\x01R\x10thresholdPercent\x12\x1f\n" +
+	"\vcomputed_at\x18\x11 \x01(\x03R\n" +
+	"computedAt\x12)\n" +
+	"\x10smoothing_window\x18\x12 \x01(\x05R\x0fsmoothingWindow\x12!\n" +
+	"\fsmoothed_rps\x18\x13 \x01(\x01R\vsmoothedRps\x12%\n" +
+	"\x0ebaseline_decay\x18\x14 \x01(\x01R\rbaselineDecay\x12&\n" +
+	"\x0frolling_avg_cpu\x18\x15 \x01(\x01R\rrollingAvgCpu\x12\x1e\n" +
+	"\vstd_dev_cpu\x18\x16 \x01(\x01R\tstdDevCpu\x12\x1e\n" +
+	"\vz_score_cpu\x18\x17 \x01(\x01R\tzScoreCpu\x12$\n" +
+	"\x0eis_anomaly_cpu\x18\x18 \x01(\bR\fisAnomalyCpu\x12/\n" +
+	"\x05joint\x18\x19 \x01(\v2\x19.highload.v1.JointAnomalyR\x05joint\x12+\n" +
+	"\x04vote\x18\x1a \x01(\v2\x17.highload.v1.VoteResultR\x04vote\x12/\n" +
+	"\x06season\x18\x1b \x01(\v2\x17.highload.v1.SeasonInfoR\x06season\x129\n" +
+	"\x06series\x18\x1c \x03(\v2!.highload.v1.Analysis.SeriesEntryR\x06series\x12\x18\n" +
+	"\asamples\x18\x1d \x03(\x01R\asamples\x1aT\n" +
+	"\vSeriesEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12/\n" +
+	"\x05value\x18\x02 \x01(\v2\x19.highload.v1.SeriesResultR\x05value:\x028\x01\"\xa6\x01\n" +
+	"\fJointAnomaly\x12\x1a\n" +
+	"\bdetected\x18\x01 \x01(\bR\bdetected\x12\x18\n" +
+	"\apattern\x18\x02 \x01(\tR\apattern\x12 \n" +
+	"\vcorrelation\x18\x03 \x01(\x01R\vcorrelation\x12\x1e\n" +
+	"\vz_score_rps\x18\x04 \x01(\x01R\tzScoreRps\x12\x1e\n" +
+	"\vz_score_cpu\x18\x05 \x01(\x01R\tzScoreCpu\"\x87\x01\n" +
+	"\n" +
+	"VoteResult\x12\x16\n" +
+	"\x06policy\x18\x01 \x01(\tR\x06policy\x12\x1a\n" +
+	"\brequired\x18\x02 \x01(\x05R\brequired\x12-\n" +
+	"\x05votes\x18\x03 \x03(\v2\x17.highload.v1.WindowVoteR\x05votes\x12\x16\n" +
+	"\x06passed\x18\x04 \x01(\bR\x06passed\"W\n" +
+	"\n" +
+	"WindowVote\x12\x16\n" +
+	"\x06window\x18\x01 \x01(\x05R\x06window\x12\x17\n" +
+	"\az_score\x18\x02 \x01(\x01R\x06zScore\x12\x18\n" +
+	"\aanomaly\x18\x03 \x01(\bR\aanomaly\"<\n" +
+	"\n" +
+	"SeasonInfo\x12\x16\n" +
+	"\x06period\x18\x01 \x01(\tR\x06period\x12\x16\n" +
+	"\x06bucket\x18\x02 \x01(\x05R\x06bucket\"\xac\x01\n" +
+	"\fSeriesResult\x12\x14\n" +
+	"\x05value\x18\x01 \x01(\x01R\x05value\x12\x14\n" +
+	"\x05count\x18\x02 \x01(\x05R\x05count\x12\x1f\n" +
+	"\vrolling_avg\x18\x03 \x01(\x01R\n" +
+	"rollingAvg\x12\x17\n" +
+	"\astd_dev\x18\x04 \x01(\x01R\x06stdDev\x12\x17\n" +
+	"\az_score\x18\x05 \x01(\x01R\x06zScore\x12\x1d\n" +
+	"\n" +
+	"is_anomaly\x18\x06 \x01(\bR\tisAnomaly2\x94\x01\n" +
+	"\x06Ingest\x12K\n" +
+	"\fIngestStream\x12\x1a.highload.v1.IngestRequest\x1a\x1b.highload.v1.IngestResponse(\x010\x01\x12=\n" +
+	"\aAnalyze\x12\x1b.highload.v1.AnalyzeRequest\x1a\x15.highload.v1.AnalysisB\x15Z\x13go-service/ingestpbb\x06proto3"
+
+var (
+	file_ingest_proto_rawDescOnce sync.Once
+	file_ingest_proto_rawDescData []byte
+)
+
+func file_ingest_proto_rawDescGZIP() []byte {
+	file_ingest_proto_rawDescOnce.Do(func() {
+		file_ingest_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_ingest_proto_rawDesc), len(file_ingest_proto_rawDesc)))
+	})
+	return file_ingest_proto_rawDescData
+}
+
+var file_ingest_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
+var file_ingest_proto_goTypes = []any{
+	(*Metric)(nil),         // 0: highload.v1.Metric
+	(*IngestRequest)(nil),  // 1: highload.v1.IngestRequest
+	(*IngestResponse)(nil), // 2: highload.v1.IngestResponse
+	(*BatchError)(nil),     // 3: highload.v1.BatchError
+	(*AnalyzeRequest)(nil), // 4: highload.v1.AnalyzeRequest
+	(*Analysis)(nil),       // 5: highload.v1.Analysis
+	(*JointAnomaly)(nil),   // 6: highload.v1.JointAnomaly
+	(*VoteResult)(nil),     // 7: highload.v1.VoteResult
+	(*WindowVote)(nil),     // 8: highload.v1.WindowVote
+	(*SeasonInfo)(nil),     // 9: highload.v1.SeasonInfo
+	(*SeriesResult)(nil),   // 10: highload.v1.SeriesResult
+	nil,                    // 11: highload.v1.Metric.ValuesEntry
+	nil,                    // 12: highload.v1.Analysis.SeriesEntry
+}
+var file_ingest_proto_depIdxs = []int32{
+	11, // 0: highload.v1.Metric.values:type_name -> highload.v1.Metric.ValuesEntry
+	0,  // 1: highload.v1.IngestRequest.metrics:type_name -> highload.v1.Metric
+	3,  // 2: highload.v1.IngestResponse.errors:type_name -> highload.v1.BatchError
+	6,  // 3: highload.v1.Analysis.joint:type_name -> highload.v1.JointAnomaly
+	7,  // 4: highload.v1.Analysis.vote:type_name -> highload.v1.VoteResult
+	9,  // 5: highload.v1.Analysis.season:type_name -> highload.v1.SeasonInfo
+	12, // 6: highload.v1.Analysis.series:type_name -> highload.v1.Analysis.SeriesEntry
+	8,  // 7: highload.v1.VoteResult.votes:type_name -> highload.v1.WindowVote
+	10, // 8: highload.v1.Analysis.SeriesEntry.value:type_name -> highload.v1.SeriesResult
+	1,  // 9: highload.v1.Ingest.IngestStream:input_type -> highload.v1.IngestRequest
+	4,  // 10: highload.v1.Ingest.Analyze:input_type -> highload.v1.AnalyzeRequest
+	2,  // 11: highload.v1.Ingest.IngestStream:output_type -> highload.v1.IngestResponse
+	5,  // 12: highload.v1.Ingest.Analyze:output_type -> highload.v1.Analysis
+	11, // [11:13] is the sub-list for method output_type
+	9,  // [9:11] is the sub-list for method input_type
+	9,  // [9:9] is the sub-list for extension type_name
+	9,  // [9:9] is the sub-list for extension extendee
+	0,  // [0:9] is the sub-list for field type_name
+}
+
+func init() { file_ingest_proto_init() }
+func file_ingest_proto_init() {
+	if File_ingest_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_ingest_proto_rawDesc), len(file_ingest_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   13,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_ingest_proto_goTypes,
+		DependencyIndexes: file_ingest_proto_depIdxs,
+		MessageInfos:      file_ingest_proto_msgTypes,
+	}.Build()
+	File_ingest_proto = out.File
+	file_ingest_proto_goTypes = nil
+	file_ingest_proto_depIdxs = nil
+}
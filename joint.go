@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	patternCoSpike      = "co_spike"
+	patternCPUUpRPSFlat = "cpu_up_rps_flat"
+	patternRPSUpCPUFlat = "rps_up_cpu_flat"
+)
+
+var jointPatterns = []string{patternCoSpike, patternCPUUpRPSFlat, patternRPSUpCPUFlat}
+
+type JointAnomaly struct {
+	Detected    bool    `json:"detected" msgpack:"detected" desc:"true if an enabled joint pattern matched"`
+	Pattern     string  `json:"pattern,omitempty" msgpack:"pattern,omitempty" desc:"matched pattern: co_spike, cpu_up_rps_flat or rps_up_cpu_flat"`
+	Correlation float64 `json:"correlation" msgpack:"correlation" unit:"dimensionless" desc:"Pearson correlation of CPU and RPS over the window"`
+	ZScoreRPS   float64 `json:"zScoreRps" msgpack:"zScoreRps" unit:"dimensionless" desc:"z-score of the latest RPS"`
+	ZScoreCPU   float64 `json:"zScoreCpu" msgpack:"zScoreCpu" unit:"dimensionless" desc:"z-score of the latest CPU"`
+}
+
+// detectJoint looks at how the latest RPS and CPU samples moved relative to
+// their windows. A co-spike is both signals far above normal; a divergence is
+// one signal far above normal while the other stays within half the
+// threshold, which only counts when the two series are normally correlated.
+// zRPS and zCPU are the z-scores of the single-series detector, so both use
+// the same baseline, e.g. with BASELINE_DECAY.
+func detectJoint(enabled []string, zRPS, zCPU float64, rpsWindow, cpuWindow []float64, threshold, minCorr float64) *JointAnomaly {
+	j := &JointAnomaly{
+		Correlation: correlation(rpsWindow, cpuWindow),
+		ZScoreRPS:   zRPS,
+		ZScoreCPU:   zCPU,
+	}
+
+	flat := threshold / 2
+	correlated := j.Correlation >= minCorr
+	for _, p := range enabled {
+		var hit bool
+		switch p {
+		case patternCoSpike:
+			hit = j.ZScoreRPS > threshold && j.ZScoreCPU > threshold
+		case patternCPUUpRPSFlat:
+			hit = correlated && j.ZScoreCPU > threshold && math.Abs(j.ZScoreRPS) < flat
+		case patternRPSUpCPUFlat:
+			hit = correlated && j.ZScoreRPS > threshold && math.Abs(j.ZScoreCPU) < flat
+		}
+		if hit {
+			j.Detected = true
+			j.Pattern = p
+			break
+		}
+	}
+	return j
+}
+
+func parseJointPatterns(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var out []string
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		known := false
+		for _, k := range jointPatterns {
+			if p == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("JOINT_PATTERNS: unknown pattern %q (known: %s)", p, strings.Join(jointPatterns, ", "))
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
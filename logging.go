@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+
+	requestIDHeader = "X-Request-ID"
+	maxRequestIDLen = 128
+	// maxLoggedRequestIDs caps the request IDs listed on a worker line; a
+	// batch may hold metrics of hundreds of requests.
+	maxLoggedRequestIDs = 10
+)
+
+// parseLogLevel reads LOG_LEVEL: debug, info, warn or error.
+func parseLogLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		return 0, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", v)
+	}
+	return level, nil
+}
+
+// newLogger returns the service logger. Every line logged with a context
+// that carries a requestInfo gets its request_id and trace fields.
+func newLogger(w io.Writer, cfg Config) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: cfg.LogLevel}
+	var h slog.Handler
+	if cfg.LogFormat == logFormatText {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(contextHandler{h})
+}
+
+// fatal logs at error level and exits, like log.Fatalf.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestInfo identifies the request a log line or a metric came from.
+// traceID and spanID are the W3C trace context of the caller, if it sent
+// one, so the lines can be joined with its traces.
+type requestInfo struct {
+	id      string
+	traceID string
+	spanID  string
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(ctx context.Context, info requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+func requestInfoFrom(ctx context.Context) requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(requestInfo)
+	return info
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	info := requestInfoFrom(ctx)
+	if info.id != "" {
+		r.AddAttrs(slog.String("request_id", info.id))
+	}
+	if info.traceID != "" {
+		r.AddAttrs(slog.String("trace_id", info.traceID), slog.String("span_id", info.spanID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// newRequestInfo takes the request ID a client or proxy sent, or makes one
+// up, and the trace context of a traceparent value.
+func newRequestInfo(id, traceparent string) requestInfo {
+	if !validRequestID(id) {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	info := requestInfo{id: id}
+	info.traceID, info.spanID = parseTraceparent(traceparent)
+	return info
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTraceparent returns the trace and parent span IDs of a W3C
+// traceparent header (version-traceid-spanid-flags), or empty strings when
+// it is missing or malformed.
+func parseTraceparent(v string) (traceID, spanID string) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", ""
+	}
+	if (parts[0] == "00" && len(parts) != 4) || !isHex(parts[0]+parts[1]+parts[2]+parts[3]) {
+		return "", ""
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// batchRequestIDs lists the distinct request IDs of a batch for a worker
+// log line, at most maxLoggedRequestIDs of them.
+func batchRequestIDs(batch []Metric) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, m := range batch {
+		if m.origin.id == "" || seen[m.origin.id] {
+			continue
+		}
+		seen[m.origin.id] = true
+		if ids = append(ids, m.origin.id); len(ids) == maxLoggedRequestIDs {
+			break
+		}
+	}
+	return ids
+}
+
+// statusRecorder remembers the status and size of a response for the
+// access log. It passes Flush through, which the SSE handler needs.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// accessLog logs every request once it is done, tags it with a request ID
+// (echoed in X-Request-ID) and puts the requestInfo into the request
+// context for the handlers and the metrics they queue. Successful probes
+// and scrapes are logged at debug level so they do not drown the rest.
+func (s *Service) accessLog(next http.Handler) http.Handler {
+	quiet := map[string]bool{
+		s.cfg.HTTPPathPrefix + "/healthz": true,
+		s.cfg.HTTPPathPrefix + "/readyz":  true,
+		"/metrics":                        true,
+		s.cfg.HTTPPathPrefix + "/metrics": true,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := newRequestInfo(r.Header.Get(requestIDHeader), r.Header.Get("traceparent"))
+		w.Header().Set(requestIDHeader, info.id)
+		ctx := withRequestInfo(r.Context(), info)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		case quiet[r.URL.Path]:
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "http request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", durationMillis(time.Since(start)),
+			"remote_addr", r.RemoteAddr)
+	})
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// grpcRequestInfo is newRequestInfo for the x-request-id and traceparent
+// metadata of a call; the request ID is sent back in the response header.
+func grpcRequestInfo(ctx context.Context) requestInfo {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	return newRequestInfo(first("x-request-id"), first("traceparent"))
+}
+
+func logGRPC(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	switch code {
+	case codes.OK, codes.Canceled:
+	case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unavailable:
+		level = slog.LevelError
+	default:
+		level = slog.LevelWarn
+	}
+	slog.Log(ctx, level, "grpc request",
+		"method", method,
+		"code", code.String(),
+		"duration_ms", durationMillis(time.Since(start)),
+		"remote_addr", grpcPeerIP(ctx))
+}
+
+func (s *Service) logUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	ri := grpcRequestInfo(ctx)
+	_ = grpc.SetHeader(ctx, metadata.Pairs("x-request-id", ri.id))
+	ctx = withRequestInfo(ctx, ri)
+	resp, err := handler(ctx, req)
+	logGRPC(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+// loggedStream hands the context with the requestInfo to the handler.
+type loggedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ls loggedStream) Context() context.Context {
+	return ls.ctx
+}
+
+// logStream is accessLog for gRPC streams. A stream is logged when it
+// closes, and all the metrics it queued carry its request ID.
+func (s *Service) logStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ri := grpcRequestInfo(ss.Context())
+	_ = ss.SetHeader(metadata.Pairs("x-request-id", ri.id))
+	ctx := withRequestInfo(ss.Context(), ri)
+	err := handler(srv, loggedStream{ss, ctx})
+	logGRPC(ctx, info.FullMethod, start, err)
+	return err
+}
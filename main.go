@@ -1,46 +1,120 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
 )
 
 type Metric struct {
 	Timestamp int64   `json:"timestamp"`
 	CPU       float64 `json:"cpu"`
 	RPS       float64 `json:"rps"`
+	Stream    string  `json:"stream,omitempty"`
+	// Source is accepted as another name for Stream.
+	Source string `json:"source,omitempty"`
+	// Values are extra named series, each scored against its own window.
+	Values map[string]float64 `json:"values,omitempty"`
+
+	backfill bool
+	// origin is the request that queued the metric, for the worker logs.
+	origin requestInfo
+	sent   metricFields
 }
 
 type Analysis struct {
-	Count       int     `json:"count"`
-	WindowSize  int     `json:"windowSize"`
-	RollingAvg  float64 `json:"rollingAvg"`
-	StdDev      float64 `json:"stdDev"`
-	ZScore      float64 `json:"zScore"`
-	IsAnomaly   bool    `json:"isAnomaly"`
-	LastRPS     float64 `json:"lastRps"`
-	LastCPU     float64 `json:"lastCpu"`
-	LastTs      int64   `json:"lastTimestamp"`
-	ThresholdZ  float64 `json:"thresholdZ"`
-	ComputedAt  int64   `json:"computedAt"`
+	Stream       string  `json:"stream" msgpack:"stream" desc:"name of the metric stream this analysis belongs to"`
+	Detector     string  `json:"detector" msgpack:"detector" desc:"baseline estimator: window, ewma or seasonal"`
+	Alpha        float64 `json:"alpha,omitempty" msgpack:"alpha,omitempty" unit:"dimensionless" desc:"EWMA smoothing factor, present with the ewma detector"`
+	Count        int     `json:"count" msgpack:"count" desc:"number of samples in the window, samples seen by the EWMA baseline, or past days or weeks in the seasonal bucket"`
+	WindowSize   int     `json:"windowSize" msgpack:"windowSize" unit:"samples" desc:"configured window capacity; 0 with the ewma and seasonal detectors"`
+	RollingAvg   float64 `json:"rollingAvg" msgpack:"rollingAvg" unit:"req/s" desc:"mean RPS over the window"`
+	StdDev       float64 `json:"stdDev" msgpack:"stdDev" unit:"req/s" desc:"standard deviation of RPS over the window"`
+	ZScore       float64 `json:"zScore" msgpack:"zScore" unit:"dimensionless" desc:"distance of the latest RPS from the mean in standard deviations"`
+	IsAnomaly    bool    `json:"isAnomaly" msgpack:"isAnomaly" desc:"true if any detector flagged the latest sample"`
+	Reason       string  `json:"reason,omitempty" msgpack:"reason,omitempty" desc:"rule that flagged the sample (zscore, window_vote, percent_deviation, a joint pattern, cpu_zscore, or source_down for an expected stream that stopped sending)"`
+	Severity     string  `json:"severity,omitempty" msgpack:"severity,omitempty" desc:"info, warning or critical by the largest z-score of the flagged sample; omitted when not anomalous"`
+	PercentDev   float64 `json:"percentDeviation" msgpack:"percentDeviation" unit:"%" desc:"deviation of the latest RPS from the mean relative to the mean; 0 when the mean is 0"`
+	LastRPS      float64 `json:"lastRps" msgpack:"lastRps" unit:"req/s" desc:"raw RPS of the latest sample"`
+	LastCPU      float64 `json:"lastCpu" msgpack:"lastCpu" unit:"%" desc:"CPU of the latest sample as sent by the client"`
+	LastTs       int64   `json:"lastTimestamp" msgpack:"lastTimestamp" unit:"unix seconds" desc:"timestamp of the latest sample"`
+	ThresholdZ   float64 `json:"thresholdZ" msgpack:"thresholdZ" unit:"dimensionless" desc:"absolute z-score above which a sample is anomalous"`
+	ThresholdPct float64 `json:"thresholdPercent,omitempty" msgpack:"thresholdPercent,omitempty" unit:"%" desc:"percent deviation threshold, omitted when disabled"`
+	ComputedAt   int64   `json:"computedAt" msgpack:"computedAt" unit:"unix seconds" desc:"when this analysis was computed"`
+	// ComputedAtNano orders analyses computed within the same second, which
+	// a batch usually is; it is the cursor of /analyze/poll.
+	ComputedAtNano int64 `json:"computedAtNano" msgpack:"computedAtNano" unit:"unix nanoseconds" desc:"when this analysis was computed, in nanoseconds"`
+
+	SmoothingWindow int     `json:"smoothingWindow" msgpack:"smoothingWindow" unit:"samples" desc:"input moving-average window; 0 or 1 means no smoothing"`
+	SmoothedRPS     float64 `json:"smoothedRps,omitempty" msgpack:"smoothedRps,omitempty" unit:"req/s" desc:"smoothed RPS fed to the detector"`
+	BaselineDecay   float64 `json:"baselineDecay,omitempty" msgpack:"baselineDecay,omitempty" unit:"dimensionless" desc:"per-sample weight decay of the baseline; omitted when disabled"`
+
+	RollingAvgCPU float64 `json:"rollingAvgCpu" msgpack:"rollingAvgCpu" unit:"%" desc:"mean CPU over the window"`
+	StdDevCPU     float64 `json:"stdDevCpu" msgpack:"stdDevCpu" unit:"%" desc:"standard deviation of CPU over the window"`
+	ZScoreCPU     float64 `json:"zScoreCpu" msgpack:"zScoreCpu" unit:"dimensionless" desc:"distance of the latest CPU from the mean in standard deviations"`
+	IsAnomalyCPU  bool    `json:"isAnomalyCpu" msgpack:"isAnomalyCpu" desc:"true if the latest CPU is beyond the z-score threshold"`
+
+	Joint *JointAnomaly `json:"joint,omitempty" msgpack:"joint,omitempty" desc:"joint CPU/RPS detection, present when JOINT_PATTERNS is set"`
+	Vote  *VoteResult   `json:"vote,omitempty" msgpack:"vote,omitempty" desc:"multi-window z-score vote, present when VOTE_WINDOWS is set"`
+
+	Season *SeasonInfo `json:"season,omitempty" msgpack:"season,omitempty" desc:"seasonal bucket the sample was compared against, present with the seasonal detector"`
+
+	Series map[string]SeriesResult `json:"series,omitempty" msgpack:"series,omitempty" desc:"analysis of each named series sent in the metric's values, by name"`
+
+	Samples []float64 `json:"samples,omitempty" msgpack:"samples,omitempty" unit:"req/s" desc:"newest window values at the time of an anomaly; only returned with ?samples=true"`
 }
 
+// Reason codes identify the rule that flagged a sample. Joint CPU/RPS
+// anomalies use their pattern name (co_spike, cpu_up_rps_flat, ...).
+const (
+	reasonZScore  = "zscore"
+	reasonPercent = "percent_deviation"
+	reasonVote    = "window_vote"
+
+	reasonCPUZScore = "cpu_zscore"
+)
+
 const (
-	windowSize = 50
-	zThreshold = 2.0
+	defaultWindowSize = 50
+	defaultZThreshold = 2.0
 
-	redisWindowKey = "rps_window"
-	redisLastKey   = "last_analysis"
+	redisWindowKey    = "rps_window"
+	redisRawWindowKey = "rps_raw_window"
+	redisCPUWindowKey = "cpu_window"
+	redisLastKey      = "last_analysis"
+
+	defaultWorkerCount     = 2
+	maxWorkerCount         = 256
+	defaultChannelCapacity = 10_000
+	maxChannelCapacity     = 10_000_000
+
+	workerInitTimeout   = 2 * time.Second
+	httpShutdownTimeout = 5 * time.Second
+	maxWorkerBatch      = 500
+	maxIngestBatch      = 10_000
+
+	defaultHistogramBins = 10
+	maxHistogramBins     = 100
 )
 
 var (
@@ -53,119 +127,739 @@ var (
 		Help:    "Latency of ingest endpoint",
 		Buckets: prometheus.DefBuckets,
 	})
-	currentRollingAvg = prometheus.NewGauge(prometheus.GaugeOpts{
+	currentRollingAvg = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "rolling_avg_rps",
-		Help: "Current rolling average of RPS",
-	})
-	anomalyTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Help: "Current rolling average of RPS by stream",
+	}, []string{"stream"})
+	anomalyTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "anomalies_total",
-		Help: "Total detected anomalies",
-	})
-	anomalyRate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Help: "Total detected anomalies by the rule that fired",
+	}, []string{"reason"})
+	anomalyRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "anomaly_rate",
-		Help: "Anomaly flag as 0/1 for latest sample",
+		Help: "Anomaly flag as 0/1 for latest sample by stream",
+	}, []string{"stream"})
+	queueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ingest_queue_length",
+		Help: "Metrics waiting in the in-process queue for a worker",
+	})
+	ingestOverloaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ingest_overloaded_total",
+		Help: "Metrics rejected with 503 because the in-process queue was full",
+	})
+	workersStarted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "workers_started",
+		Help: "Number of analysis workers in the pool, including those added by WORKER_MAX scaling",
+	})
+	secondaryWriteFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "secondary_redis_write_failures_total",
+		Help: "Writes to the secondary Redis that were dropped, by reason",
+	}, []string{"reason"})
+	jointAnomalyTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "joint_anomalies_total",
+		Help: "Total detected joint CPU/RPS anomalies by pattern",
+	}, []string{"pattern"})
+	cpuAnomalyTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cpu_anomalies_total",
+		Help: "Total samples whose CPU z-score exceeded the threshold",
 	})
 )
 
+var serviceRegistry = prometheus.NewRegistry()
+
 func init() {
-	prometheus.MustRegister(ingestTotal, ingestLatency, currentRollingAvg, anomalyTotal, anomalyRate)
+	collectors := []prometheus.Collector{
+		ingestTotal, ingestLatency, queueLength, ingestOverloaded, currentRollingAvg, anomalyTotal, anomalyRate,
+		jointAnomalyTotal, cpuAnomalyTotal, secondaryWriteFailures, workersStarted,
+	}
+	prometheus.MustRegister(collectors...)
+	serviceRegistry.MustRegister(collectors...)
 }
 
 type Service struct {
 	metricsCh chan Metric
-	rdb       *redis.Client
-	ctx       context.Context
+	// backfillCh queues backfill behind metricsCh; see enqueue.
+	backfillCh chan Metric
+	ctx        context.Context
+	cfg        Config
+	bulkSem    chan struct{}
+	sseSlots   chan struct{}
+	updates    *broadcaster
+	streams    *nameSet
+	series     *nameSet
+
+	rdbMu         sync.RWMutex
+	rdb           *redis.Client
+	workerClients []*redis.Client
+	redisGate     gate
+	secondary     *mirror
+	alerts        *alerter
+	windows       *windowStore
+	remote        remoteState
+	auth          *authenticator
+	adminAuth     *authenticator
+	limiter       *rateLimiter
+	tune          atomic.Pointer[runtimeTuning]
+	fair          *fairScheduler
+	rates         *streamRates
+
+	intakeMu  sync.RWMutex
+	stopping  chan struct{}
+	workersWG sync.WaitGroup
+	processed atomic.Int64
+	// streamBacklog is the group's unacknowledged entries; see trimStream.
+	streamBacklog atomic.Int64
+	// spillLen is the length of the overflow list as last seen; see refill.
+	spillLen atomic.Int64
+	drained  atomic.Uint64 // drain rate in metrics/s, as math.Float64bits; see backpressureLoop
+	aborted  atomic.Bool
+	spillMu  sync.Mutex
+	spilled  []Metric
+	dead     *deadLetters
+
+	// For /status: worker goroutines started and still running, and the
+	// computedAt of the newest analysis scored by this replica.
+	started      time.Time
+	workers      atomic.Int32
+	alive        atomic.Int32
+	lastAnalysis atomic.Int64
 }
 
-func NewService(rdb *redis.Client) *Service {
-	return &Service{
-		metricsCh: make(chan Metric, 10_000),
-		rdb:       rdb,
-		ctx:       context.Background(),
+func NewService(rdb *redis.Client, cfg Config) *Service {
+	s := &Service{
+		metricsCh: make(chan Metric, cfg.ChannelCapacity),
+		// Bulk loads wait for room, so a batch's worth keeps the workers busy.
+		backfillCh: make(chan Metric, maxWorkerBatch),
+		rdb:        rdb,
+		cfg:        cfg,
+		ctx:        context.Background(),
+		bulkSem:    make(chan struct{}, 1),
+		sseSlots:   make(chan struct{}, cfg.SSEMaxClients),
+		updates:    newBroadcaster(),
+		streams:    newStreamSet(cfg.MaxStreams),
+		series:     newSeriesSet(cfg.MaxSeries),
+		alerts:     newAlerter(cfg),
+		stopping:   make(chan struct{}),
+		started:    time.Now(),
+		remote:     remoteState{latest: make(map[string]*remoteLatest)},
+		auth:       newAuthenticator(cfg),
+		adminAuth:  newAdminAuthenticator(cfg),
+		limiter:    newRateLimiter(cfg),
+		dead:       &deadLetters{size: cfg.DeadLetterSize},
+		rates:      newStreamRates(),
+	}
+	s.fair = newFairScheduler(cfg, func() int { return int(s.workers.Load()) })
+	s.tune.Store(&runtimeTuning{effective: configuredTuning(cfg)})
+	if cfg.WindowStore == windowStoreMemory {
+		s.windows = newWindowStore()
 	}
+	if cfg.RedisAddrSecondary != "" {
+		s.secondary = newMirror(redis.NewClient(&redis.Options{Addr: cfg.RedisAddrSecondary}))
+	}
+	return s
 }
 
-func (s *Service) StartWorkers(n int) {
+func (s *Service) StartWorkers(n int) error {
+	if s.cfg.PerWorkerRedis {
+		clients := make([]*redis.Client, n)
+		var errs []error
+		for i := range clients {
+			c := newRedisClient(s.cfg, 1)
+			ctx, cancel := context.WithTimeout(s.ctx, workerInitTimeout)
+			err := c.Ping(ctx).Err()
+			cancel()
+			if err != nil {
+				_ = c.Close()
+				errs = append(errs, fmt.Errorf("worker %d: redis ping: %w", i, err))
+				continue
+			}
+			clients[i] = c
+		}
+		if len(errs) > 0 {
+			for _, c := range clients {
+				if c != nil {
+					_ = c.Close()
+				}
+			}
+			return fmt.Errorf("%d of %d workers failed to initialize: %w", len(errs), n, errors.Join(errs...))
+		}
+		s.rdbMu.Lock()
+		s.workerClients = clients
+		s.rdbMu.Unlock()
+	}
+
+	// Overrides set through another replica apply before the first batch.
+	s.refreshOverrides()
+
+	if s.cfg.Queue == queueStream {
+		if err := s.ensureStreamGroup(); err != nil {
+			return fmt.Errorf("init stream queue: %w", err)
+		}
+	}
+
+	s.workers.Store(int32(n))
 	for i := 0; i < n; i++ {
-		go s.worker(i)
+		s.startWorker(i, nil)
+	}
+	workersStarted.Set(float64(n))
+	go s.backpressureLoop()
+	if s.cfg.Queue == queueStream {
+		s.trimStream()
+		go s.streamBacklogLoop()
+	} else {
+		go s.replayLoop()
+		if s.cfg.OverloadPolicy == overloadSpill {
+			// Metrics spilled before a restart are picked up again.
+			s.refill()
+			go s.refillLoop()
+		}
 	}
+	if s.windows != nil {
+		go s.snapshotLoop(s.cfg.WindowSnapshotInterval)
+	}
+	if s.cfg.APIKeysRedis {
+		go s.refreshKeysLoop(s.cfg.APIKeysRefresh)
+	}
+	go s.refreshOverridesLoop(s.cfg.AdminConfigRefresh)
+	go s.sourceCheckLoop()
+	if s.cfg.Broadcast == broadcastRedis {
+		go s.relayUpdates()
+	}
+	return nil
 }
 
-func (s *Service) worker(id int) {
-	for m := range s.metricsCh {
-		if err := s.rdb.LPush(s.ctx, redisWindowKey, m.RPS).Err(); err != nil {
-			log.Printf("[worker %d] redis LPUSH error: %v", id, err)
+// Close flushes the secondary mirror and closes all Redis clients. Call it
+// after Drain so no worker is still writing.
+func (s *Service) Close() {
+	if s.secondary != nil {
+		s.secondary.close()
+	}
+	s.rdbMu.Lock()
+	defer s.rdbMu.Unlock()
+	for _, c := range s.workerClients {
+		_ = c.Close()
+	}
+	_ = s.rdb.Close()
+}
+
+// startWorker runs worker id in the background until the queue is closed
+// or quit is; a nil quit never fires.
+func (s *Service) startWorker(id int, quit <-chan struct{}) {
+	s.workersWG.Add(1)
+	s.alive.Add(1)
+	go func() {
+		defer s.workersWG.Done()
+		defer s.alive.Add(-1)
+		s.worker(id, quit)
+	}()
+}
+
+// worker processes metricsCh and backfillCh in batches, live metrics
+// first. Closing quit stops it between batches; stream workers are never
+// scaled and do not watch it.
+func (s *Service) worker(id int, quit <-chan struct{}) {
+	if s.cfg.Queue == queueStream {
+		s.streamWorker(id)
+		return
+	}
+	batch := make([]Metric, 0, maxWorkerBatch)
+	for {
+		m, ok := s.receive(quit)
+		if !ok {
+			return
+		}
+		batch = append(batch[:0], m)
+		for len(batch) < maxWorkerBatch {
+			next, ok := s.tryReceive()
+			if !ok {
+				break
+			}
+			batch = append(batch, next)
+		}
+		s.reportQueueDepth()
+
+		s.redisGate.wait()
+		if s.aborted.Load() {
+			s.spill(batch)
+			return
+		}
+		// With WORKER_FAIRNESS=stream_cap the worker may leave part of the
+		// batch to others and get samples set aside for its streams back.
+		for work := s.fair.acquire(batch); len(work) > 0; work = s.fair.release(work) {
+			if err := s.processBatch(id, s.redisFor(id), work); err != nil {
+				slog.Error("batch failed", "worker", id, "request_ids", batchRequestIDs(work), "err", err)
+				continue
+			}
+			s.processed.Add(int64(len(work)))
+		}
+	}
+}
+
+// receive waits for the next queued metric, taking backfill only while no
+// live metric is queued. It reports false once quit is closed or both
+// queues are closed and empty.
+func (s *Service) receive(quit <-chan struct{}) (Metric, bool) {
+	if m, ok := s.tryReceive(); ok {
+		return m, true
+	}
+	live, backfill := s.metricsCh, s.backfillCh
+	for live != nil || backfill != nil {
+		select {
+		case m, ok := <-live:
+			if ok {
+				return m, true
+			}
+			live = nil
+		case m, ok := <-backfill:
+			if ok {
+				return m, true
+			}
+			backfill = nil
+		case <-quit:
+			return Metric{}, false
+		}
+	}
+	return Metric{}, false
+}
+
+// tryReceive takes a queued metric without waiting, live ones first.
+func (s *Service) tryReceive() (Metric, bool) {
+	select {
+	case m, ok := <-s.metricsCh:
+		if ok {
+			return m, true
+		}
+	default:
+	}
+	select {
+	case m, ok := <-s.backfillCh:
+		if ok {
+			return m, true
+		}
+	default:
+	}
+	return Metric{}, false
+}
+
+// processBatch splits a batch by stream and processes each stream's samples
+// in order, retrying transient Redis failures. A failing stream does not
+// hold up the others; the first error is returned. In channel mode the
+// samples of a stream that still fails are dead-lettered, or spilled for
+// replay if Drain gave up meanwhile; in stream mode they stay pending.
+func (s *Service) processBatch(id int, rdb *redis.Client, batch []Metric) error {
+	var first error
+	for _, group := range groupByStream(batch) {
+		stream := group[0].Stream
+		if stream == "" {
+			stream = defaultStream
+		}
+		if err := s.streams.admit(stream); err != nil {
+			slog.Warn("dropping samples", "worker", id, "stream", stream, "samples", len(group), "request_ids", batchRequestIDs(group), "err", err)
 			continue
 		}
-		if err := s.rdb.LTrim(s.ctx, redisWindowKey, 0, windowSize-1).Err(); err != nil {
-			log.Printf("[worker %d] redis LTRIM error: %v", id, err)
+		attempts, err := s.retryRedis(id, len(group), rdb, func(rdb *redis.Client) error {
+			return s.processStreamBatch(id, rdb, stream, group)
+		})
+		if err == nil {
 			continue
 		}
+		if s.cfg.Queue == queueChannel {
+			if s.aborted.Load() {
+				s.spillMu.Lock()
+				s.spilled = append(s.spilled, group...)
+				s.spillMu.Unlock()
+			} else {
+				s.deadLetter(id, group, err, attempts)
+			}
+		}
+		if first == nil {
+			first = fmt.Errorf("stream %s: %w", stream, err)
+		}
+	}
+	return first
+}
 
-		values, err := s.rdb.LRange(s.ctx, redisWindowKey, 0, windowSize-1).Result()
+// processStreamBatch scores a batch of samples of one stream with the
+// configured detector, publishes every analysis and stores the last one.
+// With the windowed detector this takes two Redis round trips per batch:
+// the window MULTI and the pipelined writes of the results (plus one read
+// of the raw window when smoothing). batch is ordered oldest first.
+func (s *Service) processStreamBatch(id int, rdb *redis.Client, stream string, batch []Metric) error {
+	n := len(batch)
+	var anals []Analysis
+	var err error
+	if s.windows != nil {
+		anals, err = s.scoreBatchMemory(rdb, stream, batch)
+	} else {
+		anals, err = s.scoreBatch(rdb, stream, batch)
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := range anals {
+		now := time.Now()
+		anals[i].Stream = stream
+		anals[i].ComputedAt, anals[i].ComputedAtNano = now.Unix(), now.UnixNano()
+		s.grade(&anals[i])
+		s.observe(batch[i], anals[i])
+	}
+	s.publishUpdates(s.ctx, rdb, anals...)
+	s.lastAnalysis.Store(anals[n-1].ComputedAt)
+	s.rates.add(stream, n)
+
+	// The last analysis, the stream registry, the anomaly history and the
+	// metric history go out in one round trip.
+	b, _ := json.Marshal(anals[n-1])
+	lastKey := s.streamKey(redisLastKey, stream)
+	entries := s.anomalyEntries(stream, batch, anals)
+	write := func(ctx context.Context, c redis.Cmdable) ([]redis.Cmder, error) {
+		return c.Pipelined(ctx, func(p redis.Pipeliner) error {
+			p.Set(ctx, lastKey, b, 0)
+			p.SAdd(ctx, s.key(redisStreamsKey), stream)
+			s.appendHistory(ctx, p, stream, entries)
+			s.appendMetricHistory(ctx, p, stream, batch)
+			return nil
+		})
+	}
+	// The writes are idempotent, so they are retried on their own; the
+	// windows already moved and the batch must not be scored again.
+	var cmds []redis.Cmder
+	if _, err := s.retryRedis(id, n, rdb, func(rdb *redis.Client) (err error) {
+		cmds, err = write(s.ctx, rdb)
+		return err
+	}); err != nil {
+		for _, cmd := range cmds {
+			if cmd.Err() != nil {
+				slog.Error("redis write failed", "worker", id, "stream", stream, "cmd", strings.ToUpper(cmd.Name()), "request_ids", batchRequestIDs(batch), "err", cmd.Err())
+			}
+		}
+	}
+	s.secondary.write(func(ctx context.Context, c redis.Cmdable) error {
+		_, err := write(ctx, c)
+		return err
+	})
+	if slog.Default().Enabled(s.ctx, slog.LevelDebug) {
+		slog.Debug("batch processed", "worker", id, "stream", stream, "samples", n, "request_ids", batchRequestIDs(batch))
+	}
+	return nil
+}
+
+// scoreBatch scores a batch against the windows or EWMA state in Redis.
+func (s *Service) scoreBatch(rdb *redis.Client, stream string, batch []Metric) ([]Analysis, error) {
+	n := len(batch)
+	values := make([]float64, n)
+	cpus := make([]float64, n)
+	for i, m := range batch {
+		values[i] = m.RPS
+		cpus[i] = m.CPU
+	}
+
+	var pushes []windowPush
+	if s.cfg.SmoothingWindow > 1 {
+		rawKey := s.streamKey(redisRawWindowKey, stream)
+		older, err := rdb.LRange(s.ctx, rawKey, 0, int64(s.cfg.SmoothingWindow-2)).Result()
 		if err != nil {
-			log.Printf("[worker %d] redis LRANGE error: %v", id, err)
-			continue
+			return nil, fmt.Errorf("redis smoothing: LRANGE %s: %w", rawKey, err)
 		}
+		raw := make([]float64, 0, n+len(older))
+		for i := n - 1; i >= 0; i-- {
+			raw = append(raw, values[i])
+		}
+		raw = append(raw, parseWindow(older)...)
+		pushes = append(pushes, windowPush{key: rawKey, values: values})
 
-		nums := make([]float64, 0, len(values))
-		var sum float64
-		for _, v := range values {
-			f, convErr := strconv.ParseFloat(v, 64)
-			if convErr != nil {
-				continue
-			}
-			nums = append(nums, f)
-			sum += f
-		}
-
-		count := len(nums)
-		mean := 0.0
-		stddev := 0.0
-		if count > 0 {
-			mean = sum / float64(count)
-			var variance float64
-			for _, x := range nums {
-				d := x - mean
-				variance += d * d
+		smoothed := make([]float64, n)
+		for i := range smoothed {
+			smoothed[i], _ = meanStdDev(windowAt(raw, n, i, s.cfg.SmoothingWindow))
+		}
+		values = smoothed
+	}
+
+	if s.tuning().Detector != detectorWindow {
+		return s.scoreBaseline(rdb, stream, batch, values, pushes)
+	}
+	return s.scoreWindow(rdb, stream, batch, values, cpus, pushes)
+}
+
+// scoreBaseline scores a batch with the EWMA or seasonal detector, whose
+// state is kept in a Redis hash rather than in windows. pushes (the raw
+// window when smoothing) are written in the transaction that updates the
+// state, so a batch retried after a failure is not pushed twice.
+func (s *Service) scoreBaseline(rdb *redis.Client, stream string, batch []Metric, values []float64, pushes []windowPush) ([]Analysis, error) {
+	if s.tuning().Detector == detectorSeasonal {
+		return s.scoreSeasonal(rdb, stream, batch, values, pushes)
+	}
+	return s.scoreEWMA(rdb, stream, batch, values, pushes)
+}
+
+// scoreBatchMemory scores a batch against the in-memory windows of the
+// stream. The EWMA and seasonal state still lives in Redis.
+func (s *Service) scoreBatchMemory(rdb *redis.Client, stream string, batch []Metric) ([]Analysis, error) {
+	w, err := s.lockWindows(rdb, stream)
+	if err != nil {
+		return nil, err
+	}
+	defer w.mu.Unlock()
+
+	values := make([]float64, len(batch))
+	for i, m := range batch {
+		values[i] = m.RPS
+	}
+	// The raw values are pushed to a copy that replaces the window only once
+	// the batch is scored, so a batch retried after a failure is not pushed
+	// twice.
+	raw := w.raw
+	if raw != nil {
+		raw = raw.clone()
+		values = raw.smooth(values)
+	}
+	var anals []Analysis
+	if s.tuning().Detector != detectorWindow {
+		anals, err = s.scoreBaseline(rdb, stream, batch, values, nil)
+	} else {
+		anals, err = s.scoreMemory(rdb, stream, w, batch, values)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if raw != nil {
+		w.raw, w.dirty = raw, true
+	}
+	return anals, nil
+}
+
+// scoreWindow pushes the batch to the RPS, CPU and named series windows,
+// plus any extra pushes, in a single MULTI, so the windows always advance
+// together. Every sample is then scored against the windows exactly as they
+// looked right after that sample was pushed, so coalescing does not change
+// the results.
+func (s *Service) scoreWindow(rdb *redis.Client, stream string, batch []Metric, values, cpus []float64, pushes []windowPush) ([]Analysis, error) {
+	series := collectSeries(batch)
+	for _, sp := range series {
+		pushes = append(pushes, windowPush{key: s.seriesKey(stream, sp.name), values: sp.values})
+	}
+	pushes = append(pushes,
+		windowPush{key: s.streamKey(redisWindowKey, stream), values: values},
+		windowPush{key: s.streamKey(redisCPUWindowKey, stream), values: cpus},
+	)
+	windows, err := s.pushWindows(rdb, pushes...)
+	if err != nil {
+		return nil, fmt.Errorf("redis window: %w", err)
+	}
+	window, cpuWindow := windows[len(windows)-2], windows[len(windows)-1]
+	seriesWindows := windows[len(windows)-2-len(series) : len(windows)-2]
+
+	n, t := len(batch), s.tuning()
+	anals := make([]Analysis, n)
+	for i, m := range batch {
+		anals[i] = s.analyze(m, values[i], windowAt(window, n, i, t.WindowSize), windowAt(cpuWindow, n, i, t.WindowSize))
+	}
+	if len(series) > 0 {
+		for k, sp := range series {
+			for j, i := range sp.idx {
+				nums := windowAt(seriesWindows[k], len(sp.idx), j, t.WindowSize)
+				setSeries(&anals[i], sp.name, s.seriesResult(sp.values[j], nums))
 			}
-			variance /= float64(count)
-			stddev = math.Sqrt(variance)
 		}
+		for i := range anals {
+			s.flagSeries(&anals[i], t.ZThreshold)
+		}
+	}
+	return anals, nil
+}
+
+// windowAt returns the newest size entries of window as seen right after the
+// i-th of n batch samples was pushed. window is newest first and includes
+// the n-1 entries beyond the window capacity that pushWindows reads back.
+func windowAt(window []float64, n, i, size int) []float64 {
+	off := min(n-1-i, len(window))
+	return window[off:min(off+size, len(window))]
+}
+
+// moments is the baseline of a window: its mean and standard deviation.
+type moments struct {
+	mean, stddev float64
+}
+
+func (s *Service) analyze(m Metric, value float64, nums, cpuNums []float64) Analysis {
+	var rps, cpu moments
+	rps.mean, rps.stddev = s.baseline(nums)
+	cpu.mean, cpu.stddev = s.baseline(cpuNums)
+	return s.score(m, value, nums, cpuNums, rps, cpu)
+}
+
+// score applies the anomaly rules to a sample given its windows, newest
+// first, and their baselines.
+func (s *Service) score(m Metric, value float64, nums, cpuNums []float64, rps, cpu moments) Analysis {
+	t := s.tuning()
+	count := len(nums)
+	mean, stddev := rps.mean, rps.stddev
+
+	z := zScore(value, mean, stddev, count)
+	pct := percentDeviation(value, mean)
+
+	var vote *VoteResult
+	if len(s.cfg.VoteWindows) > 0 {
+		vote = s.voteWindows(value, nums)
+	}
 
-		z := 0.0
-		if count > 1 && stddev > 0 {
-			z = (m.RPS - mean) / stddev
+	var reason string
+	switch {
+	case vote != nil:
+		if vote.Passed {
+			reason = reasonVote
 		}
-		isAnomaly := math.Abs(z) > zThreshold
+	case math.Abs(z) > t.ZThreshold:
+		reason = reasonZScore
+	}
+	if reason == "" && s.cfg.PercentThreshold > 0 && count > 1 && math.Abs(pct) > s.cfg.PercentThreshold {
+		reason = reasonPercent
+	}
 
-		anal := Analysis{
-			Count:      count,
-			WindowSize: windowSize,
-			RollingAvg: mean,
-			StdDev:     stddev,
-			ZScore:     z,
-			IsAnomaly:  isAnomaly,
-			LastRPS:    m.RPS,
-			LastCPU:    m.CPU,
-			LastTs:     m.Timestamp,
-			ThresholdZ: zThreshold,
-			ComputedAt: time.Now().Unix(),
+	cpuMean, cpuStdDev := cpu.mean, cpu.stddev
+	cpuZ := zScore(m.CPU, cpuMean, cpuStdDev, len(cpuNums))
+
+	var joint *JointAnomaly
+	if len(s.cfg.JointPatterns) > 0 {
+		joint = detectJoint(s.cfg.JointPatterns, z, cpuZ, nums, cpuNums, t.ZThreshold, s.cfg.JointMinCorrelation)
+		if joint.Detected && reason == "" {
+			reason = joint.Pattern
 		}
+	}
 
-		b, _ := json.Marshal(anal)
-		if err := s.rdb.Set(s.ctx, redisLastKey, b, 0).Err(); err != nil {
-			log.Printf("[worker %d] redis SET last_analysis error: %v", id, err)
+	isAnomalyCPU := math.Abs(cpuZ) > t.ZThreshold
+	if reason == "" && isAnomalyCPU {
+		reason = reasonCPUZScore
+	}
+	isAnomaly := reason != ""
+
+	anal := Analysis{
+		Detector:        detectorWindow,
+		Count:           count,
+		WindowSize:      t.WindowSize,
+		RollingAvg:      mean,
+		StdDev:          stddev,
+		ZScore:          z,
+		IsAnomaly:       isAnomaly,
+		Reason:          reason,
+		PercentDev:      pct,
+		ThresholdPct:    s.cfg.PercentThreshold,
+		LastRPS:         m.RPS,
+		LastCPU:         m.CPU,
+		LastTs:          m.Timestamp,
+		ThresholdZ:      t.ZThreshold,
+		ComputedAt:      time.Now().Unix(),
+		SmoothingWindow: s.cfg.SmoothingWindow,
+		BaselineDecay:   s.cfg.BaselineDecay,
+		RollingAvgCPU:   cpuMean,
+		StdDevCPU:       cpuStdDev,
+		ZScoreCPU:       cpuZ,
+		IsAnomalyCPU:    isAnomalyCPU,
+		Joint:           joint,
+		Vote:            vote,
+	}
+	if s.cfg.SmoothingWindow > 1 {
+		anal.SmoothedRPS = value
+	}
+	if isAnomaly && s.cfg.AnomalySamples > 0 {
+		anal.Samples = slices.Clone(nums[:min(len(nums), s.cfg.AnomalySamples)])
+	}
+	return anal
+}
+
+func (s *Service) observe(m Metric, anal Analysis) {
+	currentRollingAvg.WithLabelValues(anal.Stream).Set(anal.RollingAvg)
+	observeSeries(m, anal)
+	if m.backfill {
+		return
+	}
+	if anal.Joint != nil && anal.Joint.Detected {
+		jointAnomalyTotal.WithLabelValues(anal.Joint.Pattern).Inc()
+	}
+	if anal.IsAnomalyCPU {
+		cpuAnomalyTotal.Inc()
+	}
+	if anal.IsAnomaly {
+		slog.InfoContext(withRequestInfo(s.ctx, m.origin), "anomaly detected",
+			"stream", anal.Stream, "reason", anal.Reason, "severity", anal.Severity, "z_score", anal.ZScore,
+			"rps", anal.LastRPS, "timestamp", anal.LastTs)
+		anomalyTotal.WithLabelValues(anal.Reason).Inc()
+		anomalySeverityTotal.WithLabelValues(anal.Severity).Inc()
+		s.alerts.notify(anal)
+		anomalyRate.WithLabelValues(anal.Stream).Set(1)
+	} else {
+		anomalyRate.WithLabelValues(anal.Stream).Set(0)
+	}
+}
+
+func (s *Service) baseline(nums []float64) (mean, stddev float64) {
+	if s.cfg.BaselineDecay > 0 {
+		return decayedMeanStdDev(nums, s.cfg.BaselineDecay)
+	}
+	return meanStdDev(nums)
+}
+
+// windowPush is one list to extend in pushWindows, values oldest first.
+type windowPush struct {
+	key    string
+	values []float64
+}
+
+// appendWindows queues on p the LPUSH of each push's values and the LTRIM
+// of its list to the window size, without reading the windows back.
+func (s *Service) appendWindows(ctx context.Context, p redis.Pipeliner, pushes []windowPush) {
+	size := int64(s.tuning().WindowSize)
+	for _, push := range pushes {
+		args := make([]any, len(push.values))
+		for j, v := range push.values {
+			args[j] = v
+		}
+		p.LPush(ctx, push.key, args...)
+		p.LTrim(ctx, push.key, 0, size-1)
+	}
+}
+
+// pushWindows prepends each push's values to its list with a single LPUSH,
+// reads back the window plus the len(values)-1 older entries needed to score
+// every value in the batch, and trims the list to the window size. All
+// lists are updated in one MULTI so they never drift apart. The returned
+// windows are newest first, in the order of pushes.
+func (s *Service) pushWindows(rdb *redis.Client, pushes ...windowPush) ([][]float64, error) {
+	size := int64(s.tuning().WindowSize)
+	args := make([][]any, len(pushes))
+	for i, p := range pushes {
+		args[i] = make([]any, len(p.values))
+		for j, v := range p.values {
+			args[i][j] = v
 		}
+	}
 
-		currentRollingAvg.Set(mean)
-		if isAnomaly {
-			anomalyTotal.Inc()
-			anomalyRate.Set(1)
-		} else {
-			anomalyRate.Set(0)
+	ranges := make([]*redis.StringSliceCmd, len(pushes))
+	_, err := rdb.TxPipelined(s.ctx, func(tx redis.Pipeliner) error {
+		for i, p := range pushes {
+			tx.LPush(s.ctx, p.key, args[i]...)
+			ranges[i] = tx.LRange(s.ctx, p.key, 0, size+int64(len(p.values))-2)
+			tx.LTrim(s.ctx, p.key, 0, size-1)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("MULTI LPUSH/LRANGE/LTRIM: %w", err)
 	}
+	s.secondary.write(func(ctx context.Context, c redis.Cmdable) error {
+		_, err := c.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+			s.appendWindows(ctx, tx, pushes)
+			return nil
+		})
+		return err
+	})
+
+	windows := make([][]float64, len(pushes))
+	for i, cmd := range ranges {
+		windows[i] = parseWindow(cmd.Val())
+	}
+	return windows, nil
 }
 
 func (s *Service) handleIngest(w http.ResponseWriter, r *http.Request) {
@@ -177,24 +871,176 @@ func (s *Service) handleIngest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	body := bufio.NewReader(r.Body)
+	if isJSONArray(body) {
+		var batch []Metric
+		if err := json.NewDecoder(body).Decode(&batch); err != nil {
+			writeBodyError(w, "bad json", err)
+			return
+		}
+		s.ingestBatch(w, r, batch)
+		return
+	}
+
 	var m Metric
-	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		writeBodyError(w, "bad json", err)
 		return
 	}
 	if m.Timestamp == 0 {
 		m.Timestamp = time.Now().Unix()
 	}
+	if err := s.validateMetric(m, false); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	if err := s.admitStream(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	select {
-	case s.metricsCh <- m:
-		ingestTotal.Inc()
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusAccepted)
-		_, _ = w.Write([]byte(`{"status":"accepted"}`))
+	if err := s.enqueue(r.Context(), m, s.cfg.OverloadPolicy); err != nil {
+		if errors.Is(err, errOverloaded) {
+			ingestOverloaded.Inc()
+			s.writeOverloaded(w)
+			return
+		}
+		if errors.Is(err, errShuttingDown) {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "queue error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ingestTotal.Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte(`{"status":"accepted"}`))
+}
+
+// isJSONArray reports whether the next non-space byte of br opens a JSON
+// array, without consuming it.
+func isJSONArray(br *bufio.Reader) bool {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		_ = br.UnreadByte()
+		return c == '['
+	}
+}
+
+type batchResult struct {
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Dropped  int          `json:"dropped"`
+	Errors   []batchError `json:"errors,omitempty"`
+
+	// overloaded is set when the rest of the batch was dropped because the
+	// queue was full.
+	overloaded bool
+}
+
+type batchError struct {
+	Index  int          `json:"index"`
+	Error  string       `json:"error"`
+	Fields []fieldError `json:"fields,omitempty"`
+}
+
+// maxBatchErrors caps how many per-item errors a batch response lists; the
+// rejected count still covers all of them.
+const maxBatchErrors = 100
+
+// handleIngestBatch enqueues a JSON array of metrics; see ingestBatch.
+func (s *Service) handleIngestBatch(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	defer func() { ingestLatency.Observe(time.Since(start).Seconds()) }()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var batch []Metric
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeBodyError(w, "bad json", err)
+		return
+	}
+	s.ingestBatch(w, r, batch)
+}
+
+// ingestBatch queues a JSON batch and reports the outcome by index. If the
+// queue fills up part way, the remaining metrics are dropped and reported
+// rather than failing the ones that were already accepted.
+func (s *Service) ingestBatch(w http.ResponseWriter, r *http.Request, batch []Metric) {
+	if len(batch) > maxIngestBatch {
+		http.Error(w, fmt.Sprintf("batch too large: max %d metrics", maxIngestBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	res := s.queueBatch(r.Context(), batch)
+	if res.overloaded {
+		w.Header().Set("Retry-After", retryAfterSeconds(s.overloadRetryAfter()))
+	}
+	status := http.StatusAccepted
+	switch {
+	case res.Accepted > 0 || len(batch) == 0:
+	case res.Dropped > 0:
+		status = http.StatusServiceUnavailable
 	default:
-		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		status = http.StatusUnprocessableEntity
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// queueBatch enqueues the metrics of a batch in order. Invalid metrics are
+// rejected one by one without affecting the rest; once the queue is full or
+// the service is stopping, the rest of the batch is dropped.
+func (s *Service) queueBatch(ctx context.Context, batch []Metric) batchResult {
+	var res batchResult
+	reject := func(i int, err error) {
+		res.Rejected++
+		if len(res.Errors) < maxBatchErrors {
+			res.Errors = append(res.Errors, batchError{Index: i, Error: err.Error(), Fields: fieldErrors(err)})
+		}
+	}
+
+	now := time.Now().Unix()
+	for i := range batch {
+		m := &batch[i]
+		if m.Timestamp == 0 {
+			m.Timestamp = now
+		}
+		if err := s.validateMetric(*m, false); err != nil {
+			reject(i, err)
+			continue
+		}
+		if err := s.admitStream(m); err != nil {
+			reject(i, err)
+			continue
+		}
+		if err := s.enqueue(ctx, *m, s.cfg.OverloadPolicy); err != nil {
+			if !errors.Is(err, errOverloaded) && !errors.Is(err, errShuttingDown) {
+				slog.ErrorContext(ctx, "batch enqueue failed", "err", err)
+			}
+			res.Dropped = len(batch) - i
+			if errors.Is(err, errOverloaded) {
+				ingestOverloaded.Add(float64(res.Dropped))
+				res.overloaded = true
+			}
+			break
+		}
+		res.Accepted++
 	}
+	ingestTotal.Add(float64(res.Accepted))
+	return res
 }
 
 func (s *Service) handleAnalyze(w http.ResponseWriter, r *http.Request) {
@@ -203,45 +1049,328 @@ func (s *Service) handleAnalyze(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	val, err := s.rdb.Get(s.ctx, redisLastKey).Result()
-	if err == redis.Nil {
+	t := s.tuning()
+	size, threshold := t.WindowSize, t.ZThreshold
+	q := r.URL.Query()
+	if v := q.Get("windowSize"); v != "" {
+		if t.Detector != detectorWindow {
+			http.Error(w, "windowSize is not supported with DETECTOR="+t.Detector, http.StatusBadRequest)
+			return
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 || n > t.WindowSize {
+			http.Error(w, fmt.Sprintf("windowSize must be an integer between 2 and %d", t.WindowSize), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	if v := q.Get("threshold"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(f > 0) || math.IsInf(f, 0) {
+			http.Error(w, "threshold must be a positive number", http.StatusBadRequest)
+			return
+		}
+		threshold = f
+	}
+	stream, err := s.streamParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := analysisFormat(r)
+	if errors.Is(err, errNotAcceptable) {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	anal, err := s.latestAnalysis(stream, size, threshold, wantSamples(r))
+	switch {
+	case errors.Is(err, redis.Nil):
 		w.WriteHeader(http.StatusNoContent)
 		return
+	case errors.Is(err, errCorruptAnalysis):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case err != nil:
+		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeAnalysis(w, format, anal)
+}
+
+var errCorruptAnalysis = errors.New("corrupt analysis")
+
+// latestAnalysis returns the stored analysis of stream, re-scored when
+// size or threshold differ from the ones in effect. It returns redis.Nil
+// while the stream has no analysis yet.
+func (s *Service) latestAnalysis(stream string, size int, threshold float64, samples bool) (Analysis, error) {
+	var anal Analysis
+	val, err := s.redis().Get(s.ctx, s.streamKey(redisLastKey, stream)).Bytes()
+	if err != nil {
+		return anal, err
+	}
+	if err := json.Unmarshal(val, &anal); err != nil {
+		return anal, fmt.Errorf("%w: %v", errCorruptAnalysis, err)
+	}
+	if !samples {
+		anal.Samples = nil
+	}
+	t := s.tuning()
+	if size == t.WindowSize && threshold == t.ZThreshold {
+		return anal, nil
+	}
+
+	if t.Detector != detectorWindow {
+		s.rescoreBaseline(&anal, threshold)
+	} else {
+		values, err := s.readWindow(stream, redisWindowKey, size)
+		if err != nil {
+			return anal, err
+		}
+		cpus, err := s.readWindow(stream, redisCPUWindowKey, size)
+		if err != nil {
+			return anal, err
+		}
+		s.recompute(&anal, values, cpus, size, threshold)
+	}
+	s.grade(&anal)
+	return anal, nil
+}
+
+// recompute re-scores the newest RPS and CPU window values against the
+// newest size samples with the given z threshold. Only the z-score and
+// percent rules are re-evaluated; vote and joint results were computed with
+// the stored parameters and are dropped rather than reported stale, as are
+// the named series when the window size changes (their z-scores are kept
+// and re-flagged for a new threshold).
+func (s *Service) recompute(anal *Analysis, nums, cpuNums []float64, size int, threshold float64) {
+	anal.WindowSize = size
+	anal.ThresholdZ = threshold
+	anal.Count = len(nums)
+	anal.Vote = nil
+	anal.Joint = nil
+	if size != s.tuning().WindowSize {
+		anal.Series = nil
+	}
+	if len(nums) == 0 {
+		return
+	}
+
+	latest := nums[0]
+	anal.RollingAvg, anal.StdDev = s.baseline(nums)
+	anal.ZScore = zScore(latest, anal.RollingAvg, anal.StdDev, len(nums))
+	anal.PercentDev = percentDeviation(latest, anal.RollingAvg)
+
+	anal.IsAnomalyCPU = false
+	if len(cpuNums) > 0 {
+		anal.RollingAvgCPU, anal.StdDevCPU = s.baseline(cpuNums)
+		anal.ZScoreCPU = zScore(cpuNums[0], anal.RollingAvgCPU, anal.StdDevCPU, len(cpuNums))
+		anal.IsAnomalyCPU = math.Abs(anal.ZScoreCPU) > threshold
+	}
+
+	anal.Reason = ""
+	switch {
+	case math.Abs(anal.ZScore) > threshold:
+		anal.Reason = reasonZScore
+	case s.cfg.PercentThreshold > 0 && len(nums) > 1 && math.Abs(anal.PercentDev) > s.cfg.PercentThreshold:
+		anal.Reason = reasonPercent
+	case anal.IsAnomalyCPU:
+		anal.Reason = reasonCPUZScore
+	}
+	anal.IsAnomaly = anal.Reason != ""
+	s.flagSeries(anal, threshold)
+}
+
+func wantSamples(r *http.Request) bool {
+	b, _ := strconv.ParseBool(r.URL.Query().Get("samples"))
+	return b
+}
+
+// stripSamples drops the anomaly evidence from a stored analysis so that the
+// default /analyze body stays small. Only anomalous analyses carry samples.
+func stripSamples(val string) string {
+	if !strings.Contains(val, `"samples"`) {
+		return val
+	}
+	var anal Analysis
+	if err := json.Unmarshal([]byte(val), &anal); err != nil {
+		return val
+	}
+	anal.Samples = nil
+	b, err := json.Marshal(anal)
+	if err != nil {
+		return val
+	}
+	return string(b)
+}
+
+func (s *Service) handleWindow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	t := s.tuning()
+	if t.Detector != detectorWindow {
+		http.Error(w, "no window is kept with DETECTOR="+t.Detector, http.StatusConflict)
+		return
+	}
+	stream, err := s.streamParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values, err := s.readWindow(stream, redisWindowKey, t.WindowSize)
+	if err != nil {
+		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	resp := struct {
+		SmoothingWindow int       `json:"smoothingWindow"`
+		Values          []float64 `json:"values"`
+		Raw             []float64 `json:"raw,omitempty"`
+	}{
+		SmoothingWindow: s.cfg.SmoothingWindow,
+		Values:          values,
+	}
+
+	if s.cfg.SmoothingWindow > 1 {
+		raw, err := s.readWindow(stream, redisRawWindowKey, t.WindowSize)
+		if err != nil {
+			http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		resp.Raw = raw
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Service) handleWindowHistogram(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
 	}
+	t := s.tuning()
+	if t.Detector != detectorWindow {
+		http.Error(w, "no window is kept with DETECTOR="+t.Detector, http.StatusConflict)
+		return
+	}
+
+	bins := defaultHistogramBins
+	if v := r.URL.Query().Get("bins"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "bins must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		bins = min(n, maxHistogramBins)
+	}
+	stream, err := s.streamParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values, err := s.readWindow(stream, redisWindowKey, t.WindowSize)
 	if err != nil {
 		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	_, _ = w.Write([]byte(val))
+	_ = json.NewEncoder(w).Encode(buildHistogram(values, bins))
 }
 
 func main() {
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "redis-master:6379"
+	validateOnly := flag.Bool("validate-config", false, "validate the configuration, print the effective settings and exit")
+	flag.Parse()
+	if v, _ := strconv.ParseBool(os.Getenv("VALIDATE_ONLY")); v {
+		*validateOnly = true
+	}
+
+	cfg, err := LoadConfig()
+	if *validateOnly {
+		cfg.WriteReport(os.Stdout, err)
+		if err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	slog.SetDefault(newLogger(os.Stderr, cfg))
+	if err != nil {
+		fatal("invalid configuration", "err", err)
+	}
+	for _, w := range cfg.Warnings {
+		slog.Warn("config warning", "warning", w)
 	}
 
 	ctx := context.Background()
-	rdb := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
+	rdb := newRedisClient(cfg, 0)
 
 	if err := rdb.Ping(ctx).Err(); err != nil {
-		log.Fatalf("redis ping failed: %v", err)
+		fatal("redis ping failed", "addr", cfg.RedisAddr, "err", err)
 	}
-	log.Println("connected to redis:", redisAddr)
+	slog.Info("connected to redis", "addr", cfg.RedisAddr)
 
-	svc := NewService(rdb)
-	svc.StartWorkers(2)
+	svc := NewService(rdb, cfg)
+	if err := svc.StartWorkers(cfg.WorkerCount); err != nil {
+		svc.Close()
+		fatal("start workers failed", "err", err)
+	}
+	if cfg.RedisReconnectAfter > 0 {
+		go svc.superviseRedis()
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ingest", svc.handleIngest)
-	mux.HandleFunc("/analyze", svc.handleAnalyze)
-	mux.Handle("/metrics", promhttp.Handler())
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		svc.Close()
+		fatal("tls setup failed", "err", err)
+	}
+	server := newHTTPServer(cfg, tlsConfig, svc.accessLog(svc.limitBody(svc.newMux())))
+	go func() {
+		slog.Info("http listening", "addr", server.Addr, "tls", server.TLSConfig != nil, "client_ca", cfg.TLSClientCAFile != "")
+		if err := serveHTTP(server); err != nil && err != http.ErrServerClosed {
+			fatal("http server failed", "err", err)
+		}
+	}()
+
+	var grpcServer *grpc.Server
+	if cfg.GRPCListenAddr != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCListenAddr)
+		if err != nil {
+			fatal("grpc listen failed", "addr", cfg.GRPCListenAddr, "err", err)
+		}
+		grpcServer = svc.newGRPCServer(tlsConfig)
+		go func() {
+			slog.Info("grpc listening", "addr", cfg.GRPCListenAddr, "tls", tlsConfig != nil, "client_ca", cfg.TLSClientCAFile != "")
+			if err := grpcServer.Serve(lis); err != nil {
+				fatal("grpc server failed", "err", err)
+			}
+		}()
+	}
+
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCtx.Done()
+	stop()
+
+	slog.Info("shutting down, draining queue", "timeout", cfg.ShutdownTimeout.String())
+	processed, flushed := svc.Drain(cfg.ShutdownTimeout)
+	slog.Info("drain finished", "processed", processed, "flushed_for_replay", flushed)
 
-	addr := ":8080"
-	log.Println("listening on", addr)
-	log.Fatal(http.ListenAndServe(addr, mux))
+	shutdownCtx, cancel := context.WithTimeout(ctx, httpShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("http shutdown", "err", err)
+	}
+	if grpcServer != nil {
+		stopGRPC(grpcServer, httpShutdownTimeout)
+	}
+	svc.Close()
+	slog.Info("bye")
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestService returns a service on a fresh miniredis, configured from
+// the environment plus env, given as key/value pairs.
+func newTestService(tb testing.TB, env ...string) (*Service, *miniredis.Miniredis) {
+	tb.Helper()
+	mr := miniredis.RunT(tb)
+	tb.Setenv("REDIS_ADDR", mr.Addr())
+	for i := 0; i+1 < len(env); i += 2 {
+		tb.Setenv(env[i], env[i+1])
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	svc := NewService(newRedisClient(cfg, 0), cfg)
+	tb.Cleanup(svc.Close)
+	return svc, mr
+}
+
+func TestStartWorkersFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        []string
+		breakRedis func(mr *miniredis.Miniredis)
+		want       string
+	}{
+		{
+			name:       "per-worker client cannot connect",
+			env:        []string{"REDIS_PER_WORKER_CLIENT", "true"},
+			breakRedis: func(mr *miniredis.Miniredis) { mr.Close() },
+			want:       "3 of 3 workers failed to initialize",
+		},
+		{
+			name: "stream group cannot be created",
+			env:  []string{"QUEUE", queueStream},
+			breakRedis: func(mr *miniredis.Miniredis) {
+				_ = mr.Set(redisStreamKey, "not a stream")
+			},
+			want: "init stream queue",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc, mr := newTestService(t, tt.env...)
+			tt.breakRedis(mr)
+			before := runtime.NumGoroutine()
+
+			err := svc.StartWorkers(3)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("StartWorkers: err = %v, want %q", err, tt.want)
+			}
+			if n, alive := svc.workers.Load(), svc.alive.Load(); n != 0 || alive != 0 {
+				t.Errorf("workers = %d, alive = %d after a failed start, want 0", n, alive)
+			}
+			svc.rdbMu.RLock()
+			clients := len(svc.workerClients)
+			svc.rdbMu.RUnlock()
+			if clients != 0 {
+				t.Errorf("%d per-worker clients kept after a failed start", clients)
+			}
+
+			// Connection pool goroutines of the closed clients may take a
+			// moment to exit.
+			deadline := time.Now().Add(time.Second)
+			for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := runtime.NumGoroutine(); n > before {
+				buf := make([]byte, 1<<16)
+				t.Errorf("%d goroutines before StartWorkers, %d after:\n%s", before, n, buf[:runtime.Stack(buf, true)])
+			}
+		})
+	}
+}
+
+// BenchmarkProcessBatch compares workers sharing the primary pool with
+// REDIS_PER_WORKER_CLIENT=true, under as many concurrent workers as
+// GOMAXPROCS. Each worker scores its own stream.
+func BenchmarkProcessBatch(b *testing.B) {
+	const batchSize = 50
+	for _, mode := range []struct {
+		name      string
+		perWorker string
+	}{
+		{"shared", "false"},
+		{"per_worker", "true"},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			workers := runtime.GOMAXPROCS(0)
+			svc, _ := newTestService(b,
+				"REDIS_PER_WORKER_CLIENT", mode.perWorker,
+				"WORKER_COUNT", strconv.Itoa(workers))
+			if err := svc.StartWorkers(workers); err != nil {
+				b.Fatal(err)
+			}
+
+			var next atomic.Int32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				id := int(next.Add(1)-1) % workers
+				rdb := svc.redisFor(id)
+				batch := make([]Metric, batchSize)
+				for i := range batch {
+					batch[i] = Metric{
+						Stream: "bench-" + strconv.Itoa(id),
+						CPU:    40 + float64(i%7),
+						RPS:    100 + float64(i%11),
+					}
+				}
+				for pb.Next() {
+					now := time.Now().Unix()
+					for i := range batch {
+						batch[i].Timestamp = now
+					}
+					if err := svc.processBatch(id, rdb, batch); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "samples/s")
+		})
+	}
+}
+
+// BenchmarkWorkerRoundTrips compares the batched worker path with the one
+// it replaced, which made four sequential round-trips per sample: LPUSH,
+// LTRIM and LRANGE of the window, then SET of last_analysis. The old path
+// is rebuilt here on the same keys; it scores RPS only, so it does less
+// work per sample than processBatch.
+func BenchmarkWorkerRoundTrips(b *testing.B) {
+	const batchSize = 50
+	newBatch := func() []Metric {
+		now := time.Now().Unix()
+		batch := make([]Metric, batchSize)
+		for i := range batch {
+			batch[i] = Metric{Timestamp: now, CPU: 40 + float64(i%7), RPS: 100 + float64(i%11)}
+		}
+		return batch
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		svc, _ := newTestService(b)
+		rdb, ctx := svc.redis(), svc.ctx
+		size := int64(svc.tuning().WindowSize)
+		windowKey := svc.streamKey(redisWindowKey, defaultStream)
+		lastKey := svc.streamKey(redisLastKey, defaultStream)
+		batch := newBatch()
+		b.ResetTimer()
+		for b.Loop() {
+			for _, m := range batch {
+				if err := rdb.LPush(ctx, windowKey, m.RPS).Err(); err != nil {
+					b.Fatal(err)
+				}
+				if err := rdb.LTrim(ctx, windowKey, 0, size-1).Err(); err != nil {
+					b.Fatal(err)
+				}
+				values, err := rdb.LRange(ctx, windowKey, 0, size-1).Result()
+				if err != nil {
+					b.Fatal(err)
+				}
+				mean, std := meanStdDev(parseWindow(values))
+				a := Analysis{Stream: defaultStream, RollingAvg: mean, StdDev: std, LastRPS: m.RPS, LastTs: m.Timestamp}
+				if std > 0 {
+					a.ZScore = (m.RPS - mean) / std
+				}
+				data, _ := json.Marshal(a)
+				if err := rdb.Set(ctx, lastKey, data, 0).Err(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "samples/s")
+	})
+
+	b.Run("pipelined", func(b *testing.B) {
+		svc, _ := newTestService(b)
+		rdb := svc.redis()
+		batch := newBatch()
+		b.ResetTimer()
+		for b.Loop() {
+			if err := svc.processBatch(0, rdb, batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N*batchSize)/b.Elapsed().Seconds(), "samples/s")
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+type metricSample struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  *float64          `json:"value,omitempty"`
+	Count  *uint64           `json:"count,omitempty"`
+	Sum    *float64          `json:"sum,omitempty"`
+}
+
+type metricValue struct {
+	Name    string         `json:"name"`
+	Type    string         `json:"type"`
+	Help    string         `json:"help"`
+	Samples []metricSample `json:"samples"`
+}
+
+// handleMetric returns the current value of one of the service's own
+// collectors as JSON. Go runtime and process collectors registered on the
+// default registry are deliberately not reachable here.
+func (s *Service) handleMetric(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	families, err := serviceRegistry.Gather()
+	if err != nil {
+		http.Error(w, "gather error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+		out := metricValue{
+			Name:    name,
+			Type:    mf.GetType().String(),
+			Help:    mf.GetHelp(),
+			Samples: make([]metricSample, 0, len(mf.GetMetric())),
+		}
+		for _, m := range mf.GetMetric() {
+			out.Samples = append(out.Samples, toSample(m))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	}
+
+	http.Error(w, "unknown metric", http.StatusNotFound)
+}
+
+func toSample(m *dto.Metric) metricSample {
+	var sm metricSample
+	if lp := m.GetLabel(); len(lp) > 0 {
+		sm.Labels = make(map[string]string, len(lp))
+		for _, l := range lp {
+			sm.Labels[l.GetName()] = l.GetValue()
+		}
+	}
+
+	switch {
+	case m.Counter != nil:
+		v := m.Counter.GetValue()
+		sm.Value = &v
+	case m.Gauge != nil:
+		v := m.Gauge.GetValue()
+		sm.Value = &v
+	case m.Untyped != nil:
+		v := m.Untyped.GetValue()
+		sm.Value = &v
+	case m.Histogram != nil:
+		c, v := m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+		sm.Count, sm.Sum = &c, &v
+	case m.Summary != nil:
+		c, v := m.Summary.GetSampleCount(), m.Summary.GetSampleSum()
+		sm.Count, sm.Sum = &c, &v
+	}
+	return sm
+}
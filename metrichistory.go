@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisMetricHistoryKey is a sorted set of the raw metrics of a stream
+	// scored by timestamp, kept for METRIC_HISTORY_RETENTION.
+	redisMetricHistoryKey = "metric_history"
+
+	defaultHistoryStep = time.Minute
+	defaultHistorySpan = 24 * time.Hour
+	// maxHistoryPoints caps the buckets of one query; Grafana rarely asks
+	// for more points than the panel is wide.
+	maxHistoryPoints = 11_000
+	// The raw points of a query are read historyPageSize at a time, and a
+	// query reads at most maxHistoryScan of them, so a wide range over a
+	// busy stream neither loads the whole set into memory nor stalls Redis.
+	historyPageSize = 5000
+	maxHistoryScan  = 1_000_000
+)
+
+var historyAggregates = []string{"avg", "min", "max"}
+
+// historyPoint is one metric as stored in the history. Identical metrics
+// are one set member, so a batch processed twice (QUEUE=stream delivers at
+// least once) does not count twice.
+type historyPoint struct {
+	Timestamp int64              `json:"t"`
+	CPU       float64            `json:"c"`
+	RPS       float64            `json:"r"`
+	Values    map[string]float64 `json:"v,omitempty"`
+}
+
+// appendMetricHistory queues the metrics of a batch onto the stream's
+// history and drops points older than METRIC_HISTORY_RETENTION.
+func (s *Service) appendMetricHistory(ctx context.Context, p redis.Pipeliner, stream string, batch []Metric) {
+	if s.cfg.MetricHistoryRetention == 0 {
+		return
+	}
+	entries := make([]redis.Z, len(batch))
+	for i, m := range batch {
+		b, _ := json.Marshal(historyPoint{Timestamp: m.Timestamp, CPU: m.CPU, RPS: m.RPS, Values: m.Values})
+		entries[i] = redis.Z{Score: float64(m.Timestamp), Member: b}
+	}
+	key := s.streamKey(redisMetricHistoryKey, stream)
+	p.ZAdd(ctx, key, entries...)
+	cutoff := time.Now().Add(-s.cfg.MetricHistoryRetention).Unix()
+	p.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(cutoff, 10))
+}
+
+// grafanaSeries is a target of the Grafana JSON datasource time series
+// format: datapoints are [value, unix milliseconds].
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type historyBucket struct {
+	start         int64
+	n             int
+	sum, min, max float64
+}
+
+var errHistoryTooLarge = fmt.Errorf("range holds more than %d points; narrow from and to", maxHistoryScan)
+
+// scanMetricHistory reads the points of key between from and to page by
+// page and folds series into step buckets, oldest first. Pages are keyed
+// by score rather than by offset from the start, so each read costs the
+// same however deep into the range it is: the next page starts at the
+// last timestamp seen, skipping the points of that timestamp already read.
+func (s *Service) scanMetricHistory(key, series string, from, to, stepSec int64) ([]historyBucket, error) {
+	var buckets []historyBucket
+	lo, skip, scanned := from, int64(0), 0
+	for {
+		page, err := s.redis().ZRangeByScoreWithScores(s.ctx, key, &redis.ZRangeBy{
+			Min:    strconv.FormatInt(lo, 10),
+			Max:    strconv.FormatInt(to, 10),
+			Offset: skip,
+			Count:  historyPageSize,
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		if scanned += len(page); scanned > maxHistoryScan {
+			return nil, errHistoryTooLarge
+		}
+		for _, z := range page {
+			if ts := int64(z.Score); ts != lo {
+				lo, skip = ts, 0
+			}
+			skip++
+			v, _ := z.Member.(string)
+			var pt historyPoint
+			if json.Unmarshal([]byte(v), &pt) != nil {
+				continue
+			}
+			var x float64
+			switch series {
+			case "rps":
+				x = pt.RPS
+			case "cpu":
+				x = pt.CPU
+			default:
+				var ok bool
+				if x, ok = pt.Values[series]; !ok {
+					continue
+				}
+			}
+			start := pt.Timestamp - pt.Timestamp%stepSec
+			if n := len(buckets); n == 0 || buckets[n-1].start != start {
+				buckets = append(buckets, historyBucket{start: start, min: math.Inf(1), max: math.Inf(-1)})
+			}
+			b := &buckets[len(buckets)-1]
+			b.n++
+			b.sum += x
+			b.min = min(b.min, x)
+			b.max = max(b.max, x)
+		}
+		if len(page) < historyPageSize {
+			return buckets, nil
+		}
+	}
+}
+
+// handleMetricHistory returns ?series= (rps, cpu or a named series) of
+// ?stream= between from and to (unix seconds, default the last 24 hours)
+// downsampled into step buckets, one Grafana target per aggregate in
+// ?agg= (avg, min and max by default). Empty buckets are left out.
+func (s *Service) handleMetricHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cfg.MetricHistoryRetention == 0 {
+		http.Error(w, "metric history is disabled: METRIC_HISTORY_RETENTION=0", http.StatusConflict)
+		return
+	}
+	q := r.URL.Query()
+
+	series := q.Get("series")
+	if series == "" {
+		series = "rps"
+	}
+	if series != "rps" && series != "cpu" {
+		if err := s.validateSeriesName(series); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	aggs := historyAggregates
+	if v := q.Get("agg"); v != "" {
+		aggs = strings.Split(v, ",")
+		for _, a := range aggs {
+			if a != "avg" && a != "min" && a != "max" {
+				http.Error(w, "agg must be a comma-separated list of avg, min and max", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	step := defaultHistoryStep
+	if v := q.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			http.Error(w, "step must be a duration of at least 1s", http.StatusBadRequest)
+			return
+		}
+		step = d.Truncate(time.Second)
+	}
+
+	now := time.Now().Unix()
+	to, err := unixParam(q.Get("to"), now)
+	if err != nil {
+		http.Error(w, "bad to: must be a unix timestamp", http.StatusBadRequest)
+		return
+	}
+	from, err := unixParam(q.Get("from"), to-int64(defaultHistorySpan/time.Second))
+	if err != nil {
+		http.Error(w, "bad from: must be a unix timestamp", http.StatusBadRequest)
+		return
+	}
+	stepSec := int64(step / time.Second)
+	if from > to {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	if (to-from)/stepSec+1 > maxHistoryPoints {
+		http.Error(w, fmt.Sprintf("range has more than %d steps; use a larger step", maxHistoryPoints), http.StatusBadRequest)
+		return
+	}
+
+	stream, err := s.streamParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	buckets, err := s.scanMetricHistory(s.streamKey(redisMetricHistoryKey, stream), series, from, to, stepSec)
+	if errors.Is(err, errHistoryTooLarge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	out := make([]grafanaSeries, len(aggs))
+	for i, agg := range aggs {
+		out[i] = grafanaSeries{Target: series + ":" + agg, Datapoints: make([][2]float64, len(buckets))}
+		for j, b := range buckets {
+			v := b.sum / float64(b.n)
+			switch agg {
+			case "min":
+				v = b.min
+			case "max":
+				v = b.max
+			}
+			out[i].Datapoints[j] = [2]float64{v, float64(b.start * 1000)}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func unixParam(v string, def int64) (int64, error) {
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	mirrorQueueSize    = 10_000
+	mirrorFlushTimeout = 5 * time.Second
+)
+
+type mirrorOp func(ctx context.Context, c redis.Cmdable) error
+
+// mirror replays worker writes against a secondary Redis so a new instance
+// can be warmed before cutover. Writes are queued and applied by a single
+// goroutine; a full queue or a failed write is counted and dropped, never
+// surfaced to the worker.
+type mirror struct {
+	rdb  *redis.Client
+	ops  chan mirrorOp
+	done chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newMirror(rdb *redis.Client) *mirror {
+	m := &mirror{rdb: rdb, ops: make(chan mirrorOp, mirrorQueueSize), done: make(chan struct{})}
+	go m.run()
+	return m
+}
+
+func (m *mirror) run() {
+	defer close(m.done)
+	ctx := context.Background()
+	for op := range m.ops {
+		if err := op(ctx, m.rdb); err != nil {
+			secondaryWriteFailures.WithLabelValues("redis").Inc()
+			slog.Warn("secondary redis write failed", "err", err)
+		}
+	}
+}
+
+func (m *mirror) write(op mirrorOp) {
+	if m == nil {
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		secondaryWriteFailures.WithLabelValues("closed").Inc()
+		return
+	}
+	select {
+	case m.ops <- op:
+	default:
+		secondaryWriteFailures.WithLabelValues("queue_full").Inc()
+	}
+}
+
+// close stops accepting writes, gives the queued ones up to
+// mirrorFlushTimeout to reach the secondary and then closes its client.
+func (m *mirror) close() {
+	m.mu.Lock()
+	m.closed = true
+	close(m.ops)
+	m.mu.Unlock()
+
+	select {
+	case <-m.done:
+	case <-time.After(mirrorFlushTimeout):
+		slog.Warn("secondary writes not flushed before shutdown", "writes", len(m.ops))
+	}
+	_ = m.rdb.Close()
+}
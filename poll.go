@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const maxPollTimeout = 120 * time.Second
+
+// handlePoll is a long-poll variant of /analyze: it returns as soon as an
+// analysis of ?stream= with computedAtNano greater than ?sinceNano= is
+// available, or 204 once the timeout elapses so the client can simply poll
+// again. ?since= compares computedAt instead, whole seconds, and misses an
+// analysis computed in the same second as the previous one. Like
+// /stream, it hears of analyses computed by other replicas only with
+// BROADCAST=redis.
+func (s *Service) handlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	since, err := unixParam(q.Get("since"), 0)
+	if err != nil {
+		http.Error(w, "bad since: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sinceNano, err := unixParam(q.Get("sinceNano"), 0)
+	if err != nil {
+		http.Error(w, "bad sinceNano: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	newer := func(a Analysis) bool {
+		if sinceNano == 0 {
+			return a.ComputedAt > since
+		}
+		at := a.ComputedAtNano
+		if at == 0 {
+			// Stored before computedAtNano existed.
+			at = a.ComputedAt * int64(time.Second)
+		}
+		return at > sinceNano
+	}
+
+	timeout := s.cfg.PollTimeout
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "bad timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(d, maxPollTimeout)
+	}
+	s.extendWriteDeadline(w, timeout)
+	stream, err := s.streamParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sub := s.updates.subscribe(stream, 1)
+	defer s.updates.unsubscribe(sub)
+
+	val, err := s.redis().Get(s.ctx, s.streamKey(redisLastKey, stream)).Result()
+	if err != nil && err != redis.Nil {
+		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	samples := wantSamples(r)
+	if err == nil {
+		var anal Analysis
+		if json.Unmarshal([]byte(val), &anal) == nil && newer(anal) {
+			if !samples {
+				val = stripSamples(val)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(val))
+			return
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case anal := <-sub:
+			if !newer(anal) {
+				continue
+			}
+			if !samples {
+				anal.Samples = nil
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(anal)
+			return
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	queueChannel = "channel"
+	queueStream  = "stream"
+
+	redisStreamKey   = "metrics_stream"
+	streamGroup      = "analyzers"
+	streamReadCount  = 50
+	streamReadBlock  = 2 * time.Second
+	streamClaimEvery = 30 * time.Second
+	// streamBacklogEvery is how often the backlog of the group is measured
+	// and the acknowledged entries trimmed.
+	streamBacklogEvery = time.Second
+
+	// streamConsumerExpiry is how long a consumer with nothing pending may
+	// stay idle before it is removed from the group. Replicas get a new
+	// consumer name on every restart, and the group would otherwise keep
+	// the old ones forever.
+	streamConsumerExpiry = time.Hour
+)
+
+var errOverloaded = errors.New("queue is full")
+
+// enqueue hands m to the workers. In channel mode a full channel is handled
+// by policy (see sendFull): reject fails fast with errOverloaded, the
+// others make room, wait for it or spill. Backfill has a queue of its own,
+// backfillCh, which workers only take from while metricsCh is empty, so a
+// bulk load never delays live samples. With spill, metrics keep going to
+// the overflow list while it is not empty, so they are scored in the
+// order they came. In stream mode the metric is appended to
+// the Redis stream and survives a restart of this process; once the
+// backlog of the group reaches STREAM_MAXLEN, see waitStreamRoom.
+func (s *Service) enqueue(ctx context.Context, m Metric, policy string) error {
+	s.intakeMu.RLock()
+	defer s.intakeMu.RUnlock()
+	select {
+	case <-s.stopping:
+		return errShuttingDown
+	default:
+	}
+
+	if m.origin.id == "" {
+		m.origin = requestInfoFrom(ctx)
+	}
+
+	if s.cfg.Queue == queueStream {
+		if err := s.waitStreamRoom(ctx, policy); err != nil {
+			return err
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		values := map[string]any{"m": b, "backfill": strconv.FormatBool(m.backfill)}
+		if m.origin.id != "" {
+			values["rid"] = m.origin.id
+		}
+		if m.origin.traceID != "" {
+			values["trace"] = m.origin.traceID + "-" + m.origin.spanID
+		}
+		// No MAXLEN: trimming by length would delete entries the group has
+		// not acknowledged yet. trimStream trims what it has.
+		return s.redis().XAdd(ctx, &redis.XAddArgs{
+			Stream: s.key(redisStreamKey),
+			Values: values,
+		}).Err()
+	}
+
+	ch := s.metricsCh
+	if m.backfill {
+		ch = s.backfillCh
+	} else if policy == overloadSpill && s.spillLen.Load() > 0 {
+		return s.spillOverflow(ctx, m)
+	}
+	select {
+	case ch <- m:
+	default:
+		if err := s.sendFull(ctx, ch, m, policy); err != nil {
+			return err
+		}
+	}
+	s.reportQueueDepth()
+	return nil
+}
+
+// waitStreamRoom returns errOverloaded while the backlog of the group is at
+// STREAM_MAXLEN, unless policy waits: /bulk-load waits until the workers
+// catch up, block up to INGEST_BLOCK_TIMEOUT. Metrics already in the stream
+// are never dropped to make room, so drop_oldest and spill reject like
+// reject.
+func (s *Service) waitStreamRoom(ctx context.Context, policy string) error {
+	if s.streamBacklog.Load() < s.cfg.StreamMaxLen {
+		return nil
+	}
+	var timeout <-chan time.Time
+	switch policy {
+	case overloadWait:
+	case overloadBlock:
+		t := time.NewTimer(s.cfg.IngestBlockTimeout)
+		defer t.Stop()
+		timeout = t.C
+	default:
+		return errOverloaded
+	}
+	tick := time.NewTicker(streamBacklogEvery / 4)
+	defer tick.Stop()
+	for s.streamBacklog.Load() >= s.cfg.StreamMaxLen {
+		select {
+		case <-tick.C:
+		case <-timeout:
+			return errOverloaded
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopping:
+			return errShuttingDown
+		}
+	}
+	return nil
+}
+
+// streamBacklogLoop calls trimStream every streamBacklogEvery until the
+// service starts stopping.
+func (s *Service) streamBacklogLoop() {
+	t := time.NewTicker(streamBacklogEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-t.C:
+			s.trimStream()
+		}
+	}
+}
+
+// trimStream deletes the entries before the oldest one the group still
+// needs: the oldest pending entry or, with nothing pending, the last
+// delivered one. It then records the backlog, the entries not yet
+// acknowledged (undelivered plus pending), for waitStreamRoom and
+// ingest_queue_length. When Redis cannot tell the lag of the group, the
+// length of the trimmed stream stands in for it.
+func (s *Service) trimStream() {
+	rdb := s.redis()
+	key := s.key(redisStreamKey)
+	groups, err := rdb.XInfoGroups(s.ctx, key).Result()
+	if err != nil {
+		slog.Error("redis XINFO GROUPS failed", "err", err)
+		return
+	}
+	for _, g := range groups {
+		if g.Name != streamGroup {
+			continue
+		}
+		minID := g.LastDeliveredID
+		if g.Pending > 0 {
+			p, err := rdb.XPending(s.ctx, key, streamGroup).Result()
+			if err != nil {
+				slog.Error("redis XPENDING failed", "err", err)
+				return
+			}
+			minID = p.Lower
+		}
+		if minID != "" && minID != "0-0" {
+			if err := rdb.XTrimMinIDApprox(s.ctx, key, minID, 0).Err(); err != nil {
+				slog.Error("redis XTRIM failed", "err", err)
+			}
+		}
+		backlog := g.Lag + g.Pending
+		if g.Lag < 0 {
+			if backlog, err = rdb.XLen(s.ctx, key).Result(); err != nil {
+				slog.Error("redis XLEN failed", "err", err)
+				return
+			}
+		}
+		s.streamBacklog.Store(backlog)
+		queueLength.Set(float64(backlog))
+	}
+}
+
+func (s *Service) ensureStreamGroup() error {
+	err := s.redis().XGroupCreateMkStream(s.ctx, s.key(redisStreamKey), streamGroup, "0").Err()
+	if err != nil && !redis.HasErrorPrefix(err, "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// streamWorker consumes the metrics stream through the shared consumer
+// group and acknowledges each entry only after it has been processed, so a
+// crash leaves unacknowledged entries pending. Every streamClaimEvery the
+// worker also claims entries that have been pending on any consumer for
+// longer than StreamClaimIdle, which picks up work from crashed replicas.
+// Worker 0 then removes expired consumers.
+func (s *Service) streamWorker(id int) {
+	host, _ := os.Hostname()
+	consumer := fmt.Sprintf("%s-%d", host, id)
+	nextClaim := time.Now().Add(streamClaimEvery)
+	s.replayPending(id, consumer)
+
+	for {
+		select {
+		case <-s.stopping:
+			return
+		default:
+		}
+		s.redisGate.wait()
+		rdb := s.redisFor(id)
+
+		if time.Now().After(nextClaim) {
+			nextClaim = time.Now().Add(streamClaimEvery)
+			msgs, _, err := rdb.XAutoClaim(s.ctx, &redis.XAutoClaimArgs{
+				Stream:   s.key(redisStreamKey),
+				Group:    streamGroup,
+				Consumer: consumer,
+				MinIdle:  s.cfg.StreamClaimIdle,
+				Start:    "0-0",
+				Count:    streamReadCount,
+			}).Result()
+			if err != nil {
+				slog.Error("redis XAUTOCLAIM failed", "worker", id, "err", err)
+			} else if len(msgs) > 0 {
+				slog.Info("reclaimed pending stream entries", "worker", id, "entries", len(msgs))
+				s.processed.Add(int64(s.processStream(id, rdb, msgs)))
+			}
+			if id == 0 {
+				s.maintainStreamGroup(rdb)
+			}
+		}
+
+		streams, err := rdb.XReadGroup(s.ctx, &redis.XReadGroupArgs{
+			Group:    streamGroup,
+			Consumer: consumer,
+			Streams:  []string{s.key(redisStreamKey), ">"},
+			Count:    streamReadCount,
+			Block:    streamReadBlock,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			slog.Error("redis XREADGROUP failed", "worker", id, "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, st := range streams {
+			s.processed.Add(int64(s.processStream(id, rdb, st.Messages)))
+		}
+	}
+}
+
+// replayPending processes the entries this consumer read but never
+// acknowledged, which after a restart under the same name (a StatefulSet
+// pod, a container restarted in place) are the ones that were in flight
+// when the process died. Without it they would wait for STREAM_CLAIM_IDLE.
+func (s *Service) replayPending(id int, consumer string) {
+	rdb := s.redisFor(id)
+	start := "0"
+	for {
+		streams, err := rdb.XReadGroup(s.ctx, &redis.XReadGroupArgs{
+			Group:    streamGroup,
+			Consumer: consumer,
+			Streams:  []string{s.key(redisStreamKey), start},
+			Count:    streamReadCount,
+		}).Result()
+		if err != nil && err != redis.Nil {
+			slog.Error("redis XREADGROUP of pending entries failed", "worker", id, "err", err)
+			return
+		}
+		if len(streams) == 0 || len(streams[0].Messages) == 0 {
+			return
+		}
+		msgs := streams[0].Messages
+		slog.Info("replaying unacknowledged stream entries", "worker", id, "entries", len(msgs))
+		s.processed.Add(int64(s.processStream(id, rdb, msgs)))
+		// Entries that failed again stay pending for XAUTOCLAIM.
+		start = msgs[len(msgs)-1].ID
+	}
+}
+
+// maintainStreamGroup deletes consumers idle for longer than
+// streamConsumerExpiry that hold no pending entries.
+func (s *Service) maintainStreamGroup(rdb *redis.Client) {
+	key := s.key(redisStreamKey)
+	consumers, err := rdb.XInfoConsumers(s.ctx, key, streamGroup).Result()
+	if err != nil {
+		slog.Error("redis XINFO CONSUMERS failed", "err", err)
+		return
+	}
+	for _, c := range consumers {
+		if c.Pending > 0 || c.Idle < streamConsumerExpiry {
+			continue
+		}
+		if err := rdb.XGroupDelConsumer(s.ctx, key, streamGroup, c.Name).Err(); err != nil {
+			slog.Error("redis XGROUP DELCONSUMER failed", "consumer", c.Name, "err", err)
+			continue
+		}
+		slog.Info("removed idle stream consumer", "consumer", c.Name, "idle", c.Idle.Round(time.Second).String())
+	}
+}
+
+// processStream scores a batch of stream entries and acknowledges them. It
+// returns the number of metrics processed; on failure nothing is
+// acknowledged and the entries stay pending for a later claim.
+func (s *Service) processStream(id int, rdb *redis.Client, msgs []redis.XMessage) int {
+	batch := make([]Metric, 0, len(msgs))
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.ID)
+		raw, _ := msg.Values["m"].(string)
+		var m Metric
+		if err := json.Unmarshal([]byte(raw), &m); err != nil {
+			slog.Warn("dropping malformed stream entry", "worker", id, "entry", msg.ID, "err", err)
+			continue
+		}
+		m.backfill, _ = strconv.ParseBool(fmt.Sprint(msg.Values["backfill"]))
+		m.origin.id, _ = msg.Values["rid"].(string)
+		if trace, ok := msg.Values["trace"].(string); ok {
+			m.origin.traceID, m.origin.spanID, _ = strings.Cut(trace, "-")
+		}
+		batch = append(batch, m)
+	}
+
+	if len(batch) > 0 {
+		if err := s.processBatch(id, rdb, batch); err != nil {
+			slog.Error("batch failed, leaving entries pending", "worker", id, "entries", len(ids), "request_ids", batchRequestIDs(batch), "err", err)
+			return 0
+		}
+	}
+	if err := rdb.XAck(s.ctx, s.key(redisStreamKey), streamGroup, ids...).Err(); err != nil {
+		slog.Error("redis XACK failed", "worker", id, "request_ids", batchRequestIDs(batch), "err", err)
+	}
+	return len(batch)
+}
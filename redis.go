@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+var redisReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "redis_reconnect_attempts_total",
+	Help: "Attempts to rebuild the Redis client after persistent ping failures, by result",
+}, []string{"result"})
+
+// redisCloseGrace is how long a replaced client stays open for the commands
+// already running on it. It is longer than the go-redis read and write
+// timeouts, so those commands end on their own; the retries after it take
+// the new client.
+const redisCloseGrace = 10 * time.Second
+
+func init() {
+	prometheus.MustRegister(redisReconnects)
+	serviceRegistry.MustRegister(redisReconnects)
+}
+
+// newRedisClient builds a client for cfg. poolSize 0 keeps the go-redis
+// default pool; per-worker clients use a single dedicated connection.
+func newRedisClient(cfg Config, poolSize int) *redis.Client {
+	opts := &redis.Options{
+		Addr: cfg.RedisAddr,
+	}
+	if poolSize > 0 {
+		opts.PoolSize = poolSize
+		opts.MinIdleConns = poolSize
+	}
+	return redis.NewClient(opts)
+}
+
+func (s *Service) redis() *redis.Client {
+	s.rdbMu.RLock()
+	defer s.rdbMu.RUnlock()
+	return s.rdb
+}
+
+func (s *Service) redisFor(worker int) *redis.Client {
+	s.rdbMu.RLock()
+	defer s.rdbMu.RUnlock()
+	if worker < len(s.workerClients) {
+		return s.workerClients[worker]
+	}
+	return s.rdb
+}
+
+// superviseRedis pings the primary every RedisHealthInterval. While pings
+// fail the worker gate is closed, so samples stay queued in metricsCh
+// instead of failing against Redis and being dropped; the HTTP listener
+// keeps accepting until the channel fills. After RedisReconnectAfter
+// consecutive failures the clients are rebuilt from scratch. It returns
+// once the service starts stopping.
+func (s *Service) superviseRedis() {
+	ticker := time.NewTicker(s.cfg.RedisHealthInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, s.cfg.RedisHealthInterval)
+		err := s.redis().Ping(ctx).Err()
+		cancel()
+
+		if err == nil {
+			if failures > 0 {
+				slog.Info("redis ping ok, resuming workers", "failures", failures)
+			}
+			failures = 0
+			s.redisGate.open()
+			continue
+		}
+
+		failures++
+		s.redisGate.close()
+		slog.Warn("redis ping failed", "failures", failures, "err", err)
+		if failures%s.cfg.RedisReconnectAfter == 0 {
+			s.reconnectRedis()
+		}
+	}
+}
+
+// reconnectRedis replaces the primary and the per-worker clients once all
+// the new ones answer a ping. The old clients are closed redisCloseGrace
+// later rather than under the commands still running on them.
+func (s *Service) reconnectRedis() {
+	s.rdbMu.RLock()
+	workers := len(s.workerClients)
+	s.rdbMu.RUnlock()
+
+	fresh := []*redis.Client{newRedisClient(s.cfg, 0)}
+	for range workers {
+		fresh = append(fresh, newRedisClient(s.cfg, 1))
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.RedisHealthInterval)
+	var err error
+	for _, c := range fresh {
+		if err = c.Ping(ctx).Err(); err != nil {
+			break
+		}
+	}
+	cancel()
+	if err != nil {
+		for _, c := range fresh {
+			_ = c.Close()
+		}
+		redisReconnects.WithLabelValues("failed").Inc()
+		slog.Error("redis reconnect failed", "addr", s.cfg.RedisAddr, "err", err)
+		return
+	}
+
+	s.rdbMu.Lock()
+	old := append([]*redis.Client{s.rdb}, s.workerClients...)
+	s.rdb = fresh[0]
+	copy(s.workerClients, fresh[1:])
+	s.rdbMu.Unlock()
+
+	time.AfterFunc(redisCloseGrace, func() {
+		for _, c := range old {
+			_ = c.Close()
+		}
+	})
+	redisReconnects.WithLabelValues("ok").Inc()
+	slog.Info("redis reconnected", "addr", s.cfg.RedisAddr)
+}
+
+// gate blocks workers while it is closed. The zero value is open.
+type gate struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (g *gate) wait() {
+	g.mu.Lock()
+	ch := g.ch
+	g.mu.Unlock()
+	if ch != nil {
+		<-ch
+	}
+}
+
+func (g *gate) isOpen() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.ch == nil
+}
+
+func (g *gate) close() {
+	g.mu.Lock()
+	if g.ch == nil {
+		g.ch = make(chan struct{})
+	}
+	g.mu.Unlock()
+}
+
+func (g *gate) open() {
+	g.mu.Lock()
+	if g.ch != nil {
+		close(g.ch)
+		g.ch = nil
+	}
+	g.mu.Unlock()
+}
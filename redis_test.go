@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectRedis(t *testing.T) {
+	svc, mr := newTestService(t, "REDIS_PER_WORKER_CLIENT", "true", "WORKER_COUNT", "2")
+	if err := svc.StartWorkers(2); err != nil {
+		t.Fatal(err)
+	}
+	old, oldWorker := svc.redis(), svc.redisFor(0)
+
+	svc.reconnectRedis()
+	if svc.redis() == old || svc.redisFor(0) == oldWorker {
+		t.Fatal("clients were not replaced")
+	}
+	// Commands already holding the old clients must not fail with
+	// "redis: client is closed".
+	if err := old.Ping(svc.ctx).Err(); err != nil {
+		t.Errorf("old primary closed right after the swap: %v", err)
+	}
+	if err := oldWorker.Ping(svc.ctx).Err(); err != nil {
+		t.Errorf("old worker client closed right after the swap: %v", err)
+	}
+
+	// A reconnect whose clients cannot reach Redis keeps the current ones.
+	current := svc.redis()
+	mr.Close()
+	svc.reconnectRedis()
+	if svc.redis() != current {
+		t.Error("clients replaced by ones that failed their ping")
+	}
+}
+
+func TestSuperviseRedisStops(t *testing.T) {
+	svc, _ := newTestService(t, "REDIS_RECONNECT_AFTER", "1", "REDIS_HEALTH_INTERVAL", "10ms")
+	if err := svc.StartWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		svc.superviseRedis()
+		close(done)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	svc.Drain(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("superviseRedis still running after Drain")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	remoteTargetRPS = "rps"
+	remoteTargetCPU = "cpu"
+
+	maxRemoteWriteBody    = 16 << 20
+	maxRemoteWriteDecoded = 64 << 20
+)
+
+var remoteWriteSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "remote_write_samples_total",
+	Help: "Samples received over Prometheus remote_write by outcome",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(remoteWriteSamples)
+	serviceRegistry.MustRegister(remoteWriteSamples)
+}
+
+// parseRemoteWriteMap reads REMOTE_WRITE_MAP, a comma-separated list of
+// prometheus_series=target pairs. The target is rps, cpu or the name of a
+// series to put into the metric's values.
+func parseRemoteWriteMap(v string, pattern *regexp.Regexp) (map[string]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	targets := make(map[string]string)
+	for _, part := range strings.Split(v, ",") {
+		name, target, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" || target == "" {
+			return nil, fmt.Errorf("REMOTE_WRITE_MAP entry %q: want series=target", part)
+		}
+		if target != remoteTargetRPS && target != remoteTargetCPU {
+			if err := validateName(pattern, target, errInvalidSeries); err != nil {
+				return nil, fmt.Errorf("REMOTE_WRITE_MAP entry %q: %w", part, err)
+			}
+		}
+		if prev, ok := targets[target]; ok {
+			return nil, fmt.Errorf("REMOTE_WRITE_MAP: %s and %s both map to %s", prev, name, target)
+		}
+		if _, ok := m[name]; ok {
+			return nil, fmt.Errorf("REMOTE_WRITE_MAP: %s is mapped twice", name)
+		}
+		m[name] = target
+		targets[target] = name
+	}
+	if _, ok := targets[remoteTargetRPS]; !ok {
+		return nil, errors.New("REMOTE_WRITE_MAP must map a series to rps")
+	}
+	return m, nil
+}
+
+type promSample struct {
+	value float64
+	ts    int64 // milliseconds
+}
+
+type promSeries struct {
+	name, stream string
+	samples      []promSample
+}
+
+// decodeWriteRequest reads the series of a remote_write WriteRequest,
+// keeping only the metric name and the stream label of each. Exemplars,
+// histograms and metadata are skipped.
+func decodeWriteRequest(b []byte, streamLabel string) ([]promSeries, error) {
+	var out []promSeries
+	err := eachField(b, func(num protowire.Number, v []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var ps promSeries
+		err := eachField(v, func(num protowire.Number, v []byte) error {
+			switch num {
+			case 1:
+				var name, value string
+				err := eachField(v, func(num protowire.Number, v []byte) error {
+					switch num {
+					case 1:
+						name = string(v)
+					case 2:
+						value = string(v)
+					}
+					return nil
+				})
+				if name == "__name__" {
+					ps.name = value
+				} else if streamLabel != "" && name == streamLabel {
+					ps.stream = value
+				}
+				return err
+			case 2:
+				s, err := decodeSample(v)
+				ps.samples = append(ps.samples, s)
+				return err
+			}
+			return nil
+		})
+		out = append(out, ps)
+		return err
+	})
+	return out, err
+}
+
+func decodeSample(b []byte) (promSample, error) {
+	var s promSample
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return s, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return s, protowire.ParseError(n)
+			}
+			s.value = math.Float64frombits(v)
+			b = b[n:]
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return s, protowire.ParseError(n)
+			}
+			s.ts = int64(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return s, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return s, nil
+}
+
+// eachField calls fn with every length-delimited field of a message and
+// skips the others.
+func eachField(b []byte, fn func(protowire.Number, []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := fn(num, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// remoteLatest is the newest CPU and named series values received over
+// remote_write for one stream. Prometheus shards series across requests, so
+// the CPU of a sample rarely arrives together with its RPS.
+type remoteLatest struct {
+	cpu    float64
+	values map[string]float64
+}
+
+type remoteState struct {
+	mu     sync.Mutex
+	latest map[string]*remoteLatest
+}
+
+// remoteMetrics turns the mapped series of a request into metrics: every
+// RPS sample becomes one metric carrying the newest CPU and series values
+// received for its stream at or before its timestamp. A stale marker (NaN)
+// clears the value.
+func (s *Service) remoteMetrics(series []promSeries) (metrics []Metric, ignored, rejected int) {
+	type point struct {
+		target string
+		promSample
+	}
+	byStream := make(map[string][]point)
+	for _, ps := range series {
+		target, ok := s.cfg.RemoteWriteMap[ps.name]
+		if !ok {
+			ignored += len(ps.samples)
+			continue
+		}
+		stream := ps.stream
+		if stream == "" {
+			stream = defaultStream
+		}
+		if s.validateStreamName(stream) != nil || s.streams.admit(stream) != nil {
+			rejected += len(ps.samples)
+			continue
+		}
+		for _, smp := range ps.samples {
+			byStream[stream] = append(byStream[stream], point{target, smp})
+		}
+	}
+
+	streams := make([]string, 0, len(byStream))
+	for stream := range byStream {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+
+	s.remote.mu.Lock()
+	defer s.remote.mu.Unlock()
+	for _, stream := range streams {
+		points := byStream[stream]
+		// Apply CPU and series values before an RPS sample with the same
+		// timestamp.
+		sort.SliceStable(points, func(i, j int) bool {
+			if points[i].ts != points[j].ts {
+				return points[i].ts < points[j].ts
+			}
+			return points[i].target != remoteTargetRPS && points[j].target == remoteTargetRPS
+		})
+		last := s.remote.latest[stream]
+		if last == nil {
+			last = &remoteLatest{values: make(map[string]float64)}
+			s.remote.latest[stream] = last
+		}
+		for _, p := range points {
+			stale := math.IsNaN(p.value)
+			switch p.target {
+			case remoteTargetRPS:
+				if stale {
+					continue
+				}
+				m := Metric{Timestamp: p.ts / 1000, RPS: p.value, CPU: last.cpu, Stream: stream}
+				if len(last.values) > 0 {
+					m.Values = maps.Clone(last.values)
+				}
+				metrics = append(metrics, m)
+			case remoteTargetCPU:
+				if stale {
+					last.cpu = 0
+				} else {
+					last.cpu = p.value
+				}
+			default:
+				if stale {
+					delete(last.values, p.target)
+				} else {
+					last.values[p.target] = p.value
+				}
+			}
+		}
+	}
+	return metrics, ignored, rejected
+}
+
+// handleRemoteWrite accepts Prometheus remote_write (protocol 1.0:
+// snappy-compressed protobuf WriteRequest) and queues the series mapped by
+// REMOTE_WRITE_MAP as metrics. Prometheus retries 5xx responses and drops
+// the request on 4xx, so only a full queue answers 503; samples already
+// queued from that request are then queued again by the retry.
+func (s *Service) handleRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.cfg.RemoteWriteMap) == 0 {
+		http.Error(w, "remote_write is disabled: set REMOTE_WRITE_MAP", http.StatusConflict)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); strings.Contains(ct, "proto=io.prometheus.write.v2") {
+		http.Error(w, "only remote_write 1.0 (prometheus.WriteRequest) is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteWriteBody))
+	if err != nil {
+		writeBodyError(w, "read body", err)
+		return
+	}
+	if n, err := snappy.DecodedLen(compressed); err != nil || n > maxRemoteWriteDecoded {
+		http.Error(w, "bad snappy payload", http.StatusBadRequest)
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, "snappy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(raw, s.cfg.RemoteWriteStreamLabel)
+	if err != nil {
+		http.Error(w, "protobuf: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics, ignored, rejected := s.remoteMetrics(series)
+	remoteWriteSamples.WithLabelValues("ignored").Add(float64(ignored))
+
+	accepted := 0
+	defer func() {
+		remoteWriteSamples.WithLabelValues("accepted").Add(float64(accepted))
+		remoteWriteSamples.WithLabelValues("rejected").Add(float64(rejected))
+		ingestTotal.Add(float64(accepted))
+	}()
+	for i, m := range metrics {
+		if err := s.validateMetric(m, false); err != nil {
+			rejected++
+			continue
+		}
+		if err := s.admitStream(&m); err != nil {
+			rejected++
+			continue
+		}
+		if err := s.enqueue(r.Context(), m, s.cfg.OverloadPolicy); err != nil {
+			switch {
+			case errors.Is(err, errOverloaded):
+				ingestOverloaded.Add(float64(len(metrics) - i))
+				s.writeOverloaded(w)
+			case errors.Is(err, errShuttingDown):
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			default:
+				http.Error(w, "queue error: "+err.Error(), http.StatusServiceUnavailable)
+			}
+			return
+		}
+		accepted++
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
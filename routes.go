@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type route struct {
+	path    string
+	handler http.Handler
+}
+
+func (s *Service) routes() []route {
+	return []route{
+		{"/ingest", s.protect(http.HandlerFunc(s.handleIngest))},
+		{"/ingest/batch", s.protect(http.HandlerFunc(s.handleIngestBatch))},
+		{"/analyze", http.HandlerFunc(s.handleAnalyze)},
+		{"/analyze/all", http.HandlerFunc(s.handleAnalyzeAll)},
+		{"/analyze/poll", http.HandlerFunc(s.handlePoll)},
+		{"/stream", http.HandlerFunc(s.handleStream)},
+		{"/analyze/stream", http.HandlerFunc(s.handleStream)},
+		{"/analyze/schema", http.HandlerFunc(s.handleAnalyzeSchema)},
+		{"/anomalies", http.HandlerFunc(s.handleAnomalies)},
+		{"/sources", http.HandlerFunc(s.handleSources)},
+		{"/window", http.HandlerFunc(s.handleWindow)},
+		{"/window/histogram", http.HandlerFunc(s.handleWindowHistogram)},
+		{"/bulk-load", s.protect(http.HandlerFunc(s.handleBulkLoad))},
+		{"/api/v1/write", s.protect(http.HandlerFunc(s.handleRemoteWrite))},
+		{"/deadletter/replay", s.protectAdmin(http.HandlerFunc(s.handleDeadLetterReplay))},
+		{"/metric", http.HandlerFunc(s.handleMetric)},
+		{"/metrics/history", http.HandlerFunc(s.handleMetricHistory)},
+		{"/config", http.HandlerFunc(s.handleConfig)},
+		{"/admin/config", s.protectAdmin(http.HandlerFunc(s.handleAdminConfig))},
+		{"/admin/sources", s.protectAdmin(http.HandlerFunc(s.handleAdminSources))},
+		{"/healthz", http.HandlerFunc(s.handleHealthz)},
+		{"/readyz", http.HandlerFunc(s.handleReadyz)},
+		{"/status", http.HandlerFunc(s.handleStatus)},
+	}
+}
+
+func (s *Service) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	var paths []string
+	register := func(path string, h http.Handler) {
+		mux.Handle(path, h)
+		paths = append(paths, path)
+	}
+
+	for _, rt := range s.routes() {
+		register(s.cfg.HTTPPathPrefix+rt.path, rt.handler)
+	}
+
+	metricsPath := "/metrics"
+	if s.cfg.PrefixMetrics {
+		metricsPath = s.cfg.HTTPPathPrefix + metricsPath
+	}
+	register(metricsPath, promhttp.Handler())
+	slog.Info("routes registered", "paths", paths)
+
+	return mux
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+type fieldSchema struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description"`
+	Optional    bool   `json:"optional,omitempty"`
+}
+
+var analysisSchema = sync.OnceValue(func() []fieldSchema {
+	return describeStruct(reflect.TypeFor[Analysis](), "")
+})
+
+// describeStruct builds the schema from the json, unit and desc struct tags,
+// so the description cannot drift from the fields actually serialized.
+// Nested structs are flattened with dotted names; the values of a map of
+// structs are listed under "name.*.".
+func describeStruct(t reflect.Type, prefix string) []fieldSchema {
+	var out []fieldSchema
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		name = prefix + name
+
+		ft := f.Type
+		optional := strings.Contains(opts, "omitempty")
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+			optional = true
+		}
+
+		out = append(out, fieldSchema{
+			Name:        name,
+			Type:        jsonType(ft),
+			Unit:        f.Tag.Get("unit"),
+			Description: f.Tag.Get("desc"),
+			Optional:    optional,
+		})
+		switch {
+		case ft.Kind() == reflect.Struct:
+			out = append(out, describeStruct(ft, name+".")...)
+		case ft.Kind() == reflect.Map && ft.Elem().Kind() == reflect.Struct:
+			out = append(out, describeStruct(ft.Elem(), name+".*.")...)
+		}
+	}
+	return out
+}
+
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func (s *Service) handleAnalyzeSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(analysisSchema())
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	_ "time/tzdata" // SEASONAL_TIMEZONE must resolve in the alpine image
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	detectorSeasonal = "seasonal"
+
+	seasonDay  = "day"
+	seasonWeek = "week"
+
+	redisSeasonalKey = "seasonal_state"
+)
+
+// SeasonInfo identifies the seasonal bucket a sample was compared against.
+type SeasonInfo struct {
+	Period string `json:"period" msgpack:"period" desc:"seasonal period: day (24 hourly buckets) or week (168)"`
+	Bucket int    `json:"bucket" msgpack:"bucket" desc:"hour of the day, or hour of the week counted from Monday 00:00, in SEASONAL_TIMEZONE"`
+}
+
+// seasonBucket is the seasonal baseline of one signal for one hour of the
+// day or week. Samples of the hour in progress are collected separately
+// (Welford's mean and M2) and folded into the baseline once a sample from a
+// later occurrence of the same hour arrives, so a sample is only ever
+// compared with earlier days or weeks, never with the traffic around it.
+type seasonBucket struct {
+	Periods int
+	ewma
+
+	Cur     int64
+	N       int
+	CurMean float64
+	CurM2   float64
+}
+
+var seasonFields = [...]string{"periods", "mean", "var", "cur", "n", "cur_mean", "cur_m2"}
+
+// roll closes the collected occurrence if hour starts a new one. The
+// baseline follows the occurrences with weight alpha on the newest, and its
+// variance is that of the mixture, so it spans both the spread within an
+// hour and the drift between days.
+func (b *seasonBucket) roll(hour int64, alpha float64) {
+	if b.N == 0 || b.Cur == hour {
+		return
+	}
+	m, v := b.CurMean, b.CurM2/float64(b.N)
+	if b.Periods == 0 {
+		b.Mean, b.Var = m, v
+	} else {
+		d := m - b.Mean
+		b.Mean += alpha * d
+		b.Var = (1-alpha)*b.Var + alpha*v + alpha*(1-alpha)*d*d
+	}
+	b.Periods++
+	b.N, b.CurMean, b.CurM2 = 0, 0, 0
+}
+
+func (b *seasonBucket) add(x float64, hour int64) {
+	b.Cur = hour
+	b.N++
+	d := x - b.CurMean
+	b.CurMean += d / float64(b.N)
+	b.CurM2 += d * (x - b.CurMean)
+}
+
+func (b *seasonBucket) stats(x float64) (mean, stddev, z float64) {
+	if b.Periods == 0 {
+		return 0, 0, 0
+	}
+	stddev = math.Sqrt(b.Var)
+	return b.Mean, stddev, zScore(x, b.Mean, stddev, 2)
+}
+
+// season returns the bucket of ts and the start of its hour.
+func (s *Service) season(ts int64) (bucket int, hour int64) {
+	t := time.Unix(ts, 0).In(s.cfg.SeasonalLocation)
+	bucket = t.Hour()
+	if s.cfg.SeasonalPeriod == seasonWeek {
+		bucket += 24 * ((int(t.Weekday()) + 6) % 7)
+	}
+	return bucket, time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Unix()
+}
+
+// seasonalState holds the buckets a batch touches, by signal ("rps", "cpu"
+// or "series:<name>") and bucket, as "<signal>:<bucket>".
+type seasonalState map[string]*seasonBucket
+
+func seasonID(signal string, bucket int) string {
+	return signal + ":" + strconv.Itoa(bucket)
+}
+
+func (st seasonalState) fieldNames() []string {
+	names := make([]string, 0, len(st)*len(seasonFields))
+	for id := range st {
+		for _, f := range seasonFields {
+			names = append(names, id+":"+f)
+		}
+	}
+	return names
+}
+
+func (st seasonalState) load(names []string, vals []any) {
+	num := func(v any) float64 {
+		f, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+		if v == nil || err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0
+		}
+		return f
+	}
+	for i := 0; i < len(names); i += len(seasonFields) {
+		id := names[i][:len(names[i])-len(seasonFields[0])-1]
+		v := vals[i : i+len(seasonFields)]
+		*st[id] = seasonBucket{
+			Periods: int(num(v[0])),
+			ewma:    ewma{Mean: num(v[1]), Var: num(v[2])},
+			Cur:     int64(num(v[3])),
+			N:       int(num(v[4])),
+			CurMean: num(v[5]),
+			CurM2:   num(v[6]),
+		}
+	}
+}
+
+func (st seasonalState) fields() map[string]any {
+	m := make(map[string]any, len(st)*len(seasonFields))
+	for id, b := range st {
+		for i, v := range []any{b.Periods, b.Mean, b.Var, b.Cur, b.N, b.CurMean, b.CurM2} {
+			m[id+":"+seasonFields[i]] = v
+		}
+	}
+	return m
+}
+
+// scoreSeasonal scores each sample against the baseline of its hour of the
+// day or week and then collects it into that hour. Only the buckets the
+// batch touches are read and written, under WATCH as with the EWMA state.
+// RPS, CPU and every named series have their own buckets.
+func (s *Service) scoreSeasonal(rdb *redis.Client, stream string, batch []Metric, values []float64, pushes []windowPush) ([]Analysis, error) {
+	key := s.streamKey(redisSeasonalKey, stream)
+	buckets := make([]int, len(batch))
+	hours := make([]int64, len(batch))
+	st := make(seasonalState)
+	touch := func(signal string, bucket int) {
+		if id := seasonID(signal, bucket); st[id] == nil {
+			st[id] = &seasonBucket{}
+		}
+	}
+	for i, m := range batch {
+		buckets[i], hours[i] = s.season(m.Timestamp)
+		touch("rps", buckets[i])
+		touch("cpu", buckets[i])
+		for name := range m.Values {
+			touch("series:"+name, buckets[i])
+		}
+	}
+	names := st.fieldNames()
+	anals := make([]Analysis, len(batch))
+
+	txf := func(tx *redis.Tx) error {
+		vals, err := tx.HMGet(s.ctx, key, names...).Result()
+		if err != nil {
+			return err
+		}
+		st.load(names, vals)
+		for i, m := range batch {
+			anals[i] = s.analyzeSeasonal(m, values[i], buckets[i], hours[i], st)
+		}
+		_, err = tx.TxPipelined(s.ctx, func(p redis.Pipeliner) error {
+			p.HSet(s.ctx, key, st.fields())
+			s.appendWindows(s.ctx, p, pushes)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for range ewmaTxAttempts {
+		err = rdb.Watch(s.ctx, txf, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis seasonal %s: %w", key, err)
+	}
+
+	fields := st.fields()
+	s.secondary.write(func(ctx context.Context, c redis.Cmdable) error {
+		_, err := c.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.HSet(ctx, key, fields)
+			s.appendWindows(ctx, p, pushes)
+			return nil
+		})
+		return err
+	})
+	return anals, nil
+}
+
+// analyzeSeasonal scores one sample and collects its values into their
+// buckets.
+func (s *Service) analyzeSeasonal(m Metric, value float64, bucket int, hour int64, st seasonalState) Analysis {
+	next := func(signal string, x float64) (*seasonBucket, float64, float64, float64) {
+		b := st[seasonID(signal, bucket)]
+		b.roll(hour, s.cfg.SeasonalAlpha)
+		mean, stddev, z := b.stats(x)
+		b.add(x, hour)
+		return b, mean, stddev, z
+	}
+
+	rb, mean, stddev, z := next("rps", value)
+	_, cpuMean, cpuStdDev, cpuZ := next("cpu", m.CPU)
+	anal := Analysis{
+		Detector:        detectorSeasonal,
+		Count:           rb.Periods,
+		RollingAvg:      mean,
+		StdDev:          stddev,
+		ZScore:          z,
+		ThresholdPct:    s.cfg.PercentThreshold,
+		LastRPS:         m.RPS,
+		LastCPU:         m.CPU,
+		LastTs:          m.Timestamp,
+		ComputedAt:      time.Now().Unix(),
+		SmoothingWindow: s.cfg.SmoothingWindow,
+		RollingAvgCPU:   cpuMean,
+		StdDevCPU:       cpuStdDev,
+		ZScoreCPU:       cpuZ,
+		Season:          &SeasonInfo{Period: s.cfg.SeasonalPeriod, Bucket: bucket},
+	}
+	if rb.Periods > 0 {
+		anal.PercentDev = percentDeviation(value, mean)
+	}
+	if s.cfg.SmoothingWindow > 1 {
+		anal.SmoothedRPS = value
+	}
+	for name, v := range m.Values {
+		b, mean, stddev, z := next("series:"+name, v)
+		setSeries(&anal, name, SeriesResult{
+			Value:      v,
+			Count:      b.Periods,
+			RollingAvg: mean,
+			StdDev:     stddev,
+			ZScore:     z,
+		})
+	}
+	s.rescoreBaseline(&anal, s.tuning().ZThreshold)
+	return anal
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// redisSeriesWindowKey is the window of a named series, suffixed with
+	// the stream (unless default) and the series name.
+	redisSeriesWindowKey = "series_window"
+
+	defaultMaxSeries = 10
+
+	reasonSeries = "series_zscore"
+)
+
+var (
+	errInvalidSeries = errors.New("invalid series name")
+	errSeriesLimit   = errors.New("series limit reached")
+)
+
+var (
+	seriesRollingAvg = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "series_rolling_avg",
+		Help: "Current baseline mean of a named series by stream",
+	}, []string{"stream", "series"})
+	seriesAnomaly = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "series_anomaly",
+		Help: "Anomaly flag as 0/1 of the latest value of a named series by stream",
+	}, []string{"stream", "series"})
+)
+
+func init() {
+	prometheus.MustRegister(seriesRollingAvg, seriesAnomaly)
+	serviceRegistry.MustRegister(seriesRollingAvg, seriesAnomaly)
+}
+
+// SeriesResult is the analysis of one named series of a metric. Each series
+// has its own window (or EWMA baseline) and is scored like CPU.
+type SeriesResult struct {
+	Value      float64 `json:"value" msgpack:"value" desc:"latest value of the series"`
+	Count      int     `json:"count" msgpack:"count" desc:"number of values in the series window, seen by its EWMA baseline, or past occurrences of its seasonal bucket"`
+	RollingAvg float64 `json:"rollingAvg" msgpack:"rollingAvg" desc:"baseline mean of the series"`
+	StdDev     float64 `json:"stdDev" msgpack:"stdDev" desc:"baseline standard deviation of the series"`
+	ZScore     float64 `json:"zScore" msgpack:"zScore" unit:"dimensionless" desc:"distance of the latest value from the mean in standard deviations"`
+	IsAnomaly  bool    `json:"isAnomaly" msgpack:"isAnomaly" desc:"true if the latest value is beyond the z-score threshold"`
+}
+
+func newSeriesSet(max int) *nameSet {
+	return &nameSet{max: max, names: make(map[string]struct{}), noun: "series", errLimit: errSeriesLimit}
+}
+
+func (s *Service) seriesKey(stream, name string) string {
+	return s.streamKey(redisSeriesWindowKey, stream) + ":" + name
+}
+
+// seriesPoints are the values of one named series in a batch, oldest first,
+// with the index of the metric each came from. Metrics without the series
+// are skipped, so its window only advances when a value is sent.
+type seriesPoints struct {
+	name   string
+	idx    []int
+	values []float64
+}
+
+// collectSeries groups the named values of a batch by series, sorted by
+// name.
+func collectSeries(batch []Metric) []seriesPoints {
+	pos := make(map[string]int)
+	var out []seriesPoints
+	for i, m := range batch {
+		for name, v := range m.Values {
+			j, ok := pos[name]
+			if !ok {
+				j = len(out)
+				pos[name] = j
+				out = append(out, seriesPoints{name: name})
+			}
+			out[j].idx = append(out[j].idx, i)
+			out[j].values = append(out[j].values, v)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].name < out[b].name })
+	return out
+}
+
+// setSeries records the result of a series on an analysis.
+func setSeries(anal *Analysis, name string, r SeriesResult) {
+	if anal.Series == nil {
+		anal.Series = make(map[string]SeriesResult)
+	}
+	anal.Series[name] = r
+}
+
+func (s *Service) seriesResult(value float64, nums []float64) SeriesResult {
+	mean, stddev := s.baseline(nums)
+	return SeriesResult{
+		Value:      value,
+		Count:      len(nums),
+		RollingAvg: mean,
+		StdDev:     stddev,
+		ZScore:     zScore(value, mean, stddev, len(nums)),
+	}
+}
+
+// flagSeries applies the z threshold to every series of an analysis. A
+// series anomaly only sets the reason when no other rule fired. With the
+// EWMA and seasonal detectors a series is not flagged before its own
+// warm-up.
+func (s *Service) flagSeries(anal *Analysis, threshold float64) {
+	for name, r := range anal.Series {
+		warm := r.Count >= s.warmup()
+		r.IsAnomaly = warm && math.Abs(r.ZScore) > threshold
+		anal.Series[name] = r
+		if r.IsAnomaly && anal.Reason == "" {
+			anal.Reason = reasonSeries
+		}
+	}
+	anal.IsAnomaly = anal.Reason != ""
+}
+
+func observeSeries(m Metric, anal Analysis) {
+	for name, r := range anal.Series {
+		seriesRollingAvg.WithLabelValues(anal.Stream, name).Set(r.RollingAvg)
+		if m.backfill {
+			continue
+		}
+		if r.IsAnomaly {
+			seriesAnomaly.WithLabelValues(anal.Stream, name).Set(1)
+		} else {
+			seriesAnomaly.WithLabelValues(anal.Stream, name).Set(0)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	defaultHTTPMaxBodyBytes = 10 << 20
+	maxHTTPHeaderBytes      = 16 << 20
+)
+
+// newHTTPServer returns the HTTP server for handler with the timeouts and
+// limits of cfg. It serves TLS when tlsConfig, from loadTLSConfig, is not
+// nil.
+func newHTTPServer(cfg Config, tlsConfig *tls.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:           cfg.ListenAddr,
+		Handler:        handler,
+		ReadTimeout:    cfg.HTTPReadTimeout,
+		WriteTimeout:   cfg.HTTPWriteTimeout,
+		IdleTimeout:    cfg.HTTPIdleTimeout,
+		MaxHeaderBytes: cfg.HTTPMaxHeaderBytes,
+		// TLS handshake failures and handler panics, logged like the rest.
+		ErrorLog:  slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		TLSConfig: tlsConfig,
+	}
+}
+
+// loadTLSConfig returns the TLS settings shared by the HTTP and gRPC
+// servers, or nil when TLS_CERT_FILE is not set. The certificate and client
+// CA are read here, once: rotating them takes a restart.
+func loadTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS_CERT_FILE/TLS_KEY_FILE: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if cfg.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read TLS_CLIENT_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE %s: no PEM certificates", cfg.TLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// serveHTTP runs server until it is shut down, over TLS when it has a
+// TLSConfig.
+func serveHTTP(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// limitBody caps request bodies at HTTP_MAX_BODY_BYTES. /bulk-load is
+// exempt: it streams the file line by line and is meant for uploads larger
+// than any sensible limit for the other endpoints.
+func (s *Service) limitBody(next http.Handler) http.Handler {
+	if s.cfg.HTTPMaxBodyBytes == 0 {
+		return next
+	}
+	bulkLoad := s.cfg.HTTPPathPrefix + "/bulk-load"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != bulkLoad {
+			r.Body = http.MaxBytesReader(w, r.Body, s.cfg.HTTPMaxBodyBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeBodyError answers 413 when err is a body over its limit, and 400
+// with msg and err otherwise.
+func writeBodyError(w http.ResponseWriter, msg string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("request body too large: limit is %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, msg+": "+err.Error(), http.StatusBadRequest)
+}
+
+// extendWriteDeadline gives a long-lived response d beyond HTTP_WRITE_TIMEOUT,
+// or no deadline at all when d is 0. Without HTTP_WRITE_TIMEOUT there is no
+// deadline to extend.
+func (s *Service) extendWriteDeadline(w http.ResponseWriter, d time.Duration) {
+	if s.cfg.HTTPWriteTimeout == 0 {
+		return
+	}
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d + s.cfg.HTTPWriteTimeout)
+	}
+	_ = http.NewResponseController(w).SetWriteDeadline(deadline)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Severity levels of an anomaly, lowest first.
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+
+	defaultSeverityWarningZ  = 3.0
+	defaultSeverityCriticalZ = 5.0
+)
+
+var anomalySeverityTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "anomalies_by_severity_total",
+	Help: "Total detected anomalies by severity: info, warning or critical",
+}, []string{"severity"})
+
+func init() {
+	prometheus.MustRegister(anomalySeverityTotal)
+	serviceRegistry.MustRegister(anomalySeverityTotal)
+}
+
+// severityRank orders severities for comparison; "" (no anomaly) is lowest.
+func severityRank(severity string) int {
+	switch severity {
+	case severityInfo:
+		return 1
+	case severityWarning:
+		return 2
+	case severityCritical:
+		return 3
+	}
+	return 0
+}
+
+// grade sets the severity of an anomalous analysis from the largest
+// absolute z-score among the RPS score and the CPU and series scores that
+// were flagged: critical from SEVERITY_CRITICAL_Z, warning from
+// SEVERITY_WARNING_Z, info below. Every rule that fires, including the
+// percent deviation and joint patterns, gets a severity this way; an
+// anomaly with a small z-score is a blip whatever the rule.
+func (s *Service) grade(anal *Analysis) {
+	anal.Severity = ""
+	if !anal.IsAnomaly {
+		return
+	}
+	z := math.Abs(anal.ZScore)
+	if anal.IsAnomalyCPU {
+		z = max(z, math.Abs(anal.ZScoreCPU))
+	}
+	for _, r := range anal.Series {
+		if r.IsAnomaly {
+			z = max(z, math.Abs(r.ZScore))
+		}
+	}
+	switch {
+	case z >= s.cfg.SeverityCriticalZ:
+		anal.Severity = severityCritical
+	case z >= s.cfg.SeverityWarningZ:
+		anal.Severity = severityWarning
+	default:
+		anal.Severity = severityInfo
+	}
+}
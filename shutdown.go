@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	redisReplayKey     = "metrics_replay"
+	shutdownAbortGrace = 2 * time.Second
+)
+
+var errShuttingDown = errors.New("shutting down")
+
+var ingestReplayed = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "ingest_replayed_total",
+	Help: "Metrics flushed to metrics_replay at a shutdown and queued again at a start",
+})
+
+func init() {
+	prometheus.MustRegister(ingestReplayed)
+	serviceRegistry.MustRegister(ingestReplayed)
+}
+
+// Drain stops intake, closes metricsCh and waits up to timeout for the
+// workers to process what is left. If the deadline passes, workers stop
+// scoring and the remaining queued samples are written as raw JSON to the
+// metrics_replay list in one round trip instead, so shutdown stays bounded
+// without losing them; replayLoop queues them again at the next start. Queued alerts get up to alertFlushTimeout to be
+// delivered and in-memory windows get a final snapshot. It returns how
+// many samples were fully processed during the drain and how many were
+// flushed for replay.
+func (s *Service) Drain(timeout time.Duration) (processed, flushed int) {
+	before := s.processed.Load()
+
+	close(s.stopping)
+	s.intakeMu.Lock()
+	close(s.metricsCh)
+	close(s.backfillCh)
+	s.intakeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.workersWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn("drain deadline exceeded, flushing the rest for replay", "timeout", timeout.String())
+		s.aborted.Store(true)
+		s.redisGate.open()
+		select {
+		case <-done:
+		case <-time.After(shutdownAbortGrace):
+			slog.Warn("workers still busy after abort, continuing")
+		}
+	}
+
+	processed = int(s.processed.Load() - before)
+	s.alerts.close(alertFlushTimeout)
+	s.snapshotWindows()
+
+	s.spillMu.Lock()
+	spilled := s.spilled
+	s.spilled = nil
+	s.spillMu.Unlock()
+	if len(spilled) == 0 {
+		return processed, 0
+	}
+
+	args := make([]any, len(spilled))
+	for i, m := range spilled {
+		b, _ := json.Marshal(m)
+		args[i] = b
+	}
+	if err := s.redis().RPush(s.ctx, s.key(redisReplayKey), args...).Err(); err != nil {
+		slog.Error("redis RPUSH failed, samples lost", "key", s.key(redisReplayKey), "samples", len(spilled), "err", err)
+		return processed, 0
+	}
+	return processed, len(spilled)
+}
+
+// spill takes batch and everything still in the closed metricsCh and
+// backfillCh out of the worker pipeline so Drain can flush it. Only called
+// once aborted is set.
+func (s *Service) spill(batch []Metric) {
+	s.spillMu.Lock()
+	defer s.spillMu.Unlock()
+	s.spilled = append(s.spilled, batch...)
+	for m := range s.metricsCh {
+		s.spilled = append(s.spilled, m)
+	}
+	for m := range s.backfillCh {
+		s.spilled = append(s.spilled, m)
+	}
+}
+
+// replayLoop moves the metrics that a shutdown flushed to metrics_replay
+// back into metricsCh as workers make room, like refillLoop does for the
+// overflow list, and returns once the list is empty or the service starts
+// stopping. Any replica with the same REDIS_KEY_PREFIX may take them.
+func (s *Service) replayLoop() {
+	key := s.key(redisReplayKey)
+	n, err := s.redis().LLen(s.ctx, key).Result()
+	if err != nil {
+		slog.Error("redis LLEN failed", "key", key, "err", err)
+	}
+	if n == 0 {
+		return
+	}
+	slog.Info("replaying metrics flushed at shutdown", "key", key, "samples", n)
+
+	t := time.NewTicker(spillRefillEvery)
+	defer t.Stop()
+	replayed := 0
+	for {
+		moved, _ := s.refillFrom(key)
+		ingestReplayed.Add(float64(moved))
+		replayed += moved
+		if n, err := s.redis().LLen(s.ctx, key).Result(); err == nil && n == 0 {
+			slog.Info("metrics flushed at shutdown replayed", "key", key, "samples", replayed)
+			return
+		}
+		select {
+		case <-s.stopping:
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestReplayFlushed checks that metrics a shutdown flushed to
+// metrics_replay are processed after the next start, also when there are
+// more of them than the queue holds.
+func TestReplayFlushed(t *testing.T) {
+	svc, mr := newTestService(t, "CHANNEL_CAPACITY", "5", "WORKER_COUNT", "1")
+	const n = 20
+	now := time.Now().Unix()
+	for i := range n {
+		b, _ := json.Marshal(Metric{Timestamp: now, CPU: 1, RPS: float64(i), Stream: defaultStream})
+		mr.RPush(svc.key(redisReplayKey), string(b))
+	}
+	if err := svc.StartWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for svc.processed.Load() < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := svc.processed.Load(); got != n {
+		t.Fatalf("processed %d, want %d", got, n)
+	}
+	if mr.Exists(svc.key(redisReplayKey)) {
+		t.Error("metrics_replay not emptied")
+	}
+	// Replayed in their order: the window holds them newest first.
+	l, _ := mr.List(svc.streamKey(redisWindowKey, defaultStream))
+	if len(l) == 0 || l[0] != "19" || l[len(l)-1] != "0" {
+		t.Errorf("window %v, want 19 down to 0", l)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// sourceInfo is a stream as /sources shows it, with the anomaly history
+// retention the workers apply to it.
+type sourceInfo struct {
+	Source             string `json:"source"`
+	AnomalyRetention   string `json:"anomalyRetention"`
+	AnomalyHistorySize int    `json:"anomalyHistorySize"`
+	// RetentionFrom is "stream" for an ANOMALY_RETENTION_BY_STREAM entry
+	// and "default" for the global settings.
+	RetentionFrom string `json:"retentionFrom"`
+	// ProcessedPerSecond is the smoothed rate at which this replica's
+	// workers process the stream.
+	ProcessedPerSecond float64 `json:"processedPerSecond"`
+	// Expected marks a stream added through /admin/sources; LastSeen and
+	// Down are only set for those.
+	Expected bool  `json:"expected"`
+	LastSeen int64 `json:"lastSeen,omitempty"`
+	Down     bool  `json:"down,omitempty"`
+}
+
+// handleSources lists the streams known to any replica together with the
+// expected ones and those ANOMALY_RETENTION_BY_STREAM names, sorted by
+// name. Processing rates
+// are those of this replica.
+func (s *Service) handleSources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	names, err := s.redis().SMembers(s.ctx, s.key(redisStreamsKey)).Result()
+	if err != nil {
+		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	expected, err := s.expectedSources(r.Context())
+	if err != nil {
+		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+	add := func(name string) {
+		if !known[name] {
+			known[name] = true
+			names = append(names, name)
+		}
+	}
+	byName := make(map[string]expectedSource, len(expected))
+	for _, e := range expected {
+		byName[e.Source] = e
+		add(e.Source)
+	}
+	for name := range s.cfg.AnomalyRetentionByStream {
+		add(name)
+	}
+	sort.Strings(names)
+
+	out := make([]sourceInfo, len(names))
+	for i, name := range names {
+		pol, own := s.historyRetention(name)
+		out[i] = sourceInfo{
+			Source:             name,
+			AnomalyRetention:   pol.Retention.String(),
+			AnomalyHistorySize: pol.Size,
+			RetentionFrom:      "default",
+			ProcessedPerSecond: s.rates.rate(name),
+		}
+		if own {
+			out[i].RetentionFrom = "stream"
+		}
+		if e, ok := byName[name]; ok {
+			out[i].Expected, out[i].LastSeen, out[i].Down = true, e.LastSeen, e.Down
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
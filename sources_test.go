@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestHandleSources(t *testing.T) {
+	svc, mr := newTestService(t, "ANOMALY_HISTORY_SIZE", "5", "ANOMALY_RETENTION", "1h",
+		"ANOMALY_RETENTION_BY_STREAM", "vip=720h:10")
+	mr.SAdd(svc.key(redisStreamsKey), defaultStream, "web")
+
+	rec := httptest.NewRecorder()
+	svc.handleSources(rec, httptest.NewRequest(http.MethodGet, "/sources", nil))
+	var got []sourceInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(rec.Code, rec.Body)
+	}
+	want := []sourceInfo{
+		{Source: defaultStream, AnomalyRetention: "1h0m0s", AnomalyHistorySize: 5, RetentionFrom: "default"},
+		{Source: "vip", AnomalyRetention: "720h0m0s", AnomalyHistorySize: 10, RetentionFrom: "stream"},
+		{Source: "web", AnomalyRetention: "1h0m0s", AnomalyHistorySize: 5, RetentionFrom: "default"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// overloadSpill moves metrics that find metricsCh full to a Redis list
+	// instead of rejecting them; refillLoop feeds them back as workers
+	// make room.
+	overloadSpill = "spill"
+
+	// redisSpillKey is the overflow list of INGEST_OVERLOAD_POLICY=spill,
+	// oldest first.
+	redisSpillKey = "metrics_spill"
+
+	defaultSpillMax  = 100_000
+	spillRefillEvery = 100 * time.Millisecond
+	// spillRefillBatch caps the metrics taken off the list in one round trip.
+	spillRefillBatch = 1000
+)
+
+var (
+	ingestSpilled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ingest_spilled_total",
+		Help: "Metrics moved to and back from the Redis overflow list with INGEST_OVERLOAD_POLICY=spill, by direction",
+	}, []string{"direction"})
+	spillLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ingest_spill_length",
+		Help: "Metrics waiting in the Redis overflow list",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(ingestSpilled, spillLength)
+	serviceRegistry.MustRegister(ingestSpilled, spillLength)
+}
+
+// spillOverflow appends m to the overflow list, or returns errOverloaded
+// once the list holds INGEST_SPILL_MAX metrics or Redis cannot take it.
+// The caller holds intakeMu.
+func (s *Service) spillOverflow(ctx context.Context, m Metric) error {
+	if s.spillLen.Load() >= int64(s.cfg.SpillMax) {
+		return errOverloaded
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	n, err := s.redis().RPush(ctx, s.key(redisSpillKey), b).Result()
+	if err != nil {
+		return fmt.Errorf("%w: spill: %v", errOverloaded, err)
+	}
+	s.spillLen.Store(n)
+	spillLength.Set(float64(n))
+	ingestSpilled.WithLabelValues("out").Inc()
+	return nil
+}
+
+// refillLoop calls refill every spillRefillEvery until the service starts
+// stopping. What is still spilled then stays in Redis for the next start.
+func (s *Service) refillLoop() {
+	t := time.NewTicker(spillRefillEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-t.C:
+			s.refill()
+		}
+	}
+}
+
+// refill moves metrics from the head of the overflow list into the free
+// room of metricsCh. The list is shared by the replicas with the same
+// REDIS_KEY_PREFIX, so its length is read back every time.
+func (s *Service) refill() {
+	rdb, key := s.redis(), s.key(redisSpillKey)
+	if s.spillLen.Load() > 0 {
+		n, err := s.refillFrom(key)
+		ingestSpilled.WithLabelValues("in").Add(float64(n))
+		if err != nil {
+			return
+		}
+	}
+	n, err := rdb.LLen(s.ctx, key).Result()
+	if err != nil {
+		slog.Error("redis LLEN failed", "key", key, "err", err)
+		return
+	}
+	s.spillLen.Store(n)
+	spillLength.Set(float64(n))
+}
+
+// refillFrom moves metrics from the head of the list at key into the free
+// room of metricsCh and returns how many it moved. Metrics that lose the
+// race for that room to intake go back to the head in their order.
+func (s *Service) refillFrom(key string) (int, error) {
+	rdb := s.redis()
+	room := min(cap(s.metricsCh)-len(s.metricsCh), spillRefillBatch)
+	if room <= 0 {
+		return 0, nil
+	}
+	vals, err := rdb.LPopCount(s.ctx, key, room).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		slog.Error("redis LPOP failed", "key", key, "err", err)
+		return 0, err
+	}
+	n, rest := s.requeue(vals)
+	if len(rest) > 0 {
+		args := make([]any, len(rest))
+		for i, v := range rest {
+			args[len(rest)-1-i] = v
+		}
+		if err := rdb.LPush(s.ctx, key, args...).Err(); err != nil {
+			slog.Error("redis LPUSH failed, metrics lost", "key", key, "samples", len(rest), "err", err)
+		}
+	}
+	return n, nil
+}
+
+// requeue puts listed metrics into metricsCh without waiting and returns
+// how many it queued and those that found no room or came after the
+// service started stopping.
+func (s *Service) requeue(vals []string) (int, []string) {
+	s.intakeMu.RLock()
+	defer s.intakeMu.RUnlock()
+	select {
+	case <-s.stopping:
+		return 0, vals
+	default:
+	}
+	n := 0
+	defer s.reportQueueDepth()
+	for i, v := range vals {
+		var m Metric
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			slog.Warn("dropping corrupt listed metric", "err", err)
+			continue
+		}
+		select {
+		case s.metricsCh <- m:
+			n++
+		default:
+			return n, vals[i:]
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSpillRefill(t *testing.T) {
+	svc, mr := newTestService(t, "CHANNEL_CAPACITY", "2", "INGEST_OVERLOAD_POLICY", "spill", "INGEST_SPILL_MAX", "3")
+	ctx := context.Background()
+	key := svc.key(redisSpillKey)
+	enqueue := func(rps float64) error {
+		return svc.enqueue(ctx, Metric{RPS: rps}, svc.cfg.OverloadPolicy)
+	}
+	queued := func() []float64 {
+		var out []float64
+		for len(svc.metricsCh) > 0 {
+			out = append(out, (<-svc.metricsCh).RPS)
+		}
+		return out
+	}
+	spilled := func() []float64 {
+		vals, _ := mr.List(key)
+		var out []float64
+		for _, v := range vals {
+			var m Metric
+			if err := json.Unmarshal([]byte(v), &m); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, m.RPS)
+		}
+		return out
+	}
+
+	for i := range 5 {
+		if err := enqueue(float64(i)); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err := enqueue(5); !errors.Is(err, errOverloaded) {
+		t.Fatalf("enqueue past INGEST_SPILL_MAX: %v", err)
+	}
+	if got := spilled(); !slices.Equal(got, []float64{2, 3, 4}) {
+		t.Fatalf("spilled %v", got)
+	}
+
+	// Room for one: the head moves, the rest stays in order.
+	<-svc.metricsCh
+	svc.refill()
+	if got := spilled(); !slices.Equal(got, []float64{3, 4}) || svc.spillLen.Load() != 2 {
+		t.Fatalf("after refilling one: spilled %v, spillLen %d", got, svc.spillLen.Load())
+	}
+	// While the list is not empty, new metrics join its tail even when the
+	// channel has room, so they are scored after the spilled ones.
+	<-svc.metricsCh
+	if err := enqueue(6); err != nil {
+		t.Fatal(err)
+	}
+	if got := spilled(); !slices.Equal(got, []float64{3, 4, 6}) {
+		t.Fatalf("spilled %v", got)
+	}
+	if got := queued(); !slices.Equal(got, []float64{2}) {
+		t.Fatalf("queued %v, want [2]", got)
+	}
+	svc.refill()
+	if got := queued(); !slices.Equal(got, []float64{3, 4}) {
+		t.Fatalf("refilled %v, want [3 4]", got)
+	}
+	svc.refill()
+	if got := queued(); !slices.Equal(got, []float64{6}) || svc.spillLen.Load() != 0 {
+		t.Fatalf("refilled %v, spillLen %d", got, svc.spillLen.Load())
+	}
+
+	// Once the list is empty, metrics go to the channel again.
+	if err := enqueue(7); err != nil {
+		t.Fatal(err)
+	}
+	if got := queued(); !slices.Equal(got, []float64{7}) || len(spilled()) != 0 {
+		t.Fatalf("queued %v, spilled %v", got, spilled())
+	}
+}
+
+func TestRefillDropsCorrupt(t *testing.T) {
+	svc, mr := newTestService(t, "INGEST_OVERLOAD_POLICY", "spill")
+	key := svc.key(redisSpillKey)
+	mr.RPush(key, `{"rps":1}`, "not json", `{"rps":2}`)
+	svc.spillLen.Store(3)
+	svc.refill()
+	if len(svc.metricsCh) != 2 || svc.spillLen.Load() != 0 || mr.Exists(key) {
+		t.Errorf("queued %d, spillLen %d, list left: %v", len(svc.metricsCh), svc.spillLen.Load(), mr.Exists(key))
+	}
+}
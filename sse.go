@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	sseHeartbeat = 15 * time.Second
+
+	defaultSSEMaxClients = 100
+	defaultSSEBuffer     = 64
+	maxSSEBuffer         = 10_000
+)
+
+var sseClients = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sse_clients",
+	Help: "Clients connected to the analysis event stream",
+})
+
+func init() {
+	prometheus.MustRegister(sseClients)
+	serviceRegistry.MustRegister(sseClients)
+}
+
+// handleStream pushes every new analysis of ?stream= to the client as a
+// Server-Sent Event. With ?flips=true only analyses whose isAnomaly differs
+// from the previous one are sent. A client that falls behind loses frames
+// (see broadcaster) rather than slowing the workers, and a comment line is
+// written every sseHeartbeat so idle proxies keep the connection open. At
+// most SSE_MAX_CLIENTS clients are connected at once; the buffer of each
+// holds SSE_BUFFER analyses. Analyses of other replicas only arrive with
+// BROADCAST=redis; see publishUpdates.
+func (s *Service) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	stream, err := s.streamParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flipsOnly, _ := strconv.ParseBool(r.URL.Query().Get("flips"))
+	samples := wantSamples(r)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case s.sseSlots <- struct{}{}:
+		sseClients.Inc()
+		defer func() {
+			<-s.sseSlots
+			sseClients.Dec()
+		}()
+	default:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "too many stream clients", http.StatusServiceUnavailable)
+		return
+	}
+
+	sub := s.updates.subscribe(stream, s.cfg.SSEBuffer)
+	defer s.updates.unsubscribe(sub)
+
+	s.extendWriteDeadline(w, 0)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	var last *bool
+	for {
+		select {
+		case anal := <-sub:
+			if flipsOnly && last != nil && *last == anal.IsAnomaly {
+				continue
+			}
+			last = &anal.IsAnomaly
+			if !samples {
+				anal.Samples = nil
+			}
+			b, err := json.Marshal(anal)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		}
+	}
+}
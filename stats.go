@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+// parseWindow converts a Redis list to numbers. Entries that do not parse or
+// parse to NaN/Inf (written before ingest validated them) are skipped so they
+// cannot poison the statistics.
+func parseWindow(values []string) []float64 {
+	nums := make([]float64, 0, len(values))
+	for _, v := range values {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			continue
+		}
+		nums = append(nums, f)
+	}
+	return nums
+}
+
+func meanStdDev(nums []float64) (mean, stddev float64) {
+	if len(nums) == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for _, x := range nums {
+		sum += x
+	}
+	mean = sum / float64(len(nums))
+
+	var variance float64
+	for _, x := range nums {
+		d := x - mean
+		variance += d * d
+	}
+	variance /= float64(len(nums))
+	return mean, math.Sqrt(variance)
+}
+
+// decayedMeanStdDev weights the i-th newest sample by decay^i, so recent
+// behaviour dominates the baseline. nums must be ordered newest first, as
+// returned by LRANGE on the window.
+func decayedMeanStdDev(nums []float64, decay float64) (mean, stddev float64) {
+	if len(nums) == 0 {
+		return 0, 0
+	}
+	var sum, wsum float64
+	w := 1.0
+	for _, x := range nums {
+		sum += w * x
+		wsum += w
+		w *= decay
+	}
+	mean = sum / wsum
+
+	var variance float64
+	w = 1.0
+	for _, x := range nums {
+		d := x - mean
+		variance += w * d * d
+		w *= decay
+	}
+	variance /= wsum
+	return mean, math.Sqrt(variance)
+}
+
+func zScore(x, mean, stddev float64, count int) float64 {
+	if count > 1 && stddev > 0 {
+		return (x - mean) / stddev
+	}
+	return 0
+}
+
+// percentDeviation is how far x is from mean in percent of mean. A zero mean
+// has no meaningful relative deviation and yields 0.
+func percentDeviation(x, mean float64) float64 {
+	if mean == 0 {
+		return 0
+	}
+	return (x - mean) / math.Abs(mean) * 100
+}
+
+// correlation returns the Pearson correlation of the overlapping prefix of a
+// and b, or 0 when either series is constant.
+func correlation(a, b []float64) float64 {
+	n := min(len(a), len(b))
+	if n < 2 {
+		return 0
+	}
+	a, b = a[:n], b[:n]
+	ma, sa := meanStdDev(a)
+	mb, sb := meanStdDev(b)
+	if sa == 0 || sb == 0 {
+		return 0
+	}
+	var cov float64
+	for i := range n {
+		cov += (a[i] - ma) * (b[i] - mb)
+	}
+	cov /= float64(n)
+	return cov / (sa * sb)
+}
+
+type histogram struct {
+	Min    float64   `json:"min"`
+	Max    float64   `json:"max"`
+	Edges  []float64 `json:"edges"`
+	Counts []int     `json:"counts"`
+}
+
+// buildHistogram buckets nums into bins equal-width bins between the window
+// min and max. The last bin is closed so that max is counted.
+func buildHistogram(nums []float64, bins int) histogram {
+	h := histogram{Edges: []float64{}, Counts: []int{}}
+	if len(nums) == 0 {
+		return h
+	}
+
+	h.Min, h.Max = nums[0], nums[0]
+	for _, x := range nums {
+		h.Min = math.Min(h.Min, x)
+		h.Max = math.Max(h.Max, x)
+	}
+
+	width := (h.Max - h.Min) / float64(bins)
+	h.Edges = make([]float64, bins+1)
+	for i := range h.Edges {
+		h.Edges[i] = h.Min + float64(i)*width
+	}
+	h.Edges[bins] = h.Max
+
+	h.Counts = make([]int, bins)
+	for _, x := range nums {
+		i := 0
+		if width > 0 {
+			i = min(int((x-h.Min)/width), bins-1)
+		}
+		h.Counts[i]++
+	}
+	return h
+}
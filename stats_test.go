@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPercentDeviation(t *testing.T) {
+	tests := []struct {
+		name     string
+		x, mean  float64
+		want     float64
+		wantZero bool
+	}{
+		{name: "zero mean and zero value", x: 0, mean: 0, want: 0},
+		{name: "zero mean and positive value", x: 42, mean: 0, want: 0},
+		{name: "zero mean and negative value", x: -42, mean: 0, want: 0},
+		{name: "above positive mean", x: 140, mean: 100, want: 40},
+		{name: "below positive mean", x: 75, mean: 100, want: -25},
+		{name: "above negative mean", x: -50, mean: -100, want: 50},
+		{name: "below negative mean", x: -150, mean: -100, want: -50},
+		{name: "zero value with negative mean", x: 0, mean: -20, want: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := percentDeviation(tt.x, tt.mean)
+			if math.IsNaN(got) || math.IsInf(got, 0) {
+				t.Fatalf("percentDeviation(%g, %g) = %g, want a finite number", tt.x, tt.mean, got)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("percentDeviation(%g, %g) = %g, want %g", tt.x, tt.mean, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+const (
+	defaultStream     = "default"
+	maxStreamNameLen  = 64
+	defaultMaxStreams = 100
+	// defaultStreamNamePattern allows letters, digits, '_', '-' and '.',
+	// which keeps names safe both in Redis keys and as label values.
+	defaultStreamNamePattern = `[A-Za-z0-9_.-]+`
+
+	// redisStreamsKey is a set of every stream that has an analysis, shared
+	// by all replicas; it backs /analyze/all.
+	redisStreamsKey = "streams"
+)
+
+var (
+	errInvalidStream = errors.New("invalid stream name")
+	errStreamLimit   = errors.New("stream limit reached")
+)
+
+// key prefixes base with REDIS_KEY_PREFIX.
+func (s *Service) key(base string) string {
+	return s.cfg.RedisKeyPrefix + base
+}
+
+// streamKey derives the Redis key of a per-stream structure. The default
+// stream keeps the unsuffixed key so data written before streams existed is
+// still picked up.
+func (s *Service) streamKey(base, stream string) string {
+	if stream == defaultStream {
+		return s.key(base)
+	}
+	return s.key(base) + ":" + stream
+}
+
+// compileNamePattern compiles STREAM_NAME_PATTERN so that it has to match
+// a whole name. The default stream is used without being named, so the
+// pattern must accept it.
+func compileNamePattern(p string) (*regexp.Regexp, error) {
+	if _, err := regexp.Compile(p); err != nil {
+		return nil, fmt.Errorf("STREAM_NAME_PATTERN: %w", err)
+	}
+	re := regexp.MustCompile(`^(?:` + p + `)$`)
+	if !re.MatchString(defaultStream) {
+		return nil, fmt.Errorf("STREAM_NAME_PATTERN %q must match the default stream name %q", p, defaultStream)
+	}
+	return re, nil
+}
+
+// validateStreamName accepts names of up to maxStreamNameLen characters
+// that match STREAM_NAME_PATTERN.
+func (s *Service) validateStreamName(name string) error {
+	return validateName(s.cfg.StreamNamePattern, name, errInvalidStream)
+}
+
+// validateSeriesName applies the stream name rules to the name of a series.
+func (s *Service) validateSeriesName(name string) error {
+	return validateName(s.cfg.StreamNamePattern, name, errInvalidSeries)
+}
+
+func validateName(pattern *regexp.Regexp, name string, errInvalid error) error {
+	if name == "" || len(name) > maxStreamNameLen {
+		return fmt.Errorf("%w: must be 1 to %d characters", errInvalid, maxStreamNameLen)
+	}
+	if !pattern.MatchString(name) {
+		return fmt.Errorf("%w %q: must match %s", errInvalid, name, pattern)
+	}
+	return nil
+}
+
+// nameSet tracks the streams or series this process has seen. Every name
+// becomes a label value on the per-stream and per-series gauges, so the set
+// is capped (MAX_STREAMS, MAX_SERIES) to keep Prometheus cardinality
+// bounded; metrics with new names beyond the cap are rejected.
+type nameSet struct {
+	mu       sync.Mutex
+	max      int
+	names    map[string]struct{}
+	noun     string
+	errLimit error
+}
+
+func newStreamSet(max int) *nameSet {
+	return &nameSet{max: max, names: map[string]struct{}{defaultStream: {}}, noun: "streams", errLimit: errStreamLimit}
+}
+
+func (ns *nameSet) admit(name string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if _, ok := ns.names[name]; ok {
+		return nil
+	}
+	if len(ns.names) >= ns.max {
+		return fmt.Errorf("%w: at most %d %s", ns.errLimit, ns.max, ns.noun)
+	}
+	ns.names[name] = struct{}{}
+	return nil
+}
+
+// admitStream fills in the default stream, checks the name and registers
+// it along with the metric's series. Ingest handlers call it on every
+// metric before it is queued.
+func (s *Service) admitStream(m *Metric) error {
+	if m.Source != "" {
+		if m.Stream != "" && m.Stream != m.Source {
+			return fmt.Errorf("%w: stream %q and source %q differ", errInvalidStream, m.Stream, m.Source)
+		}
+		m.Stream, m.Source = m.Source, ""
+	}
+	if m.Stream == "" {
+		m.Stream = defaultStream
+	}
+	if err := s.validateStreamName(m.Stream); err != nil {
+		return err
+	}
+	// The stream goes first, so a metric refused by MAX_STREAMS does not
+	// use up MAX_SERIES slots with its series.
+	if err := s.streams.admit(m.Stream); err != nil {
+		return err
+	}
+	for name := range m.Values {
+		if err := s.series.admit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamParam reads ?stream= (or its alias ?source=), defaulting to the
+// default stream.
+func (s *Service) streamParam(r *http.Request) (string, error) {
+	q := r.URL.Query()
+	name := q.Get("stream")
+	if name == "" {
+		name = q.Get("source")
+	}
+	if name == "" {
+		return defaultStream, nil
+	}
+	return name, s.validateStreamName(name)
+}
+
+// groupByStream splits an oldest-first batch into per-stream batches,
+// keeping the order within each stream and the order streams first appear.
+func groupByStream(batch []Metric) [][]Metric {
+	if len(batch) == 0 {
+		return nil
+	}
+	first := batch[0].Stream
+	same := true
+	for _, m := range batch[1:] {
+		if m.Stream != first {
+			same = false
+			break
+		}
+	}
+	if same {
+		return [][]Metric{batch}
+	}
+
+	idx := make(map[string]int)
+	var groups [][]Metric
+	for _, m := range batch {
+		i, ok := idx[m.Stream]
+		if !ok {
+			i = len(groups)
+			idx[m.Stream] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], m)
+	}
+	return groups
+}
+
+// handleAnalyzeAll returns the last analysis of every stream known to any
+// replica, sorted by stream name, without anomaly samples.
+func (s *Service) handleAnalyzeAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+
+	names, err := s.redis().SMembers(s.ctx, s.key(redisStreamsKey)).Result()
+	if err != nil {
+		http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	sort.Strings(names)
+
+	out := make([]Analysis, 0, len(names))
+	if len(names) > 0 {
+		keys := make([]string, len(names))
+		for i, name := range names {
+			keys[i] = s.streamKey(redisLastKey, name)
+		}
+		vals, err := s.redis().MGet(s.ctx, keys...).Result()
+		if err != nil {
+			http.Error(w, "redis error: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		for _, v := range vals {
+			str, ok := v.(string)
+			if !ok {
+				continue
+			}
+			var anal Analysis
+			if json.Unmarshal([]byte(str), &anal) != nil {
+				continue
+			}
+			anal.Samples = nil
+			out = append(out, anal)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAdmitStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		metrics    []Metric
+		wantErr    []error
+		wantSeries int
+	}{
+		{
+			name: "refused stream does not take series slots",
+			metrics: []Metric{
+				{Stream: "a", Values: map[string]float64{"x": 1}},
+				{Stream: "b", Values: map[string]float64{"y": 1}},
+				{Stream: "a", Values: map[string]float64{"z": 1}},
+			},
+			wantErr:    []error{nil, errStreamLimit, nil},
+			wantSeries: 2,
+		},
+		{
+			name: "source is an alias of stream",
+			metrics: []Metric{
+				{Source: "a"},
+				{Stream: "a", Source: "a"},
+				{Stream: "a", Source: "b"},
+			},
+			wantErr: []error{nil, nil, errInvalidStream},
+		},
+		{
+			name:    "default stream is admitted at the limit",
+			metrics: []Metric{{Stream: "a"}, {Stream: "c"}, {}, {Stream: defaultStream}},
+			wantErr: []error{nil, errStreamLimit, nil, nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// default plus one more stream, two series.
+			svc, _ := newTestService(t, "MAX_STREAMS", "2", "MAX_SERIES", "2")
+			for i, m := range tt.metrics {
+				if err := svc.admitStream(&m); !errors.Is(err, tt.wantErr[i]) {
+					t.Errorf("metric %d: %v, want %v", i, err, tt.wantErr[i])
+				}
+			}
+			svc.series.mu.Lock()
+			n := len(svc.series.names)
+			svc.series.mu.Unlock()
+			if n != tt.wantSeries {
+				t.Errorf("%d series admitted, want %d", n, tt.wantSeries)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a metric field is rejected, as reported in 422 responses and
+// in validation_rejects_total.
+const (
+	rejectMissing     = "missing_field"
+	rejectNotFinite   = "not_finite"
+	rejectNegative    = "negative"
+	rejectOutOfRange  = "out_of_range"
+	rejectFuture      = "timestamp_in_future"
+	rejectTooOld      = "timestamp_too_old"
+	rejectInvalidName = "invalid_name"
+)
+
+var validationRejects = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "validation_rejects_total",
+	Help: "Metrics rejected by ingest validation by reason; a metric counts once per distinct reason",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(validationRejects)
+	serviceRegistry.MustRegister(validationRejects)
+}
+
+// metricFields records which fields a JSON metric carried, so a required
+// field sent as 0 can be told apart from a missing one. Metrics that did
+// not come from JSON (gRPC, remote_write) have no fieldsDecoded bit and
+// skip VALIDATE_REQUIRED.
+type metricFields uint8
+
+const (
+	fieldTimestamp metricFields = 1 << iota
+	fieldCPU
+	fieldRPS
+	fieldStream
+	fieldsDecoded
+)
+
+var requiredFields = map[string]metricFields{
+	"timestamp": fieldTimestamp,
+	"cpu":       fieldCPU,
+	"rps":       fieldRPS,
+	"stream":    fieldStream,
+}
+
+func (m *Metric) UnmarshalJSON(b []byte) error {
+	type plain Metric
+	aux := struct {
+		*plain
+		Timestamp *int64   `json:"timestamp"`
+		CPU       *float64 `json:"cpu"`
+		RPS       *float64 `json:"rps"`
+	}{plain: (*plain)(m)}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	m.sent = fieldsDecoded
+	if aux.Timestamp != nil {
+		m.Timestamp, m.sent = *aux.Timestamp, m.sent|fieldTimestamp
+	}
+	if aux.CPU != nil {
+		m.CPU, m.sent = *aux.CPU, m.sent|fieldCPU
+	}
+	if aux.RPS != nil {
+		m.RPS, m.sent = *aux.RPS, m.sent|fieldRPS
+	}
+	if m.Stream != "" || m.Source != "" {
+		m.sent |= fieldStream
+	}
+	return nil
+}
+
+// parseRequiredFields reads VALIDATE_REQUIRED, a comma-separated list of
+// timestamp, cpu, rps and stream.
+func parseRequiredFields(v string) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if _, ok := requiredFields[f]; !ok {
+			return nil, fmt.Errorf("VALIDATE_REQUIRED: unknown field %q, want timestamp, cpu, rps or stream", f)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// fieldError is one failed rule of a metric.
+type fieldError struct {
+	Field   string `json:"field"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// validationError lists every failed rule of a metric, not just the first.
+type validationError struct {
+	Fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// validateMetric rejects metrics that would poison the window statistics:
+// NaN and infinities never leave the window's mean once pushed, CPU and
+// RPS cannot be negative, and a timestamp far in the future would sort
+// ahead of everything sent after it. On top of that come the configured
+// rules: required fields, upper bounds for CPU and RPS, and the timestamp
+// skew and age. The age limit does not apply to backfill, which is old by
+// design. Unlike CPU and RPS, named series may be negative.
+func (s *Service) validateMetric(m Metric, backfill bool) error {
+	var fields []fieldError
+	reject := func(field, reason, format string, args ...any) {
+		fields = append(fields, fieldError{Field: field, Reason: reason, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if m.sent&fieldsDecoded != 0 {
+		for _, f := range s.cfg.RequiredFields {
+			if m.sent&requiredFields[f] == 0 {
+				reject(f, rejectMissing, "%s is required", f)
+			}
+		}
+	}
+
+	for _, f := range []struct {
+		name string
+		v    float64
+		max  float64
+	}{{"cpu", m.CPU, s.cfg.ValidateCPUMax}, {"rps", m.RPS, s.cfg.ValidateRPSMax}} {
+		switch {
+		case math.IsNaN(f.v) || math.IsInf(f.v, 0):
+			reject(f.name, rejectNotFinite, "%s must be a finite number", f.name)
+		case f.v < 0:
+			reject(f.name, rejectNegative, "%s must not be negative, got %g", f.name, f.v)
+		case f.max > 0 && f.v > f.max:
+			reject(f.name, rejectOutOfRange, "%s must be at most %g, got %g", f.name, f.max, f.v)
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case m.Timestamp < 0:
+		reject("timestamp", rejectNegative, "timestamp must not be negative, got %d", m.Timestamp)
+	case s.cfg.ValidateMaxSkew > 0 && m.Timestamp > now.Add(s.cfg.ValidateMaxSkew).Unix():
+		reject("timestamp", rejectFuture, "timestamp must be at most %s in the future, got %d", s.cfg.ValidateMaxSkew, m.Timestamp)
+	case !backfill && s.cfg.ValidateMaxAge > 0 && m.Timestamp < now.Add(-s.cfg.ValidateMaxAge).Unix():
+		reject("timestamp", rejectTooOld, "timestamp must be at most %s in the past, got %d", s.cfg.ValidateMaxAge, m.Timestamp)
+	}
+
+	for _, f := range []struct{ field, name string }{{"stream", m.Stream}, {"source", m.Source}} {
+		if f.name != "" {
+			if err := s.validateStreamName(f.name); err != nil {
+				reject(f.field, rejectInvalidName, "%v", err)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(m.Values))
+	for name := range m.Values {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		field := "values." + name
+		if err := s.validateSeriesName(name); err != nil {
+			reject(field, rejectInvalidName, "%v", err)
+		} else if v := m.Values[name]; math.IsNaN(v) || math.IsInf(v, 0) {
+			reject(field, rejectNotFinite, "%s must be a finite number", field)
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+	counted := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if !counted[f.Reason] {
+			counted[f.Reason] = true
+			validationRejects.WithLabelValues(f.Reason).Inc()
+		}
+	}
+	return &validationError{Fields: fields}
+}
+
+// fieldErrors returns the failed fields of a validation error, or nil for
+// any other error.
+func fieldErrors(err error) []fieldError {
+	var verr *validationError
+	if errors.As(err, &verr) {
+		return verr.Fields
+	}
+	return nil
+}
+
+// writeValidationError answers 422 with the failed fields of a metric.
+func writeValidationError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error  string       `json:"error"`
+		Fields []fieldError `json:"fields"`
+	}{"invalid metric", fieldErrors(err)})
+}
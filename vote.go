@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type WindowVote struct {
+	Window  int     `json:"window" msgpack:"window" unit:"samples" desc:"number of newest samples this vote looked at"`
+	ZScore  float64 `json:"zScore" msgpack:"zScore" unit:"dimensionless" desc:"z-score of the latest value against this window"`
+	Anomaly bool    `json:"anomaly" msgpack:"anomaly" desc:"true if the absolute z-score exceeds thresholdZ"`
+}
+
+type VoteResult struct {
+	Policy   string       `json:"policy" msgpack:"policy" desc:"all, majority, any or the number of votes required"`
+	Required int          `json:"required" msgpack:"required" unit:"votes" desc:"anomalous votes needed to flag the sample"`
+	Votes    []WindowVote `json:"votes" msgpack:"votes" desc:"per-window verdicts"`
+	Passed   bool         `json:"passed" msgpack:"passed" desc:"combined decision of the vote"`
+}
+
+// voteWindows scores value against the newest w samples for each configured
+// window size and combines the verdicts per VotePolicy. nums is the full
+// window, newest first.
+func (s *Service) voteWindows(value float64, nums []float64) *VoteResult {
+	res := &VoteResult{
+		Policy:   s.cfg.VotePolicy,
+		Required: votesRequired(s.cfg.VotePolicy, len(s.cfg.VoteWindows)),
+		Votes:    make([]WindowVote, 0, len(s.cfg.VoteWindows)),
+	}
+
+	anomalous := 0
+	for _, w := range s.cfg.VoteWindows {
+		sub := nums[:min(w, len(nums))]
+		mean, stddev := s.baseline(sub)
+		z := zScore(value, mean, stddev, len(sub))
+		v := WindowVote{Window: w, ZScore: z, Anomaly: math.Abs(z) > s.tuning().ZThreshold}
+		if v.Anomaly {
+			anomalous++
+		}
+		res.Votes = append(res.Votes, v)
+	}
+	res.Passed = anomalous >= res.Required
+	return res
+}
+
+func votesRequired(policy string, n int) int {
+	switch policy {
+	case "all":
+		return n
+	case "any":
+		return 1
+	case "majority":
+		return n/2 + 1
+	}
+	k, _ := strconv.Atoi(policy)
+	return k
+}
+
+func parseVoteWindows(v string, maxWindow int) ([]int, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var out []int
+	for _, f := range strings.Split(v, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("VOTE_WINDOWS: %w", err)
+		}
+		if n < 2 || n > maxWindow {
+			return nil, fmt.Errorf("VOTE_WINDOWS: window %d must be between 2 and %d", n, maxWindow)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func validateVotePolicy(policy string, windows int) error {
+	switch policy {
+	case "all", "any", "majority":
+		return nil
+	}
+	k, err := strconv.Atoi(policy)
+	if err != nil || k < 1 || k > windows {
+		return fmt.Errorf("VOTE_POLICY must be all, any, majority or a number between 1 and %d, got %q", windows, policy)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestVoteWindows(t *testing.T) {
+	// Newest first: the five newest samples are steady around 100, the five
+	// before them swing widely, so short windows see 110 as an anomaly and
+	// the 10-sample window does not.
+	window := []float64{100, 101, 99, 100, 101, 40, 160, 40, 160, 40}
+
+	tests := []struct {
+		name       string
+		windows    []int
+		policy     string
+		value      float64
+		nums       []float64
+		wantVotes  []bool
+		wantPassed bool
+	}{
+		{name: "all agree on an anomaly", windows: []int{5, 10}, policy: "all", value: 300, nums: window,
+			wantVotes: []bool{true, true}, wantPassed: true},
+		{name: "all agree on normal", windows: []int{5, 10}, policy: "any", value: 100, nums: window,
+			wantVotes: []bool{false, false}, wantPassed: false},
+		{name: "majority of three", windows: []int{3, 5, 10}, policy: "majority", value: 110, nums: window,
+			wantVotes: []bool{true, true, false}, wantPassed: true},
+		{name: "majority short of all", windows: []int{3, 5, 10}, policy: "all", value: 110, nums: window,
+			wantVotes: []bool{true, true, false}, wantPassed: false},
+		{name: "tie fails majority", windows: []int{5, 10}, policy: "majority", value: 110, nums: window,
+			wantVotes: []bool{true, false}, wantPassed: false},
+		{name: "tie passes one required", windows: []int{5, 10}, policy: "1", value: 110, nums: window,
+			wantVotes: []bool{true, false}, wantPassed: true},
+		{name: "single detector", windows: []int{5}, policy: "majority", value: 110, nums: window,
+			wantVotes: []bool{true}, wantPassed: true},
+		{name: "detector without variance", windows: []int{3}, policy: "any", value: 500, nums: []float64{100, 100, 100},
+			wantVotes: []bool{false}, wantPassed: false},
+		{name: "detector without enough samples", windows: []int{5, 10}, policy: "any", value: 500, nums: []float64{100},
+			wantVotes: []bool{false, false}, wantPassed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Service{cfg: Config{VoteWindows: tt.windows, VotePolicy: tt.policy}}
+			s.tune.Store(&runtimeTuning{effective: tuning{WindowSize: 10, ZThreshold: 2, Detector: detectorWindow}})
+
+			res := s.voteWindows(tt.value, tt.nums)
+			var votes []bool
+			for _, v := range res.Votes {
+				votes = append(votes, v.Anomaly)
+			}
+			if !slices.Equal(votes, tt.wantVotes) {
+				t.Errorf("votes = %v, want %v (%+v)", votes, tt.wantVotes, res.Votes)
+			}
+			if res.Passed != tt.wantPassed {
+				t.Errorf("passed = %v, want %v (required %d)", res.Passed, tt.wantPassed, res.Required)
+			}
+			if res.Policy != tt.policy {
+				t.Errorf("policy = %q, want %q", res.Policy, tt.policy)
+			}
+		})
+	}
+}
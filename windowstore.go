@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	windowStoreRedis  = "redis"
+	windowStoreMemory = "memory"
+)
+
+// ring is a window of the newest values, newest first, with the running sum
+// and sum of squares of its values. The sums are taken relative to ref, the
+// mean at the last exact recomputation, so they do not cancel badly for
+// large values with a small spread; they are recomputed every time the
+// buffer is compacted, which keeps rounding errors from accumulating.
+type ring struct {
+	size    int
+	buf     []float64
+	head, n int
+
+	ref, sum, sumSq float64
+}
+
+func newRing(size int) *ring {
+	return &ring{size: size, buf: make([]float64, 2*size), head: 2 * size}
+}
+
+func (r *ring) push(x float64) {
+	if r.n == r.size {
+		d := r.buf[r.head+r.n-1] - r.ref
+		r.sum -= d
+		r.sumSq -= d * d
+		r.n--
+	}
+	if r.head == 0 {
+		r.head = len(r.buf) - r.n
+		copy(r.buf[r.head:], r.buf[:r.n])
+		r.recompute()
+	}
+	r.head--
+	r.buf[r.head] = x
+	r.n++
+	d := x - r.ref
+	r.sum += d
+	r.sumSq += d * d
+}
+
+func (r *ring) clone() *ring {
+	c := *r
+	c.buf = slices.Clone(r.buf)
+	return &c
+}
+
+func (r *ring) recompute() {
+	r.ref, _ = meanStdDev(r.view())
+	r.sum, r.sumSq = 0, 0
+	for _, x := range r.view() {
+		d := x - r.ref
+		r.sum += d
+		r.sumSq += d * d
+	}
+}
+
+// view returns the window newest first. It aliases the buffer and is only
+// valid until the next push.
+func (r *ring) view() []float64 {
+	return r.buf[r.head : r.head+r.n]
+}
+
+// meanStdDev is the O(1) equivalent of meanStdDev(r.view()).
+func (r *ring) meanStdDev() (mean, stddev float64) {
+	if r.n == 0 {
+		return 0, 0
+	}
+	n := float64(r.n)
+	d := r.sum / n
+	return r.ref + d, math.Sqrt(max(r.sumSq/n-d*d, 0))
+}
+
+// streamWindows is the in-memory state of one stream: the RPS, CPU and
+// named series windows (not kept with the EWMA detector) and, with
+// smoothing, the raw RPS values.
+type streamWindows struct {
+	mu     sync.Mutex
+	loaded bool
+	dirty  bool
+
+	rps, cpu, raw *ring
+	series        map[string]*ring
+}
+
+// windowStore keeps the windows of every stream in process memory
+// (WINDOW_STORE=memory), so scoring a batch takes no Redis round trip. The
+// windows are written to their usual Redis lists every
+// WINDOW_SNAPSHOT_INTERVAL and when draining, and a stream's window is read
+// back from Redis the first time this process sees the stream. Windows are
+// per replica: two replicas fed the same stream keep separate windows and
+// overwrite each other's snapshots.
+type windowStore struct {
+	mu      sync.Mutex
+	streams map[string]*streamWindows
+}
+
+func newWindowStore() *windowStore {
+	return &windowStore{streams: make(map[string]*streamWindows)}
+}
+
+// lockWindows returns the windows of stream locked, restoring them from Redis on
+// first use.
+func (s *Service) lockWindows(rdb *redis.Client, stream string) (*streamWindows, error) {
+	s.windows.mu.Lock()
+	w, ok := s.windows.streams[stream]
+	if !ok {
+		w = &streamWindows{}
+		if s.cfg.Detector == detectorWindow {
+			w.rps, w.cpu = newRing(s.cfg.WindowSize), newRing(s.cfg.WindowSize)
+		}
+		if s.cfg.SmoothingWindow > 1 {
+			w.raw = newRing(s.cfg.SmoothingWindow)
+		}
+		s.windows.streams[stream] = w
+	}
+	s.windows.mu.Unlock()
+
+	w.mu.Lock()
+	if !w.loaded {
+		if err := s.restoreWindows(rdb, stream, w); err != nil {
+			w.mu.Unlock()
+			return nil, err
+		}
+		w.loaded = true
+	}
+	return w, nil
+}
+
+func (w *streamWindows) rings(s *Service, stream string) map[string]*ring {
+	m := make(map[string]*ring, 3+len(w.series))
+	for key, r := range map[string]*ring{
+		redisWindowKey:    w.rps,
+		redisCPUWindowKey: w.cpu,
+		redisRawWindowKey: w.raw,
+	} {
+		if r != nil {
+			m[s.streamKey(key, stream)] = r
+		}
+	}
+	for name, r := range w.series {
+		m[s.seriesKey(stream, name)] = r
+	}
+	return m
+}
+
+// readWindow returns up to size newest values of the window stored under
+// key (redisWindowKey, redisCPUWindowKey or redisRawWindowKey) of stream,
+// newest first. With WINDOW_STORE=memory the Redis list is only a snapshot,
+// so a window this process holds is read from memory; one it has not
+// loaded yet is read from its snapshot.
+func (s *Service) readWindow(stream, key string, size int) ([]float64, error) {
+	if s.windows != nil {
+		s.windows.mu.Lock()
+		w := s.windows.streams[stream]
+		s.windows.mu.Unlock()
+		if w != nil {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.loaded {
+				r := map[string]*ring{
+					redisWindowKey:    w.rps,
+					redisCPUWindowKey: w.cpu,
+					redisRawWindowKey: w.raw,
+				}[key]
+				if r == nil {
+					return nil, nil
+				}
+				v := r.view()
+				return slices.Clone(v[:min(len(v), size)]), nil
+			}
+		}
+	}
+	values, err := s.redis().LRange(s.ctx, s.streamKey(key, stream), 0, int64(size-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseWindow(values), nil
+}
+
+func (s *Service) restoreWindows(rdb *redis.Client, stream string, w *streamWindows) error {
+	return s.restoreRings(rdb, w.rings(s, stream))
+}
+
+// restoreRings fills empty rings from the Redis lists they are snapshotted
+// to, in one round trip.
+func (s *Service) restoreRings(rdb *redis.Client, rings map[string]*ring) error {
+	cmds := make(map[*ring]*redis.StringSliceCmd, len(rings))
+	_, err := rdb.Pipelined(s.ctx, func(p redis.Pipeliner) error {
+		for key, r := range rings {
+			cmds[r] = p.LRange(s.ctx, key, 0, int64(r.size-1))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redis restore window: %w", err)
+	}
+	for r, cmd := range cmds {
+		nums := parseWindow(cmd.Val())
+		for i := len(nums) - 1; i >= 0; i-- {
+			r.push(nums[i])
+		}
+	}
+	return nil
+}
+
+// scoreMemory is scoreWindow against the in-memory windows. Each sample is
+// pushed and then scored against the window as it looks right after, with
+// the mean and standard deviation taken from the running sums. A series
+// new to this process is first restored from its snapshot.
+func (s *Service) scoreMemory(rdb *redis.Client, stream string, w *streamWindows, batch []Metric, values []float64) ([]Analysis, error) {
+	fresh := make(map[string]*ring)
+	for _, m := range batch {
+		for name := range m.Values {
+			key := s.seriesKey(stream, name)
+			if _, ok := w.series[name]; !ok && fresh[key] == nil {
+				fresh[key] = newRing(s.cfg.WindowSize)
+			}
+		}
+	}
+	if len(fresh) > 0 {
+		if err := s.restoreRings(rdb, fresh); err != nil {
+			return nil, err
+		}
+		if w.series == nil {
+			w.series = make(map[string]*ring)
+		}
+		for _, m := range batch {
+			for name := range m.Values {
+				if r := fresh[s.seriesKey(stream, name)]; r != nil {
+					w.series[name] = r
+				}
+			}
+		}
+	}
+
+	anals := make([]Analysis, len(batch))
+	for i, m := range batch {
+		w.rps.push(values[i])
+		w.cpu.push(m.CPU)
+		var rps, cpu moments
+		if s.cfg.BaselineDecay > 0 {
+			rps.mean, rps.stddev = s.baseline(w.rps.view())
+			cpu.mean, cpu.stddev = s.baseline(w.cpu.view())
+		} else {
+			rps.mean, rps.stddev = w.rps.meanStdDev()
+			cpu.mean, cpu.stddev = w.cpu.meanStdDev()
+		}
+		anals[i] = s.score(m, values[i], w.rps.view(), w.cpu.view(), rps, cpu)
+		for name, v := range m.Values {
+			r := w.series[name]
+			r.push(v)
+			res := SeriesResult{Value: v, Count: r.n}
+			if s.cfg.BaselineDecay > 0 {
+				res.RollingAvg, res.StdDev = s.baseline(r.view())
+			} else {
+				res.RollingAvg, res.StdDev = r.meanStdDev()
+			}
+			res.ZScore = zScore(v, res.RollingAvg, res.StdDev, r.n)
+			setSeries(&anals[i], name, res)
+		}
+		s.flagSeries(&anals[i], s.tuning().ZThreshold)
+	}
+	w.dirty = true
+	return anals, nil
+}
+
+// smooth pushes values and returns their moving averages over the window.
+func (r *ring) smooth(values []float64) []float64 {
+	smoothed := make([]float64, len(values))
+	for i, v := range values {
+		r.push(v)
+		smoothed[i], _ = r.meanStdDev()
+	}
+	return smoothed
+}
+
+// snapshotLoop writes changed windows to Redis every interval until the
+// service starts stopping; Drain takes the final snapshot.
+func (s *Service) snapshotLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case <-t.C:
+			s.snapshotWindows()
+		}
+	}
+}
+
+// snapshotWindows replaces the Redis lists of every window changed since the
+// last snapshot, in one MULTI so a crash never leaves the RPS and CPU
+// windows of a stream out of step.
+func (s *Service) snapshotWindows() {
+	if s.windows == nil {
+		return
+	}
+	s.windows.mu.Lock()
+	var changed []*streamWindows
+	snap := make(map[string][]any)
+	for stream, w := range s.windows.streams {
+		w.mu.Lock()
+		if w.dirty {
+			for key, r := range w.rings(s, stream) {
+				vals := make([]any, r.n)
+				for i, x := range r.view() {
+					vals[i] = x
+				}
+				snap[key] = vals
+			}
+			w.dirty = false
+			changed = append(changed, w)
+		}
+		w.mu.Unlock()
+	}
+	s.windows.mu.Unlock()
+	if len(snap) == 0 {
+		return
+	}
+
+	write := func(ctx context.Context, c redis.Cmdable) error {
+		_, err := c.TxPipelined(ctx, func(tx redis.Pipeliner) error {
+			for key, vals := range snap {
+				tx.Del(ctx, key)
+				if len(vals) > 0 {
+					tx.RPush(ctx, key, vals...)
+				}
+			}
+			return nil
+		})
+		return err
+	}
+	if err := write(s.ctx, s.redis()); err != nil {
+		slog.Error("window snapshot failed", "streams", len(changed), "err", err)
+		for _, w := range changed {
+			w.mu.Lock()
+			w.dirty = true
+			w.mu.Unlock()
+		}
+		return
+	}
+	s.secondary.write(write)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestWindowEndpointsMemory checks that with WINDOW_STORE=memory the window
+// endpoints read the windows the workers hold, not the Redis snapshot.
+func TestWindowEndpointsMemory(t *testing.T) {
+	svc, mr := newTestService(t, "WINDOW_STORE", windowStoreMemory, "WINDOW_SNAPSHOT_INTERVAL", "1h",
+		"WINDOW_SIZE", "10", "WORKER_COUNT", "1", "BATCH_SIZE", "1")
+	// A stale snapshot from an earlier run.
+	mr.RPush(svc.streamKey(redisWindowKey, defaultStream), "100")
+	if err := svc.StartWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	for i := range 4 {
+		if err := svc.enqueue(context.Background(), Metric{Timestamp: now, CPU: 1, RPS: float64(i + 1), Stream: defaultStream}, overloadReject); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for svc.processed.Load() < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	want := []float64{4, 3, 2, 1, 100}
+	if l, _ := mr.List(svc.streamKey(redisWindowKey, defaultStream)); len(l) != 1 {
+		t.Fatalf("snapshot was written early: %v", l)
+	}
+
+	rec := httptest.NewRecorder()
+	svc.handleWindow(rec, httptest.NewRequest(http.MethodGet, "/window", nil))
+	var win struct {
+		Values []float64 `json:"values"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &win); err != nil {
+		t.Fatal(rec.Code, rec.Body)
+	}
+	if !slices.Equal(win.Values, want) {
+		t.Errorf("/window values %v, want %v", win.Values, want)
+	}
+
+	got, err := svc.readWindow(defaultStream, redisWindowKey, 2)
+	if err != nil || !slices.Equal(got, want[:2]) {
+		t.Errorf("readWindow with size 2: %v, %v, want %v", got, err, want[:2])
+	}
+
+	anal, err := svc.latestAnalysis(defaultStream, 3, svc.tuning().ZThreshold, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anal.Count != 3 {
+		t.Errorf("recomputed over %d samples, want 3", anal.Count)
+	}
+}